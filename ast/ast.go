@@ -0,0 +1,255 @@
+package ast
+
+import "github.com/chickencoder/run/scanner"
+
+// Pos is the position of a node within its source file. Most
+// nodes are positioned at their first token, whereas operators,
+// assignments, calls, dot access and indexing are positioned
+// at the operator token
+type Pos struct {
+	Line   int
+	Column int
+}
+
+// Position returns the position of a node
+func (p Pos) Position() Pos {
+	return p
+}
+
+// Node is any element of the syntax tree
+type Node interface {
+	Position() Pos
+}
+
+// Stmt is a statement node
+type Stmt interface {
+	Node
+	stmtNode()
+}
+
+// Expr is an expression node
+type Expr interface {
+	Node
+	exprNode()
+}
+
+// Program is the root of a parsed source file
+type Program struct {
+	Stmts []Stmt
+}
+
+// Statements
+
+// Block is a braced list of statements
+type Block struct {
+	Pos
+	Stmts []Stmt
+}
+
+// LetStmt declares a mutable variable with let, or an
+// immutable one with set
+type LetStmt struct {
+	Pos
+	Name     string
+	Constant bool // Declared with set
+	Value    Expr // nil if let was given no value
+}
+
+// AssignStmt stores a value into a variable, entity field or
+// collection item
+type AssignStmt struct {
+	Pos
+	Target Expr // *Ident, *DotExpr or *IndexExpr
+	Value  Expr
+}
+
+// ExprStmt evaluates an expression for its side effects
+type ExprStmt struct {
+	Pos
+	X Expr
+}
+
+// IfStmt runs Then if Cond is truthy, otherwise Else
+type IfStmt struct {
+	Pos
+	Cond Expr
+	Then *Block
+	Else Stmt // nil, *Block or *IfStmt
+}
+
+// ForStmt loops for as long as Cond is truthy, or
+// forever if Cond is nil
+type ForStmt struct {
+	Pos
+	Cond Expr
+	Body *Block
+}
+
+// ForOfStmt runs Body once for each item of a collection,
+// assigning the item to a mutable variable named Name
+type ForOfStmt struct {
+	Pos
+	Name       string
+	Collection Expr
+	Body       *Block
+}
+
+// FunStmt declares a named function
+type FunStmt struct {
+	Pos
+	Name string
+	Fun  *FunLit
+}
+
+// MethodStmt declares a function which is called on instances of
+// an entity, as in Animal fun eat(f) { ... }
+type MethodStmt struct {
+	Pos
+	Entity string
+	Name   string
+	Fun    *FunLit
+}
+
+// ReturnStmt returns from the enclosing function
+type ReturnStmt struct {
+	Pos
+	Value Expr // nil if no value is returned
+}
+
+// EntityStmt declares an entity and its ordered fields
+type EntityStmt struct {
+	Pos
+	Name   string
+	Fields []string
+}
+
+// ImportStmt imports a module by name. Modules in lower
+// directories are named by a dotted path, as in shapes.circle
+type ImportStmt struct {
+	Pos
+	Name string
+}
+
+// ExportStmt makes names visible to importing modules
+type ExportStmt struct {
+	Pos
+	Names []string
+}
+
+// Expressions
+
+// Ident is a reference to a named value
+type Ident struct {
+	Pos
+	Name string
+}
+
+// NumberLit is a number literal
+type NumberLit struct {
+	Pos
+	Value float64
+}
+
+// StringLit is a string literal
+type StringLit struct {
+	Pos
+	Value string
+}
+
+// BoolLit is either true or false
+type BoolLit struct {
+	Pos
+	Value bool
+}
+
+// NilLit is the nil literal
+type NilLit struct {
+	Pos
+}
+
+// ListLit is a list literal, as in [1, 2, 3]
+type ListLit struct {
+	Pos
+	Items []Expr
+}
+
+// MapLit is a map literal, as in { go: message }. Identifier
+// keys are stored as string literals
+type MapLit struct {
+	Pos
+	Keys   []Expr
+	Values []Expr
+}
+
+// FunLit is a function, which is anonymous unless
+// it belongs to a FunStmt or MethodStmt
+type FunLit struct {
+	Pos
+	Params []string
+	Body   *Block
+}
+
+// UnaryExpr applies a prefix operator, either ! or -
+type UnaryExpr struct {
+	Pos
+	Op scanner.TokenType
+	X  Expr
+}
+
+// BinaryExpr applies an infix operator, including the
+// logical and, or and is operators
+type BinaryExpr struct {
+	Pos
+	Op    scanner.TokenType
+	Left  Expr
+	Right Expr
+}
+
+// CallExpr calls a function with arguments
+type CallExpr struct {
+	Pos
+	Fun  Expr
+	Args []Expr
+}
+
+// DotExpr accesses a field of an entity or module
+type DotExpr struct {
+	Pos
+	X    Expr
+	Name string
+}
+
+// IndexExpr accesses an item of a collection
+type IndexExpr struct {
+	Pos
+	X     Expr
+	Index Expr
+}
+
+func (*Block) stmtNode()      {}
+func (*LetStmt) stmtNode()    {}
+func (*AssignStmt) stmtNode() {}
+func (*ExprStmt) stmtNode()   {}
+func (*IfStmt) stmtNode()     {}
+func (*ForStmt) stmtNode()    {}
+func (*ForOfStmt) stmtNode()  {}
+func (*FunStmt) stmtNode()    {}
+func (*MethodStmt) stmtNode() {}
+func (*ReturnStmt) stmtNode() {}
+func (*EntityStmt) stmtNode() {}
+func (*ImportStmt) stmtNode() {}
+func (*ExportStmt) stmtNode() {}
+
+func (*Ident) exprNode()      {}
+func (*NumberLit) exprNode()  {}
+func (*StringLit) exprNode()  {}
+func (*BoolLit) exprNode()    {}
+func (*NilLit) exprNode()     {}
+func (*ListLit) exprNode()    {}
+func (*MapLit) exprNode()     {}
+func (*FunLit) exprNode()     {}
+func (*UnaryExpr) exprNode()  {}
+func (*BinaryExpr) exprNode() {}
+func (*CallExpr) exprNode()   {}
+func (*DotExpr) exprNode()    {}
+func (*IndexExpr) exprNode()  {}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"strings"
+
+	"github.com/chickencoder/run/stdlib"
+	"github.com/chickencoder/run/vm"
+)
+
+// caps are the capabilities granted by the --allow flags, which
+// the natives of the standard library consult as they are called
+var (
+	caps    stdlib.Capabilities
+	natives = vm.NewNatives()
+)
+
+func init() {
+	stdlib.Register(natives, &caps)
+}
+
+// roots is a flag listing the directories granted a capability.
+// It may be repeated or given a comma separated list, such as
+// --allow-read=./data,./config, and --allow-read=/ grants the
+// whole filesystem
+type roots struct {
+	dirs *[]string
+}
+
+func (r roots) String() string {
+	if r.dirs == nil {
+		return ""
+	}
+	return strings.Join(*r.dirs, ",")
+}
+
+func (r roots) Set(s string) error {
+	for _, dir := range strings.Split(s, ",") {
+		if dir == "" {
+			return errors.New("expected a directory, or / for every file")
+		}
+		*r.dirs = append(*r.dirs, dir)
+	}
+	return nil
+}
+
+// allowFlags adds the flags granting capabilities to programs,
+// which are denied any access outside of the program by default
+func allowFlags(flags *flag.FlagSet) {
+	flags.Var(roots{&caps.Read}, "allow-read", "Allow reading files beneath the comma separated `dirs`, or anywhere given /")
+	flags.Var(roots{&caps.Write}, "allow-write", "Allow writing files beneath the comma separated `dirs`, or anywhere given /")
+	flags.BoolVar(&caps.Exec, "allow-exec", false, "Allow running other programs")
+	flags.BoolVar(&caps.Env, "allow-env", false, "Allow reading environment variables")
+	flags.BoolVar(&caps.Clock, "allow-clock", false, "Allow reading the time")
+	flags.BoolVar(&caps.Net, "allow-net", false, "Allow network requests")
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/chickencoder/run/parser"
+	"github.com/chickencoder/run/scanner"
+)
+
+// indent is the indentation of each level of brackets
+const indent = "    "
+
+// format prints Run programs formatted, or rewrites them with -w
+func format(args []string) int {
+	flags := newFlags("fmt", "run fmt [-w] program.run ...")
+	write := flags.Bool("w", false, "Write the result to the program instead of printing it")
+	if err := flags.Parse(args); err != nil {
+		return parseStatus(err)
+	}
+
+	if flags.NArg() == 0 {
+		flags.Usage()
+		return exitUsage
+	}
+
+	status := exitOK
+	for _, path := range flags.Args() {
+		dat, err := ioutil.ReadFile(path)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "FileError: couldn't open file", path)
+			status = exitFailure
+			continue
+		}
+
+		formatted, ok := formatSource(path, string(dat))
+		if !ok {
+			status = exitFailure
+			continue
+		}
+
+		if !*write {
+			fmt.Print(formatted)
+		} else if formatted != string(dat) {
+			if err := ioutil.WriteFile(path, []byte(formatted), 0644); err != nil {
+				fmt.Fprintln(os.Stderr, "FileError: couldn't write file", path)
+				status = exitFailure
+			}
+		}
+	}
+	return status
+}
+
+// formatSource indents each line of a program by the brackets
+// left open before it, trims trailing whitespace and collapses
+// runs of blank lines. Programs which do not parse are refused
+// with their errors, as the brackets cannot be trusted
+func formatSource(path, source string) (string, bool) {
+	// The parser reports lexical errors along with its own
+	tokens, _ := scanner.Tokenize(source)
+	if _, errs := parser.Parse(source); len(errs) > 0 {
+		for _, e := range errs {
+			fmt.Fprintf(os.Stderr, "%s:%s\n", path, e)
+		}
+		return "", false
+	}
+
+	// Brackets opened and closed on each line, and those
+	// closed before any other token which outdent the line
+	lines := strings.Split(strings.TrimRight(source, " \t\r\n"), "\n")
+	opens := make([]int, len(lines)+1)
+	closes := make([]int, len(lines)+1)
+	leading := make([]int, len(lines)+1)
+	started := make([]bool, len(lines)+1)
+	for _, token := range tokens {
+		line := token.Line - 1
+		if line < 0 || line >= len(lines) {
+			continue
+		}
+
+		switch token.Type {
+		case scanner.LeftBraceToken, scanner.LeftParenToken, scanner.LeftBracketToken:
+			opens[line]++
+		case scanner.RightBraceToken, scanner.RightParenToken, scanner.RightBracketToken:
+			closes[line]++
+			if !started[line] {
+				leading[line]++
+			}
+			continue
+		}
+		started[line] = true
+	}
+
+	var b strings.Builder
+	depth, blank := 0, false
+	for i, line := range lines {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			blank = b.Len() > 0
+			continue
+		}
+		if blank {
+			b.WriteString("\n")
+			blank = false
+		}
+
+		level := depth - leading[i]
+		if level < 0 {
+			level = 0
+		}
+		b.WriteString(strings.Repeat(indent, level) + line + "\n")
+		depth += opens[i] - closes[i]
+	}
+	return b.String(), true
+}
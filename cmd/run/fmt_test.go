@@ -0,0 +1,102 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+var formatTests = []struct {
+	name   string
+	source string
+	want   string
+}{
+	{"unchanged", "let x = 1\nprint(x)\n", "let x = 1\nprint(x)\n"},
+	{"block", "if x {\nprint(x)\n}", "if x {\n    print(x)\n}\n"},
+	{"nested", "fun f() {\n  for x of xs {\n        if x {\n  print(x)\n      }\n }\n}",
+		"fun f() {\n    for x of xs {\n        if x {\n            print(x)\n        }\n    }\n}\n"},
+	{"else", "if a {\nf()\n} else {\ng()\n}", "if a {\n    f()\n} else {\n    g()\n}\n"},
+	{"brackets", "let xs = [\n1,\n[\n2\n],\n{ a: (\n3\n) }\n]",
+		"let xs = [\n    1,\n    [\n        2\n    ],\n    { a: (\n            3\n    ) }\n]\n"},
+	{"closed on one line", "let m = { a: [1, 2] }\nprint(m)", "let m = { a: [1, 2] }\nprint(m)\n"},
+	{"several closers", "print(f(\n[1,\n2]))\nprint(1)", "print(f(\n        [1,\n            2]))\nprint(1)\n"},
+	{"trailing space", "let x = 1   \t\nprint(x) ", "let x = 1\nprint(x)\n"},
+	{"blank lines", "\n\nlet x = 1\n\n\n\nprint(x)\n\n\n", "let x = 1\n\nprint(x)\n"},
+	{"comments", "fun f() {\n# inside\nreturn 1 # one\n}", "fun f() {\n    # inside\n    return 1 # one\n}\n"},
+	{"brackets in strings", "fun f() {\nprint(\"{ ( [\")\n}", "fun f() {\n    print(\"{ ( [\")\n}\n"},
+	{"crlf", "if x {\r\nprint(x)\r\n}\r\n", "if x {\n    print(x)\n}\n"},
+	{"empty", "", ""},
+}
+
+func TestFormat(t *testing.T) {
+	for _, test := range formatTests {
+		got, ok := formatSource(test.name, test.source)
+		if !ok {
+			t.Errorf("%s: refused to format", test.name)
+		} else if got != test.want {
+			t.Errorf("%s: formatted as\n%s\nwant\n%s", test.name, got, test.want)
+		}
+	}
+}
+
+// Formatting formatted source changes nothing
+func TestFormatIdempotent(t *testing.T) {
+	sources := map[string]string{}
+	for _, test := range formatTests {
+		sources[test.name] = test.source
+	}
+	paths, _ := filepath.Glob(filepath.Join("..", "..", "vm", "test", "*.run"))
+	for _, path := range paths {
+		dat, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sources[path] = string(dat)
+	}
+
+	for name, source := range sources {
+		once, ok := formatSource(name, source)
+		if !ok {
+			t.Errorf("%s: refused to format", name)
+			continue
+		}
+		if twice, _ := formatSource(name, once); twice != once {
+			t.Errorf("%s: formatting again gave\n%s\nfrom\n%s", name, twice, once)
+		}
+	}
+}
+
+// Files which do not parse are reported and left as they were,
+// even when other files are formatted
+func TestFormatErrors(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"syntax.run":  "if x {\nprint(x\n}\n",
+		"lexical.run": "let x = 5 % 2\n",
+		"string.run":  "print(\"abc)\n",
+		"good.run":    "if x {\nprint(x)\n}\n",
+	}
+	var paths []string
+	for name, source := range files {
+		path := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(path, []byte(source), 0644); err != nil {
+			t.Fatal(err)
+		}
+		paths = append(paths, path)
+	}
+
+	if status := format(append([]string{"-w"}, paths...)); status != exitFailure {
+		t.Errorf("exited with %d, want %d", status, exitFailure)
+	}
+
+	files["good.run"] = "if x {\n    print(x)\n}\n"
+	for name, want := range files {
+		dat, err := ioutil.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(dat) != want {
+			t.Errorf("%s: rewritten as %q, want %q", name, dat, want)
+		}
+	}
+}
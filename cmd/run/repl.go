@@ -0,0 +1,209 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/chickencoder/run/ast"
+	"github.com/chickencoder/run/compiler"
+	"github.com/chickencoder/run/parser"
+	"github.com/chickencoder/run/scanner"
+	"github.com/chickencoder/run/vm"
+)
+
+const replHelp = `Enter Run statements to run them, or assembly in :asm mode.
+Run entries continue over several lines until every bracket is
+closed, whereas assembly entries continue until an empty line.
+
+  :asm      switch between Run and assembly entries
+  :trace    turn tracing of each instruction on or off
+  :stack    print the items on the stack
+  :globals  print the global variables
+  :help     print this message
+  :quit     leave the repl`
+
+// session is a repl which compiles every entry into the same
+// program and runs it with the same Runner, so that globals
+// survive from one entry to the next
+type session struct {
+	compiler *compiler.Compiler
+	runner   *vm.Runner
+	in       *bufio.Scanner
+	asm      bool
+	trace    bool
+}
+
+// repl reads entries from stdin until it is closed
+func repl(args []string) int {
+	flags := newFlags("repl", "run repl [flags]")
+	size := flags.Int("stacksize", 1024, "Fixed size of execution stack")
+	trace := flags.Bool("trace", false, "Trace the execution of each entry")
+	allowFlags(flags)
+	if err := flags.Parse(args); err != nil {
+		return parseStatus(err)
+	}
+
+	s := &session{
+		compiler: compiler.NewCompiler(),
+		runner:   vm.NewRunner(nil, *size, 0, *trace),
+		in:       bufio.NewScanner(os.Stdin),
+		trace:    *trace,
+	}
+	s.compiler.SetNatives(natives)
+	s.runner.SetNatives(natives)
+	s.runner.SetGlobal(compiler.ArgsGlobal, vm.NewList(nil))
+
+	fmt.Println("Run repl, enter :help for commands")
+	for {
+		entry, ok := s.read()
+		if !ok {
+			fmt.Println()
+			return exitOK
+		}
+
+		switch strings.TrimSpace(entry) {
+		case "":
+		case ":help":
+			fmt.Println(replHelp)
+		case ":quit":
+			return exitOK
+		case ":asm":
+			s.asm = !s.asm
+		case ":trace":
+			s.trace = !s.trace
+			s.runner.SetTrace(s.trace)
+			fmt.Println("trace", map[bool]string{true: "on", false: "off"}[s.trace])
+		case ":stack":
+			for i, item := range s.runner.Stack() {
+				fmt.Printf("%4d  %s\n", i, item)
+			}
+		case ":globals":
+			for slot, name := range s.compiler.Globals() {
+				if name != "" {
+					fmt.Printf("%4d  %s = %s\n", slot, name, s.runner.Global(slot))
+				}
+			}
+		default:
+			if strings.HasPrefix(strings.TrimSpace(entry), ":") {
+				fmt.Println("unknown command, enter :help for commands")
+			} else if s.asm {
+				s.assemble(entry)
+			} else {
+				s.eval(entry)
+			}
+		}
+	}
+}
+
+// read prompts for an entry, reading more lines while the
+// entry leaves brackets open or, in assembly, until a blank line
+func (s *session) read() (string, bool) {
+	prompt := "run> "
+	if s.asm {
+		prompt = "asm> "
+	}
+
+	var lines []string
+	for {
+		fmt.Print(prompt)
+		if !s.in.Scan() {
+			return strings.Join(lines, "\n"), len(lines) > 0
+		}
+		lines = append(lines, s.in.Text())
+		entry := strings.Join(lines, "\n")
+
+		if strings.HasPrefix(strings.TrimSpace(entry), ":") {
+			return entry, true
+		} else if s.asm && strings.TrimSpace(s.in.Text()) == "" {
+			return entry, true
+		} else if !s.asm && balanced(entry) {
+			return entry, true
+		}
+		prompt = "...  "
+	}
+}
+
+// balanced reports whether every bracket opened in source is closed
+func balanced(source string) bool {
+	tokens, _ := scanner.Tokenize(source)
+
+	depth := 0
+	for _, token := range tokens {
+		switch token.Type {
+		case scanner.LeftBraceToken, scanner.LeftParenToken, scanner.LeftBracketToken:
+			depth++
+		case scanner.RightBraceToken, scanner.RightParenToken, scanner.RightBracketToken:
+			depth--
+		}
+	}
+	return depth <= 0
+}
+
+// eval compiles and runs Run statements, printing the
+// value of a final expression unless it is nil
+func (s *session) eval(entry string) {
+	tree, errs := parser.Parse(entry)
+	if len(errs) > 0 {
+		for _, e := range errs {
+			fmt.Println(e)
+		}
+		return
+	}
+
+	start, cerrs := s.compiler.Chunk(tree)
+	if len(cerrs) > 0 {
+		for _, e := range cerrs {
+			fmt.Println(e)
+		}
+		return
+	}
+
+	if !s.run(start) {
+		return
+	}
+
+	// Chunk leaves the value of a final expression on the stack
+	if n := len(tree.Stmts); n > 0 {
+		if _, ok := tree.Stmts[n-1].(*ast.ExprStmt); !ok {
+			return
+		}
+		stack := s.runner.Stack()
+		if result := stack[len(stack)-1]; result.Kind != vm.NilValue {
+			fmt.Println(result)
+		}
+	}
+}
+
+// assemble assembles and runs instructions, whose
+// branches are relocated to the end of the program
+func (s *session) assemble(entry string) {
+	program, diagnostics, err := vm.Assemble(entry)
+	if err != nil {
+		for _, d := range diagnostics {
+			fmt.Println(d)
+		}
+		return
+	}
+
+	start := len(s.compiler.Code())
+	for _, instr := range program {
+		if instr.Code.IsBranch() && len(instr.Operands) > 0 && instr.Operands[0].Kind == vm.NumberValue {
+			instr.Operands[0].Content = instr.Operands[0].Content.(float64) + float64(start)
+		}
+	}
+	s.run(s.compiler.Append(program))
+}
+
+// run runs the program from start, reporting whether it succeeded
+func (s *session) run(start int) bool {
+	if err := s.runner.Continue(s.compiler.Code(), start); err != nil {
+		fmt.Println(err)
+		if rerr, ok := err.(*vm.RuntimeError); ok {
+			fmt.Print(rerr.Trace())
+		}
+		return false
+	}
+	return true
+}
@@ -0,0 +1,362 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/chickencoder/run"
+	"github.com/chickencoder/run/compiler"
+	"github.com/chickencoder/run/vm"
+)
+
+// Exit codes of the run command
+const (
+	exitOK      = 0 // The command succeeded
+	exitFailure = 1 // The program failed to compile or run
+	exitUsage   = 2 // The command was invoked incorrectly
+)
+
+// command is a subcommand of run, such as run build
+type command struct {
+	name    string
+	usage   string
+	summary string
+	run     func(args []string) int
+}
+
+var commands []*command
+
+func init() {
+	commands = []*command{
+		{"asm", "run asm [flags] program.runasm [-- args]", "run a Run Assembly program", runAsm},
+		{"build", "run build [-o output.runc] program.run|program.runasm", "compile a program to a .runc file", build},
+		{"disasm", "run disasm program", "print a program as assembly", disasm},
+		{"fmt", "run fmt [-w] program.run ...", "format Run programs", format},
+		{"help", "run help [command]", "print help for a command", help},
+		{"repl", "run repl [flags]", "start an interactive session", repl},
+		{"test", "run test [path ...]", "run programs and compare their output", test},
+		{"version", "run version", "print the version of run", version},
+	}
+}
+
+const usage = `Run is a procedural scripting language.
+
+usage:
+  run [flags] program [-- args]
+  run <command> [arguments]
+
+A program is compiled from Run source unless it has a .runasm
+extension, in which case it is assembled, or a .runc extension,
+in which case it has already been built. Arguments following the
+program are passed to it in the args list.
+
+commands:
+`
+
+func main() {
+	args := os.Args[1:]
+	if len(args) > 0 {
+		for _, cmd := range commands {
+			if cmd.name == args[0] {
+				os.Exit(cmd.run(args[1:]))
+			}
+		}
+	}
+	os.Exit(runFile(args))
+}
+
+// printUsage writes the usage of run and a summary of its commands
+func printUsage() {
+	fmt.Fprint(os.Stderr, usage)
+	for _, cmd := range commands {
+		fmt.Fprintf(os.Stderr, "  %-8s %s\n", cmd.name, cmd.summary)
+	}
+	fmt.Fprintln(os.Stderr, "\nrun help <command> prints help for a command")
+}
+
+// newFlags returns a flag set whose usage prints that of the command
+func newFlags(name, usage string) *flag.FlagSet {
+	flags := flag.NewFlagSet(name, flag.ContinueOnError)
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "usage:", usage)
+		flags.PrintDefaults()
+	}
+	return flags
+}
+
+// help prints the help text of a command, or of run itself
+func help(args []string) int {
+	flags := newFlags("help", "run help [command]")
+	if err := flags.Parse(args); err != nil {
+		return parseStatus(err)
+	}
+	if flags.NArg() == 0 {
+		printUsage()
+		return exitOK
+	}
+
+	// Every command, including help, prints its usage when
+	// asked for -h
+	name := flags.Arg(0)
+	for _, cmd := range commands {
+		if cmd.name == name {
+			cmd.run([]string{"-h"})
+			return exitOK
+		}
+	}
+	fmt.Fprintf(os.Stderr, "run help: unknown command %s\n", name)
+	return exitUsage
+}
+
+// runFile runs a program of any kind, which is the default command
+func runFile(args []string) int {
+	flags := newFlags("run", "run [flags] program [-- args]")
+	flags.Usage = printUsage
+	opts := runFlags(flags)
+	if err := flags.Parse(args); err != nil {
+		return parseStatus(err)
+	}
+
+	if flags.NArg() == 0 {
+		printUsage()
+		return exitUsage
+	}
+
+	program, err := load(flags.Arg(0))
+	if err != nil {
+		return exitFailure
+	}
+	return execute(program, opts, scriptArgs(flags.Args()[1:]))
+}
+
+// runAsm runs a Run Assembly program, whatever its extension
+func runAsm(args []string) int {
+	flags := newFlags("asm", "run asm [flags] program.runasm [-- args]")
+	opts := runFlags(flags)
+	if err := flags.Parse(args); err != nil {
+		return parseStatus(err)
+	}
+
+	if flags.NArg() == 0 {
+		flags.Usage()
+		return exitUsage
+	}
+
+	path, dat, err := read(flags.Arg(0))
+	if err != nil {
+		return exitFailure
+	}
+
+	program, err := assemble(path, dat)
+	if err != nil {
+		return exitFailure
+	}
+	return execute(program, opts, scriptArgs(flags.Args()[1:]))
+}
+
+// disasm prints a program as assembly instead of running it
+func disasm(args []string) int {
+	flags := newFlags("disasm", "run disasm program")
+	if err := flags.Parse(args); err != nil {
+		return parseStatus(err)
+	}
+
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return exitUsage
+	}
+
+	program, err := load(flags.Arg(0))
+	if err != nil {
+		return exitFailure
+	}
+	fmt.Print(vm.Disassemble(program))
+	return exitOK
+}
+
+// build compiles or assembles a program and writes it out as a .runc file
+func build(args []string) int {
+	flags := newFlags("build", "run build [-o output.runc] program.run|program.runasm")
+	out := flags.String("o", "", "Output file (defaults to the input with a .runc extension)")
+	if err := flags.Parse(args); err != nil {
+		return parseStatus(err)
+	}
+
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return exitUsage
+	}
+
+	path := flags.Arg(0)
+	if *out == "" {
+		*out = strings.TrimSuffix(path, filepath.Ext(path)) + ".runc"
+	}
+
+	program, err := load(path)
+	if err != nil {
+		return exitFailure
+	}
+	if err := ioutil.WriteFile(*out, vm.Encode(program), 0644); err != nil {
+		fmt.Fprintln(os.Stderr, "FileError: couldn't write file", *out)
+		return exitFailure
+	}
+	return exitOK
+}
+
+// version prints the version of run
+func version(args []string) int {
+	flags := newFlags("version", "run version")
+	if err := flags.Parse(args); err != nil {
+		return parseStatus(err)
+	}
+	fmt.Println("run version", run.Version)
+	return exitOK
+}
+
+// options control how a program is run
+type options struct {
+	entry   string
+	size    int
+	trace   bool
+	budget  int
+	timeout time.Duration
+	limits  vm.Limits
+}
+
+// runFlags adds the flags of the commands which run a program
+func runFlags(flags *flag.FlagSet) *options {
+	opts := &options{}
+	usage := "Label at which to start the program (defaults to " + vm.EntryLabel + " if present, else 0)"
+	flags.StringVar(&opts.entry, "main", "", usage)
+	flags.StringVar(&opts.entry, "entry", "", "Alias of -main")
+	flags.BoolVar(&opts.trace, "trace", false, "Trace the program execution")
+	flags.IntVar(&opts.size, "stacksize", 1024, "Fixed size of execution stack")
+	flags.IntVar(&opts.budget, "budget", 0, "Maximum number of instructions to run (0 for no limit)")
+	flags.DurationVar(&opts.timeout, "timeout", 0, "Maximum time to run for, such as 5s (0 for no limit)")
+	flags.IntVar(&opts.limits.HeapBytes, "max-heap", 0, "Maximum bytes allocated for lists, maps and strings (0 for no limit)")
+	flags.IntVar(&opts.limits.StringLen, "max-string", 0, "Maximum length of a string in bytes (0 for no limit)")
+	flags.IntVar(&opts.limits.Collection, "max-items", 0, "Maximum number of items in a list or map (0 for no limit)")
+	flags.IntVar(&opts.limits.CallDepth, "max-depth", 0, "Maximum depth of nested calls (0 for no limit)")
+	allowFlags(flags)
+	return opts
+}
+
+// parseStatus returns the exit code for an error parsing flags,
+// which is only a success when help was asked for
+func parseStatus(err error) int {
+	if err == flag.ErrHelp {
+		return exitOK
+	}
+	return exitUsage
+}
+
+// scriptArgs drops the -- separating the arguments of a program
+// from those of run, as it is optional after the program
+func scriptArgs(args []string) []string {
+	if len(args) > 0 && args[0] == "--" {
+		return args[1:]
+	}
+	return args
+}
+
+// execute runs a program with args bound to the args global,
+// printing the error and trace if it fails
+func execute(program []*vm.Instruction, opts *options, args []string) int {
+	main, err := vm.Entry(program, opts.entry)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitUsage
+	}
+
+	items := make([]vm.Value, len(args))
+	for i, arg := range args {
+		items[i] = vm.Value{Kind: vm.StringValue, Content: arg}
+	}
+
+	runner := vm.NewRunner(program, opts.size, main, opts.trace)
+	runner.SetBudget(opts.budget)
+	runner.SetTimeout(opts.timeout)
+	runner.SetLimits(opts.limits)
+	runner.SetNatives(natives)
+	runner.SetGlobal(compiler.ArgsGlobal, vm.NewList(items))
+	if err := runner.Run(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		if rerr, ok := err.(*vm.RuntimeError); ok {
+			fmt.Fprint(os.Stderr, rerr.Trace())
+		}
+		return exitFailure
+	}
+	return exitOK
+}
+
+// read reads a program, returning its absolute path
+func read(source string) (string, []byte, error) {
+	path, err := filepath.Abs(source)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "FileError: couldn't resolve path", source)
+		return "", nil, err
+	}
+
+	dat, err := ioutil.ReadFile(path)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "FileError: couldn't open file", path)
+		return "", nil, err
+	}
+	return path, dat, nil
+}
+
+// load decodes a compiled program, assembles an assembly program
+// or compiles a Run program, printing any errors found. Files
+// without an extension are Run programs, such as scripts
+// beginning with a #!/usr/bin/env run line
+func load(source string) ([]*vm.Instruction, error) {
+	path, dat, err := read(source)
+	if err != nil {
+		return nil, err
+	}
+
+	switch filepath.Ext(path) {
+	case ".runc":
+		program, err := vm.Decode(dat)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %s\n", path, err)
+			return nil, err
+		}
+		return program, nil
+
+	case ".runasm":
+		return assemble(path, dat)
+	}
+	return compile(path)
+}
+
+// assemble assembles a Run Assembly program and the files it includes
+func assemble(path string, dat []byte) ([]*vm.Instruction, error) {
+	program, diagnostics, err := vm.AssembleFile(path, string(dat))
+	if err != nil {
+		for _, d := range diagnostics {
+			fmt.Fprintln(os.Stderr, d)
+		}
+		fmt.Fprintln(os.Stderr, err)
+		return nil, err
+	}
+	return program, nil
+}
+
+// compile loads and compiles a Run program along with the
+// modules it imports, printing every error found
+func compile(path string) ([]*vm.Instruction, error) {
+	program, errs := compiler.Load(path, natives)
+	if len(errs) > 0 {
+		for _, e := range errs {
+			fmt.Fprintln(os.Stderr, e)
+		}
+		return nil, fmt.Errorf("%s: %d errors", path, len(errs))
+	}
+	return program, nil
+}
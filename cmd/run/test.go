@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/chickencoder/run/compiler"
+	"github.com/chickencoder/run/vm"
+)
+
+// test runs each Run program which has a .out file beside it,
+// such as fact.run and fact.out, and compares what the program
+// prints with the contents of the .out file
+func test(args []string) int {
+	flags := newFlags("test", "run test [path ...]")
+	size := flags.Int("stacksize", 1024, "Fixed size of execution stack")
+	if err := flags.Parse(args); err != nil {
+		return parseStatus(err)
+	}
+
+	paths := flags.Args()
+	if len(paths) == 0 {
+		paths = []string{"."}
+	}
+
+	var programs []string
+	for _, path := range paths {
+		found, err := findTests(path)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "FileError:", err)
+			return exitFailure
+		}
+		programs = append(programs, found...)
+	}
+
+	failed := 0
+	for _, program := range programs {
+		if err := runTest(program, *size); err != nil {
+			fmt.Printf("FAIL %s\n%s\n", program, err)
+			failed++
+		} else {
+			fmt.Printf("ok   %s\n", program)
+		}
+	}
+
+	if failed > 0 {
+		fmt.Printf("%d of %d failed\n", failed, len(programs))
+		return exitFailure
+	}
+	return exitOK
+}
+
+// findTests returns the programs with an expected output under path
+func findTests(path string) ([]string, error) {
+	var programs []string
+	err := filepath.Walk(path, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() || filepath.Ext(path) != ".run" {
+			return nil
+		}
+		if _, err := os.Stat(expected(path)); err == nil {
+			programs = append(programs, path)
+		}
+		return nil
+	})
+	return programs, err
+}
+
+// expected returns the path of the expected output of a program
+func expected(path string) string {
+	return strings.TrimSuffix(path, filepath.Ext(path)) + ".out"
+}
+
+// runTest runs a program, returning an error if it fails
+// or prints something other than its expected output
+func runTest(path string, size int) error {
+	want, err := ioutil.ReadFile(expected(path))
+	if err != nil {
+		return err
+	}
+
+	program, errs := compiler.Load(path, natives)
+	if len(errs) > 0 {
+		messages := make([]string, len(errs))
+		for i, e := range errs {
+			messages[i] = e.Error()
+		}
+		return fmt.Errorf("%s", strings.Join(messages, "\n"))
+	}
+
+	main, err := vm.Entry(program, "")
+	if err != nil {
+		return err
+	}
+
+	var out bytes.Buffer
+	runner := vm.NewRunner(program, size, main, false)
+	runner.SetOutput(&out)
+	runner.SetNatives(natives)
+	runner.SetGlobal(compiler.ArgsGlobal, vm.NewList(nil))
+	if err := runner.Run(); err != nil {
+		return err
+	}
+
+	if got := out.String(); got != string(want) {
+		return fmt.Errorf("expected:\n%sfound:\n%s", want, got)
+	}
+	return nil
+}
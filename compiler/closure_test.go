@@ -0,0 +1,84 @@
+package compiler
+
+import (
+	"testing"
+
+	"github.com/chickencoder/run/vm"
+)
+
+var closureTests = []programTest{
+	{"counter", `
+fun counter() {
+	let count = 0
+	return fun() {
+		count = count + 1
+		return count
+	}
+}
+let a = counter()
+let b = counter()
+a()
+print(a())
+print(b())`, "2\n1\n"},
+
+	// Closures created by the same call share its locals,
+	// even once it has returned
+	{"shared", `
+fun pair() {
+	let n = 0
+	let inc = fun() { n = n + 1 }
+	let get = fun() { return n }
+	return [inc, get]
+}
+let p = pair()
+p[0]()
+p[0]()
+print(p[1]())`, "2\n"},
+
+	// Until the function returns, its locals and the
+	// upvalues referring to them are the same variables
+	{"open", `
+fun f() {
+	let x = 1
+	let get = fun() { return x }
+	x = 2
+	print(get())
+	let put = fun(v) { x = v }
+	put(3)
+	print(x)
+}
+f()`, "2\n3\n"},
+
+	// Variables of functions further out are captured
+	// through every function in between
+	{"nested", `
+fun outer() {
+	let x = "outer"
+	return fun() {
+		return fun() { return x }
+	}
+}
+print(outer()()())`, "outer\n"},
+	{"parameter", "fun adder(n) { return fun(x) { return x + n } }\nlet add2 = adder(2)\nprint(add2(3))", "5\n"},
+	{"block local", "fun f() {\n if true {\n  let y = 4\n  return fun() { return y }\n }\n}\nprint(f()())", "4\n"},
+	{"globals", "let g = 1\nlet f = fun() { g = g + 1 }\nf()\nprint(g)", "2\n"},
+	{"argument", "fun apply(f, x) { return f(x) }\nprint(apply(fun(x) { return x * 3 }, 2))", "6\n"},
+	{"recursive value", "fun f(n) {\n let g = fun(m) { if m <= 0 { return 0 } return m + f(m - 1) }\n return g(n)\n}\nprint(f(3))", "6\n"},
+	{"value", "let f = fun(a, b) { return a }\nprint(f)", "<fun anonymous/2>\n"},
+}
+
+func TestClosures(t *testing.T) {
+	checkPrograms(t, closureTests, nil)
+}
+
+// Values called through callv are checked at runtime
+var callValueTests = []runtimeErrorTest{
+	{"too few", "let f = fun(a, b) {}\nf(1)", vm.ValueError, "anonymous expects 2 arguments, found 1"},
+	{"too many", "fun g() {}\nlet f = g\nf(1)", vm.ValueError, "g expects 0 arguments, found 1"},
+	{"number", "let f = 1\nf()", vm.ValueError, "cannot call number value"},
+	{"nil", "let f = nil\nf()", vm.ValueError, "cannot call nil value"},
+}
+
+func TestCallValueErrors(t *testing.T) {
+	checkRuntimeErrors(t, callValueTests)
+}
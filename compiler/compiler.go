@@ -0,0 +1,974 @@
+package compiler
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/chickencoder/run/ast"
+	"github.com/chickencoder/run/scanner"
+	"github.com/chickencoder/run/vm"
+)
+
+// Error is an error found while loading or compiling a program
+type Error struct {
+	Path    string // Source file, empty unless loaded from a file
+	Line    int
+	Column  int
+	Message string
+}
+
+func (e Error) Error() string {
+	if e.Path != "" && e.Line == 0 {
+		return fmt.Sprintf("%s: %s", e.Path, e.Message)
+	} else if e.Path != "" {
+		return fmt.Sprintf("%s:%d:%d: %s", e.Path, e.Line, e.Column, e.Message)
+	}
+	return fmt.Sprintf("%d:%d: %s", e.Line, e.Column, e.Message)
+}
+
+// function is a named function declared at the top level
+type function struct {
+	decl    *ast.FunStmt
+	address int   // Index of the first instruction of the body
+	calls   []int // Call and closure instructions waiting for the address
+}
+
+// variable is a name declared with let or set
+type variable struct {
+	slot     int
+	constant bool // Declared with set
+}
+
+// scope maps the names declared in a block to their variables
+type scope struct {
+	parent *scope
+	frame  *frame // Frame holding the local slots, nil for the global scope
+	global bool   // Top level of the program, holding global slots
+	names  map[string]variable
+}
+
+// frame is the body of a function, or the top level of the
+// program, whose local slots are reserved by a single enter
+type frame struct {
+	enclosing *frame
+	locals    int       // Next free local slot
+	captures  []capture // Upvalues of the closure, in order
+	function  bool      // false for the top level, which cannot return
+}
+
+// capture describes where a closure finds one of its upvalues
+// within the frame which creates it
+type capture struct {
+	local bool // A local slot, otherwise an upvalue of that frame
+	index int
+}
+
+// location is where a variable is kept at runtime
+type location int
+
+const (
+	globalSlot location = iota
+	localSlot
+	upvalueSlot
+)
+
+// ref is a variable resolved from the current frame
+type ref struct {
+	location location
+	slot     int
+	constant bool
+}
+
+// Compiler translates a syntax tree into instructions for the vm.
+// Top level variables are kept in global slots, whereas variables
+// declared within functions or blocks are kept in local slots of the
+// enclosing frame. The arguments of a function occupy its first
+// local slots, followed by the slots reserved by enter. Functions
+// refer to the locals of enclosing functions through upvalues
+type Compiler struct {
+	code      []*vm.Instruction
+	scope     *scope
+	frame     *frame
+	globals   int // Number of global slots allocated
+	functions map[string]*function
+	exports   []*ast.Ident
+	modules   map[string]int    // Global slot holding each compiled module by path
+	imports   map[string]string // Path of each module imported by the current module
+	natives   *vm.Natives
+	host      map[string]variable // Globals declared by the host, visible to every module
+	path      string
+	name      string // Name of the module being compiled, empty for the program
+	line      int
+	Errors    []Error
+}
+
+// ArgsGlobal is the global slot of args, which holds the list
+// of arguments passed to the program and is set by the host
+// before the program is run
+const ArgsGlobal = 0
+
+// NewCompiler returns a Compiler whose global scope
+// declares only args
+func NewCompiler() *Compiler {
+	host := map[string]variable{
+		"args": {slot: ArgsGlobal, constant: true},
+	}
+	return &Compiler{
+		scope:     &scope{global: true, names: copyNames(host)},
+		globals:   1,
+		frame:     &frame{},
+		functions: map[string]*function{},
+		modules:   map[string]int{},
+		host:      host,
+	}
+}
+
+// Declare declares a global on behalf of the host, which every
+// module may use and assign, returning its slot. The host sets
+// its value before the program is run
+func (c *Compiler) Declare(name string) int {
+	if v, ok := c.host[name]; ok {
+		return v.slot
+	}
+
+	v := variable{slot: c.globals}
+	c.globals++
+	c.host[name] = v
+	c.scope.names[name] = v
+	return v.slot
+}
+
+// Function returns the entry point and arity of a top level
+// function of the program compiled last
+func (c *Compiler) Function(name string) (address, arity int, ok bool) {
+	fn, ok := c.functions[name]
+	if !ok {
+		return 0, 0, false
+	}
+	return fn.address, len(fn.decl.Fun.Params), true
+}
+
+// Global returns the slot of a global of the program compiled
+// last, and whether it is a constant
+func (c *Compiler) Global(name string) (slot int, constant, ok bool) {
+	v, ok := c.scope.names[name]
+	if !ok || !c.scope.global {
+		return 0, false, false
+	}
+	return v.slot, v.constant, true
+}
+
+func copyNames(names map[string]variable) map[string]variable {
+	copied := make(map[string]variable, len(names))
+	for name, v := range names {
+		copied[name] = v
+	}
+	return copied
+}
+
+// SetNatives sets the registry of native functions which
+// programs may call by name
+func (c *Compiler) SetNatives(natives *vm.Natives) {
+	c.natives = natives
+}
+
+// Compile translates a program into instructions which
+// begin executing at index 0
+func Compile(program *ast.Program) ([]*vm.Instruction, []Error) {
+	c := NewCompiler()
+	c.Program(program)
+	c.entry()
+	return c.code, c.Errors
+}
+
+// entry labels the first instruction as the entry point,
+// since the top level of a compiled program runs from 0
+func (c *Compiler) entry() {
+	if len(c.code) > 0 {
+		c.code[0].Labels = append([]string{vm.EntryLabel}, c.code[0].Labels...)
+	}
+}
+
+// Program compiles the top level statements of a program followed
+// by a halt instruction and then the body of every function
+func (c *Compiler) Program(program *ast.Program) {
+	c.compile(program, func() {
+		c.emit(vm.Halt)
+	})
+}
+
+// Chunk compiles statements which continue the program compiled so
+// far, such as an entry typed into the repl, returning the address
+// at which they begin. If the last statement is an expression its
+// value is left on the stack when the chunk halts. The compiler is
+// left as it was if any errors are found
+func (c *Compiler) Chunk(program *ast.Program) (int, []Error) {
+	start := len(c.code)
+	globals, locals := c.globals, c.frame.locals
+	names := make(map[string]variable, len(c.scope.names))
+	for name, v := range c.scope.names {
+		names[name] = v
+	}
+	functions := make(map[string]*function, len(c.functions))
+	for name, fn := range c.functions {
+		functions[name] = fn
+	}
+
+	stmts := program.Stmts
+	var result ast.Expr
+	if n := len(stmts); n > 0 {
+		if s, ok := stmts[n-1].(*ast.ExprStmt); ok {
+			result = s.X
+			stmts = stmts[:n-1]
+		}
+	}
+
+	c.Errors = nil
+	c.compile(&ast.Program{Stmts: stmts}, func() {
+		if result != nil {
+			c.at(result)
+			c.expr(result)
+		}
+		c.emit(vm.Halt)
+	})
+
+	if len(c.Errors) > 0 {
+		c.code = c.code[:start]
+		c.globals, c.frame.locals = globals, locals
+		c.scope.names, c.functions = names, functions
+		for _, fn := range c.functions {
+			calls := fn.calls[:0]
+			for _, call := range fn.calls {
+				if call < start {
+					calls = append(calls, call)
+				}
+			}
+			fn.calls = calls
+		}
+	}
+	return start, c.Errors
+}
+
+// Code returns every instruction compiled so far
+func (c *Compiler) Code() []*vm.Instruction {
+	return c.code
+}
+
+// Append adds instructions assembled elsewhere to the end of the
+// program, returning the address at which they begin. Their
+// branches must already refer to addresses within the program
+func (c *Compiler) Append(program []*vm.Instruction) int {
+	start := len(c.code)
+	c.code = append(c.code, program...)
+	return start
+}
+
+// Globals returns the name of every global variable
+// of the program, indexed by slot
+func (c *Compiler) Globals() []string {
+	names := make([]string, c.globals)
+	for name, v := range c.scope.names {
+		if v.slot < len(names) {
+			names[v.slot] = name
+		}
+	}
+	return names
+}
+
+// module compiles a module imported by the program. Its top level
+// runs before that of the modules importing it, then gathers its
+// exports into a module value held by a constant global
+func (c *Compiler) module(m *module) {
+	slot := c.globals
+	c.globals++
+	c.modules[m.path] = slot
+
+	c.reset(m)
+	skip := 0
+	c.compile(m.tree, func() {
+		for _, name := range c.exports {
+			c.at(name)
+			c.emit(vm.Const, str(name.Name))
+			c.expr(name)
+		}
+		name := strings.TrimSuffix(filepath.Base(m.path), filepath.Ext(m.path))
+		c.emit(vm.MakeModule, number(len(c.exports)), str(name))
+		c.emit(vm.GDefine, number(slot))
+		skip = c.emit(vm.Goto, number(0))
+	})
+	c.patch(skip)
+}
+
+// reset gives the compiler a new global scope
+// in which to compile a module loaded from a file
+func (c *Compiler) reset(m *module) {
+	c.scope = &scope{global: true, names: copyNames(c.host)}
+	c.functions = map[string]*function{}
+	c.exports = nil
+	c.path, c.imports, c.name = m.display, m.imports, m.name
+}
+
+// compile compiles the top level statements of a program, followed
+// by the instructions emitted by end and then every function body
+func (c *Compiler) compile(program *ast.Program, end func()) {
+	// Functions may be called before they are declared
+	var declared []*function
+	for _, stmt := range program.Stmts {
+		if decl, ok := stmt.(*ast.FunStmt); ok {
+			if _, exists := c.functions[decl.Name]; exists {
+				c.errorf(decl, "function %s is already declared", decl.Name)
+				continue
+			} else if _, exists := c.scope.names[decl.Name]; exists {
+				c.errorf(decl, "%s is already declared", decl.Name)
+				continue
+			}
+			fn := &function{decl: decl}
+			c.functions[decl.Name] = fn
+			declared = append(declared, fn)
+		}
+	}
+
+	// Modules share the top level frame, so each
+	// reserves only the locals it declares
+	locals := c.frame.locals
+	enter := c.emit(vm.Enter, number(0))
+	for _, stmt := range program.Stmts {
+		if _, ok := stmt.(*ast.FunStmt); !ok {
+			c.stmt(stmt)
+		}
+	}
+	c.code[enter].Operands[0] = number(c.frame.locals - locals)
+	end()
+
+	// Functions of a module are labelled with its name, such as
+	// maths.pow, so that only those of the program itself have
+	// bare labels. A function of the program called main is
+	// labelled main_, as the entry label belongs to the start
+	for _, fn := range declared {
+		fn.address, _ = c.body(fn.decl.Fun)
+		label := fn.decl.Name
+		if c.name != "" {
+			label = c.name + "." + label
+		} else if label == vm.EntryLabel {
+			label += "_"
+		}
+		c.code[fn.address].Labels = append(c.code[fn.address].Labels, label)
+	}
+
+	for _, fn := range c.functions {
+		for _, call := range fn.calls {
+			c.code[call].Operands[0] = number(fn.address)
+		}
+	}
+}
+
+// body compiles a function, which returns nil if it reaches the
+// end without a return statement. It returns the address of the
+// function along with its frame
+func (c *Compiler) body(fun *ast.FunLit) (int, *frame) {
+	params := len(fun.Params)
+	address := c.emit(vm.Enter, number(0))
+	c.frame = &frame{enclosing: c.frame, locals: params, function: true}
+
+	c.scope = &scope{parent: c.scope, frame: c.frame, names: map[string]variable{}}
+	for i, param := range fun.Params {
+		c.scope.names[param] = variable{slot: i}
+	}
+
+	c.block(fun.Body)
+	c.emit(vm.Const, vm.Nil)
+	c.emit(vm.Return)
+	c.code[address].Operands[0] = number(c.frame.locals - params)
+
+	f := c.frame
+	c.scope = c.scope.parent
+	c.frame = f.enclosing
+	return address, f
+}
+
+// closure compiles a function in place, jumping over its body,
+// and pushes a function value which captures every variable of
+// the enclosing functions that it refers to
+func (c *Compiler) closure(name string, fun *ast.FunLit) {
+	skip := c.emit(vm.Goto, number(0))
+	address, f := c.body(fun)
+	c.patch(skip)
+
+	c.at(fun)
+	c.emit(vm.MakeClosure, number(address), number(len(fun.Params)), str(name))
+	for _, capture := range f.captures {
+		if capture.local {
+			c.emit(vm.Capture, number(capture.index))
+		} else {
+			c.emit(vm.CaptureUp, number(capture.index))
+		}
+	}
+}
+
+// Helpers
+
+func (c *Compiler) errorf(node ast.Node, format string, args ...interface{}) {
+	pos := node.Position()
+	c.Errors = append(c.Errors, Error{
+		Path:    c.path,
+		Line:    pos.Line,
+		Column:  pos.Column,
+		Message: fmt.Sprintf(format, args...),
+	})
+}
+
+// at records the source line of the node being compiled
+// so that runtime errors can refer back to it
+func (c *Compiler) at(node ast.Node) {
+	c.line = node.Position().Line
+}
+
+// emit appends an instruction, returning its address
+func (c *Compiler) emit(op vm.Opcode, operands ...vm.Value) int {
+	instr := vm.NewInstruction(op, operands)
+	instr.Line = c.line
+	c.code = append(c.code, instr)
+	return len(c.code) - 1
+}
+
+// patch points the jump at address to the next instruction
+func (c *Compiler) patch(address int) {
+	c.code[address].Operands[0] = number(len(c.code))
+}
+
+func number(n int) vm.Value {
+	return vm.Value{
+		Kind:    vm.NumberValue,
+		Content: float64(n),
+	}
+}
+
+func str(s string) vm.Value {
+	return vm.Value{
+		Kind:    vm.StringValue,
+		Content: s,
+	}
+}
+
+// declare allocates a slot for a new variable in the current scope
+func (c *Compiler) declare(node ast.Node, name string, constant bool) {
+	if _, exists := c.scope.names[name]; exists {
+		c.errorf(node, "%s is already declared", name)
+		return
+	}
+	if _, exists := c.functions[name]; exists && c.scope.global {
+		c.errorf(node, "%s is already declared as a function", name)
+		return
+	}
+
+	if c.scope.global {
+		c.scope.names[name] = variable{slot: c.globals, constant: constant}
+		c.globals++
+		return
+	}
+
+	c.scope.names[name] = variable{slot: c.frame.locals, constant: constant}
+	c.frame.locals++
+}
+
+// resolve finds a variable visible from the current scope
+func (c *Compiler) resolve(name string) (ref, bool) {
+	return c.lookup(c.scope, c.frame, name)
+}
+
+// lookup finds a variable visible from scope s, which belongs to
+// frame f. Locals of an enclosing frame are captured as upvalues
+// by f, and by every frame in between
+func (c *Compiler) lookup(s *scope, f *frame, name string) (ref, bool) {
+	for ; s != nil && s.frame == f; s = s.parent {
+		if v, ok := s.names[name]; ok {
+			return ref{location: localSlot, slot: v.slot, constant: v.constant}, true
+		}
+	}
+
+	if s == nil {
+		return ref{}, false
+	} else if s.global {
+		v, ok := s.names[name]
+		return ref{location: globalSlot, slot: v.slot, constant: v.constant}, ok
+	}
+
+	r, ok := c.lookup(s, s.frame, name)
+	if !ok || r.location == globalSlot {
+		return r, ok
+	}
+	return ref{location: upvalueSlot, slot: f.capture(r), constant: r.constant}, true
+}
+
+// capture returns the index of the upvalue through which the frame
+// refers to a variable of its enclosing frame
+func (f *frame) capture(r ref) int {
+	capture := capture{local: r.location == localSlot, index: r.slot}
+	for i, existing := range f.captures {
+		if existing == capture {
+			return i
+		}
+	}
+	f.captures = append(f.captures, capture)
+	return len(f.captures) - 1
+}
+
+// fetch pushes a variable onto the stack
+func (c *Compiler) fetch(r ref) {
+	switch r.location {
+	case globalSlot:
+		c.emit(vm.GFetch, number(r.slot))
+	case localSlot:
+		c.emit(vm.Fetch, number(r.slot))
+	case upvalueSlot:
+		c.emit(vm.UFetch, number(r.slot))
+	}
+}
+
+// define pops the top of the stack into a newly declared variable.
+// Constant globals are defined with gdefine so that the vm refuses
+// to store to them again
+func (c *Compiler) define(node ast.Node, name string, constant bool) {
+	c.declare(node, name, constant)
+	r, ok := c.resolve(name)
+	if !ok {
+		return
+	}
+
+	if r.location == globalSlot && r.constant {
+		c.emit(vm.GDefine, number(r.slot))
+	} else if r.location == globalSlot {
+		c.emit(vm.GStore, number(r.slot))
+	} else {
+		c.emit(vm.Store, number(r.slot))
+	}
+}
+
+// store pops the top of the stack into an existing variable
+func (c *Compiler) store(node ast.Node, name string) {
+	r, ok := c.resolve(name)
+	if !ok {
+		c.errorf(node, "undefined variable %s", name)
+		return
+	} else if r.constant {
+		c.errorf(node, "cannot assign to %s, which is declared with set", name)
+		return
+	}
+
+	switch r.location {
+	case globalSlot:
+		c.emit(vm.GStore, number(r.slot))
+	case localSlot:
+		c.emit(vm.Store, number(r.slot))
+	case upvalueSlot:
+		c.emit(vm.UStore, number(r.slot))
+	}
+}
+
+// Statements
+
+func (c *Compiler) block(block *ast.Block) {
+	c.scope = &scope{parent: c.scope, frame: c.frame, names: map[string]variable{}}
+	for _, stmt := range block.Stmts {
+		c.stmt(stmt)
+	}
+	c.scope = c.scope.parent
+}
+
+func (c *Compiler) stmt(stmt ast.Stmt) {
+	c.at(stmt)
+
+	switch s := stmt.(type) {
+	case *ast.Block:
+		c.block(s)
+
+	case *ast.LetStmt:
+		if s.Value != nil {
+			c.expr(s.Value)
+		} else {
+			c.emit(vm.Const, vm.Nil)
+		}
+		c.define(s, s.Name, s.Constant)
+
+	case *ast.AssignStmt:
+		c.assign(s)
+
+	case *ast.ExprStmt:
+		c.expr(s.X)
+		c.emit(vm.Pop)
+
+	case *ast.IfStmt:
+		jump := c.jumpIfFalse(s.Cond)
+		c.block(s.Then)
+		if s.Else != nil {
+			end := c.emit(vm.Goto, number(0))
+			c.patch(jump)
+			c.stmt(s.Else)
+			c.patch(end)
+		} else {
+			c.patch(jump)
+		}
+
+	case *ast.ForStmt:
+		top := len(c.code)
+		jump := -1
+		if s.Cond != nil {
+			jump = c.jumpIfFalse(s.Cond)
+		}
+		c.block(s.Body)
+		c.emit(vm.Goto, number(top))
+		if jump != -1 {
+			c.patch(jump)
+		}
+
+	case *ast.ForOfStmt:
+		c.expr(s.Collection)
+		c.emit(vm.Iter)
+		top := len(c.code)
+		next := c.emit(vm.Next, number(0))
+
+		c.scope = &scope{parent: c.scope, frame: c.frame, names: map[string]variable{}}
+		c.define(s, s.Name, false)
+		c.block(s.Body)
+		c.scope = c.scope.parent
+
+		c.emit(vm.Goto, number(top))
+		c.patch(next)
+
+	case *ast.ReturnStmt:
+		if !c.frame.function {
+			c.errorf(s, "cannot return from outside of a function")
+			return
+		}
+		if s.Value != nil {
+			c.expr(s.Value)
+		} else {
+			c.emit(vm.Const, vm.Nil)
+		}
+		c.emit(vm.Return)
+
+	case *ast.FunStmt:
+		// Declared before its body is compiled so
+		// that the function may call itself
+		c.declare(s, s.Name, false)
+		c.closure(s.Name, s.Fun)
+		c.at(s)
+		c.store(s, s.Name)
+
+	case *ast.EntityStmt:
+		for _, field := range s.Fields {
+			c.emit(vm.Const, str(field))
+		}
+		c.emit(vm.MakeEntity, number(len(s.Fields)), str(s.Name))
+		c.define(s, s.Name, true)
+
+	case *ast.MethodStmt:
+		r, ok := c.resolve(s.Entity)
+		if !ok {
+			c.errorf(s, "undefined entity %s", s.Entity)
+			return
+		}
+		c.fetch(r)
+
+		// Methods are passed the instance they are called
+		// on as self, before any other arguments
+		fun := *s.Fun
+		if len(fun.Params) == 0 || fun.Params[0] != "self" {
+			fun.Params = append([]string{"self"}, fun.Params...)
+		}
+		c.closure(s.Name, &fun)
+		c.emit(vm.Method, str(s.Name))
+
+	case *ast.ImportStmt:
+		c.use(s)
+
+	case *ast.ExportStmt:
+		if !c.scope.global {
+			c.errorf(s, "names may only be exported from the top level")
+			return
+		}
+		for _, name := range s.Names {
+			c.exports = append(c.exports, &ast.Ident{Pos: s.Pos, Name: name})
+		}
+
+	default:
+		c.errorf(s, "unexpected statement")
+	}
+}
+
+// use binds the module imported by an import statement to the last
+// part of its name, as in circle for import shapes.circle
+func (c *Compiler) use(s *ast.ImportStmt) {
+	if !c.scope.global {
+		c.errorf(s, "modules may only be imported at the top level")
+		return
+	}
+
+	slot, ok := c.modules[c.imports[s.Name]]
+	if !ok {
+		c.errorf(s, "cannot find module %s", s.Name)
+		return
+	}
+
+	name := s.Name[strings.LastIndex(s.Name, ".")+1:]
+	if _, exists := c.scope.names[name]; exists {
+		c.errorf(s, "%s is already declared", name)
+	} else if _, exists := c.functions[name]; exists {
+		c.errorf(s, "%s is already declared as a function", name)
+	} else {
+		c.scope.names[name] = variable{slot: slot, constant: true}
+	}
+}
+
+func (c *Compiler) assign(s *ast.AssignStmt) {
+	switch target := s.Target.(type) {
+	case *ast.Ident:
+		c.expr(s.Value)
+		c.store(target, target.Name)
+
+	case *ast.IndexExpr:
+		c.expr(target.X)
+		c.expr(target.Index)
+		c.expr(s.Value)
+		c.emit(vm.Set)
+
+	case *ast.DotExpr:
+		c.expr(target.X)
+		c.expr(s.Value)
+		c.at(target)
+		c.emit(vm.SetField, str(target.Name))
+
+	default:
+		c.errorf(s, "cannot assign to this expression")
+	}
+}
+
+// comparisonJumps maps each ordering operator to the jump
+// taken when the comparison holds
+var comparisonJumps = map[scanner.TokenType]vm.Opcode{
+	scanner.LessToken:         vm.IfLessThan,
+	scanner.LessEqualToken:    vm.IfLessThanOrEqual,
+	scanner.GreaterToken:      vm.IfGreaterThan,
+	scanner.GreaterEqualToken: vm.IfGreaterThanOrEqual,
+}
+
+// jumpIfFalse evaluates a condition and emits a jump which is taken
+// if the condition is not truthy, returning its address to be patched.
+// A comparison jumps over that jump when it holds, since a failed
+// comparison does not imply the opposite one holds when given NaN
+func (c *Compiler) jumpIfFalse(cond ast.Expr) int {
+	if b, ok := cond.(*ast.BinaryExpr); ok {
+		if op, ok := comparisonJumps[b.Op]; ok {
+			c.expr(b.Left)
+			c.expr(b.Right)
+			c.at(b)
+			c.emit(op, number(len(c.code)+2))
+			return c.emit(vm.Goto, number(0))
+		}
+	}
+
+	c.expr(cond)
+	return c.emit(vm.JumpIfFalse, number(0))
+}
+
+// Expressions
+
+// operators maps binary operators to the instruction
+// which applies them to the top two items of the stack
+var operators = map[scanner.TokenType]vm.Opcode{
+	scanner.PlusToken:         vm.Add,
+	scanner.MinusToken:        vm.Sub,
+	scanner.StarToken:         vm.Mul,
+	scanner.SlashToken:        vm.Div,
+	scanner.EqualEqualToken:   vm.Equal,
+	scanner.IsToken:           vm.Equal,
+	scanner.BangEqualToken:    vm.NotEqual,
+	scanner.LessToken:         vm.LessThan,
+	scanner.LessEqualToken:    vm.LessThanOrEqual,
+	scanner.GreaterToken:      vm.GreaterThan,
+	scanner.GreaterEqualToken: vm.GreaterThanOrEqual,
+}
+
+func (c *Compiler) expr(expr ast.Expr) {
+	switch e := expr.(type) {
+	case *ast.NumberLit:
+		c.emit(vm.Const, vm.Value{Kind: vm.NumberValue, Content: e.Value})
+
+	case *ast.StringLit:
+		c.emit(vm.Const, vm.Value{Kind: vm.StringValue, Content: e.Value})
+
+	case *ast.BoolLit:
+		c.emit(vm.Const, vm.Value{Kind: vm.BoolValue, Content: e.Value})
+
+	case *ast.NilLit:
+		c.emit(vm.Const, vm.Nil)
+
+	case *ast.Ident:
+		if r, ok := c.resolve(e.Name); ok {
+			c.fetch(r)
+		} else if fn, ok := c.functions[e.Name]; ok {
+			params := len(fn.decl.Fun.Params)
+			closure := c.emit(vm.MakeClosure, number(0), number(params), str(e.Name))
+			fn.calls = append(fn.calls, closure)
+		} else {
+			c.errorf(e, "undefined variable %s", e.Name)
+		}
+
+	case *ast.ListLit:
+		for _, item := range e.Items {
+			c.expr(item)
+		}
+		c.emit(vm.MakeList, number(len(e.Items)))
+
+	case *ast.MapLit:
+		for i := range e.Keys {
+			c.expr(e.Keys[i])
+			c.expr(e.Values[i])
+		}
+		c.emit(vm.MakeMap, number(len(e.Keys)))
+
+	case *ast.UnaryExpr:
+		if e.Op == scanner.BangToken {
+			c.expr(e.X)
+			c.at(e)
+			c.emit(vm.Not)
+		} else {
+			c.emit(vm.Const, number(0))
+			c.expr(e.X)
+			c.at(e)
+			c.emit(vm.Sub)
+		}
+
+	case *ast.BinaryExpr:
+		if e.Op == scanner.AndToken || e.Op == scanner.OrToken {
+			c.logical(e)
+			return
+		}
+		c.expr(e.Left)
+		c.expr(e.Right)
+		c.at(e)
+		c.emit(operators[e.Op])
+
+	case *ast.CallExpr:
+		c.call(e)
+
+	case *ast.IndexExpr:
+		c.expr(e.X)
+		c.expr(e.Index)
+		c.at(e)
+		c.emit(vm.Get)
+
+	case *ast.DotExpr:
+		c.expr(e.X)
+		c.at(e)
+		c.emit(vm.GetField, str(e.Name))
+
+	case *ast.FunLit:
+		c.closure("anonymous", e)
+
+	default:
+		c.errorf(e, "unexpected expression")
+	}
+}
+
+// logical compiles the short circuiting and/or operators,
+// which always produce a bool
+func (c *Compiler) logical(e *ast.BinaryExpr) {
+	jump := vm.JumpIfFalse
+	if e.Op == scanner.OrToken {
+		jump = vm.JumpIfTrue
+	}
+
+	c.expr(e.Left)
+	left := c.emit(jump, number(0))
+	c.expr(e.Right)
+	right := c.emit(jump, number(0))
+
+	// Both operands fell through, so the result is
+	// true for and, or false for or
+	c.emit(vm.Const, vm.Value{Kind: vm.BoolValue, Content: jump == vm.JumpIfFalse})
+	end := c.emit(vm.Goto, number(0))
+	c.patch(left)
+	c.patch(right)
+	c.emit(vm.Const, vm.Value{Kind: vm.BoolValue, Content: jump == vm.JumpIfTrue})
+	c.patch(end)
+}
+
+// builtins maps the functions provided by the vm to the
+// instruction which implements them
+var builtins = map[string]vm.Opcode{
+	"print": vm.Print,
+	"len":   vm.Length,
+}
+
+// call compiles a call to a function. Top level functions, natives
+// and builtins are called directly, whereas any other value is
+// called through callv with its arity checked at runtime
+func (c *Compiler) call(e *ast.CallExpr) {
+	if ident, ok := e.Fun.(*ast.Ident); ok {
+		if _, ok := c.resolve(ident.Name); !ok {
+			c.direct(e, ident)
+			return
+		}
+	}
+
+	for _, arg := range e.Args {
+		c.expr(arg)
+	}
+	c.expr(e.Fun)
+	c.at(e)
+	c.emit(vm.CallValue, number(len(e.Args)))
+}
+
+func (c *Compiler) direct(e *ast.CallExpr, ident *ast.Ident) {
+	if fn, ok := c.functions[ident.Name]; ok {
+		params := len(fn.decl.Fun.Params)
+		if len(e.Args) != params {
+			c.errorf(e, "%s expects %d arguments, found %d", ident.Name, params, len(e.Args))
+		}
+
+		for _, arg := range e.Args {
+			c.expr(arg)
+		}
+		c.at(e)
+		call := c.emit(vm.Call, number(0), number(len(e.Args)))
+		fn.calls = append(fn.calls, call)
+		return
+	}
+
+	// Natives are checked before builtins so that
+	// hosts may replace them, such as print
+	if native, ok := c.natives.Lookup(ident.Name); ok {
+		if native.Arity >= 0 && len(e.Args) != native.Arity {
+			c.errorf(e, "%s expects %d arguments, found %d", ident.Name, native.Arity, len(e.Args))
+		}
+
+		for _, arg := range e.Args {
+			c.expr(arg)
+		}
+		c.at(e)
+		c.emit(vm.CallNative, str(ident.Name), number(len(e.Args)))
+		return
+	}
+
+	if op, ok := builtins[ident.Name]; ok {
+		if len(e.Args) != 1 {
+			c.errorf(e, "%s expects 1 argument, found %d", ident.Name, len(e.Args))
+			return
+		}
+		c.expr(e.Args[0])
+		c.at(e)
+		c.emit(op)
+
+		// print leaves its argument on the stack,
+		// whereas as a function it returns nil
+		if op == vm.Print {
+			c.emit(vm.Pop)
+			c.emit(vm.Const, vm.Nil)
+		}
+		return
+	}
+
+	c.errorf(e, "undefined function %s", ident.Name)
+}
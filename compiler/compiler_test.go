@@ -0,0 +1,284 @@
+package compiler
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/chickencoder/run/parser"
+	"github.com/chickencoder/run/vm"
+)
+
+// compile compiles source with natives, which may be nil,
+// returning the program along with any compile errors
+func compile(t *testing.T, source string, natives *vm.Natives) ([]*vm.Instruction, []Error) {
+	t.Helper()
+	tree, errs := parser.Parse(source)
+	if len(errs) > 0 {
+		t.Fatalf("parsing %q: %v", source, errs)
+	}
+
+	c := NewCompiler()
+	c.SetNatives(natives)
+	c.Program(tree)
+	return c.Code(), c.Errors
+}
+
+// run compiles and runs source, returning what it printed
+func run(t *testing.T, source string, natives *vm.Natives) (string, error) {
+	t.Helper()
+	program, errs := compile(t, source, natives)
+	if len(errs) > 0 {
+		t.Fatalf("compiling %q: %v", source, errs)
+	}
+
+	var out bytes.Buffer
+	r := vm.NewRunner(program, 256, 0, false)
+	r.SetOutput(&out)
+	r.SetNatives(natives)
+	r.SetGlobal(ArgsGlobal, vm.NewList(nil))
+	err := r.Run()
+	return out.String(), err
+}
+
+// programTest is a program along with what it should print
+type programTest struct {
+	name   string
+	source string
+	output string
+}
+
+func checkPrograms(t *testing.T, tests []programTest, natives *vm.Natives) {
+	t.Helper()
+	for _, test := range tests {
+		out, err := run(t, test.source, natives)
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+		} else if out != test.output {
+			t.Errorf("%s: printed %q, want %q", test.name, out, test.output)
+		}
+	}
+}
+
+// runtimeErrorTest is a program which compiles
+// but fails at runtime with a RuntimeError
+type runtimeErrorTest struct {
+	name    string
+	source  string
+	kind    vm.ErrorKind
+	message string
+}
+
+func checkRuntimeErrors(t *testing.T, tests []runtimeErrorTest) {
+	t.Helper()
+	for _, test := range tests {
+		_, err := run(t, test.source, nil)
+		rerr, ok := err.(*vm.RuntimeError)
+		if !ok || rerr.Kind != test.kind || rerr.Message != test.message {
+			t.Errorf("%s: returned %v, expected a %s: %s", test.name, err, test.kind, test.message)
+		}
+	}
+}
+
+// errorTest is a program along with the errors it should fail
+// to compile with, formatted as line:column: message
+type errorTest struct {
+	name   string
+	source string
+	errors []string
+}
+
+func checkErrors(t *testing.T, tests []errorTest, natives *vm.Natives) {
+	t.Helper()
+	for _, test := range tests {
+		_, errs := compile(t, test.source, natives)
+		found := make([]string, len(errs))
+		for i, err := range errs {
+			found[i] = err.Error()
+		}
+		if strings.Join(found, "\n") != strings.Join(test.errors, "\n") {
+			t.Errorf("%s: errors %q, want %q", test.name, found, test.errors)
+		}
+	}
+}
+
+// mnemonics lists the instructions of a program
+func mnemonics(program []*vm.Instruction) []string {
+	names := make([]string, len(program))
+	for i, instr := range program {
+		names[i] = vm.Instructions[instr.Code]
+	}
+	return names
+}
+
+func contains(names []string, name string) bool {
+	for _, n := range names {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Conditions which compare two values branch on the comparison
+// directly, rather than pushing a bool for jmpf
+var loweringTests = []struct {
+	name    string
+	source  string
+	want    string // Instruction which must be emitted
+	without string // Instruction which must not be emitted
+}{
+	{"if less", "let x = 1\nif x < 2 {}", "iflt", "lt"},
+	{"if less or equal", "let x = 1\nif x <= 2 {}", "iflte", "lte"},
+	{"if greater", "let x = 1\nif x > 2 {}", "ifgt", "gt"},
+	{"if greater or equal", "let x = 1\nif x >= 2 {}", "ifgte", "gte"},
+	{"for less", "let x = 1\nfor x < 2 {}", "iflt", "jmpf"},
+	{"if equal", "let x = 1\nif x == 2 {}", "jmpf", "ifeq"},
+	{"if truthy", "let x = 1\nif x {}", "jmpf", "iflt"},
+	{"comparison value", "let x = 1 < 2", "lt", "iflt"},
+}
+
+func TestConditionLowering(t *testing.T) {
+	for _, test := range loweringTests {
+		program, errs := compile(t, test.source, nil)
+		if len(errs) > 0 {
+			t.Errorf("%s: %v", test.name, errs)
+			continue
+		}
+		names := mnemonics(program)
+		if !contains(names, test.want) || contains(names, test.without) {
+			t.Errorf("%s: compiled to %v, want %s without %s", test.name, names, test.want, test.without)
+		}
+	}
+}
+
+var statementTests = []programTest{
+	{"if", "let x = 1\nif x < 2 { print(\"yes\") }", "yes\n"},
+	{"if not taken", "let x = 3\nif x < 2 { print(\"yes\") }\nprint(x)", "3\n"},
+	{"else", "let x = 3\nif x <= 2 { print(1) } else { print(2) }", "2\n"},
+	{"else if", "let x = 3\nif x < 2 { print(1) } else if x >= 3 { print(2) } else { print(3) }", "2\n"},
+	{"nan comparison", "let x = 0 / 0\nif x < 1 { print(1) } else { print(2) }", "2\n"},
+	{"nan loop", "let x = 0 / 0\nfor x >= 1 { x = 0 }\nprint(x)", "NaN\n"},
+	{"for", "let i = 0\nfor i < 3 {\n print(i)\n i = i + 1\n}", "0\n1\n2\n"},
+	{"for greater", "let i = 3\nfor i > 0 { i = i - 1 }\nprint(i)", "0\n"},
+	{"for of", "for x of [1, 2] { print(x) }", "1\n2\n"},
+	{"for of map", "for k of { a: 1, b: 2 } { print(k) }", "a\nb\n"},
+
+	// Block scoping
+	{"shadowing", "let x = 1\nif true {\n let x = 2\n print(x)\n}\nprint(x)", "2\n1\n"},
+	{"outer assignment", "let x = 1\nif true { x = 2 }\nprint(x)", "2\n"},
+	{"sibling blocks", "if true { let y = 1 }\nif true {\n let y = 2\n print(y)\n}", "2\n"},
+	{"loop body", "let i = 0\nfor i < 2 {\n let j = i * 10\n print(j)\n i = i + 1\n}", "0\n10\n"},
+	{"let without value", "let x\nprint(x)", "nil\n"},
+
+	// Short circuiting
+	{"and false", "fun f() {\n print(\"f\")\n return true\n}\nprint(false and f())", "false\n"},
+	{"and true", "fun f() {\n print(\"f\")\n return 2\n}\nprint(true and f())", "f\ntrue\n"},
+	{"or true", "fun f() {\n print(\"f\")\n return true\n}\nprint(1 or f())", "true\n"},
+	{"or false", "fun f() {\n print(\"f\")\n return nil\n}\nprint(nil or f())", "f\nfalse\n"},
+	{"logic in condition", "let x = 1\nif x > 0 and x < 2 { print(\"in\") }", "in\n"},
+
+	// Calls and builtins
+	{"call", "fun add(a, b) { return a + b }\nprint(add(1, 2))", "3\n"},
+	{"call before declaration", "print(double(2))\nfun double(x) { return x * 2 }", "4\n"},
+	{"recursion", "fun fib(n) {\n if n < 2 { return n }\n return fib(n - 1) + fib(n - 2)\n}\nprint(fib(10))", "55\n"},
+	{"no return", "fun f() {}\nprint(f())", "nil\n"},
+	{"function value", "fun f(x) { return x + 1 }\nlet g = f\nprint(g(1))", "2\n"},
+	{"print returns nil", "print(print(1))", "1\nnil\n"},
+	{"len", "print(len([1, 2, 3]))\nprint(len(\"four\"))", "3\n4\n"},
+	{"operators", "print(-2 * 3 + 10 / 4)\nprint(!true)\nprint(1 != 2)\nprint(\"a\" is \"a\")", "-3.5\nfalse\ntrue\ntrue\n"},
+	{"collections", "let xs = [1, 2]\nxs[0] = 5\nprint(xs[0])\nlet m = { a: 1 }\nprint(m[\"a\"])", "5\n1\n"},
+}
+
+func TestStatements(t *testing.T) {
+	checkPrograms(t, statementTests, nil)
+}
+
+func TestNatives(t *testing.T) {
+	var printed []string
+	natives := vm.NewNatives()
+	natives.Register("print", 1, func(args []vm.Value) (vm.Value, error) {
+		printed = append(printed, args[0].String())
+		return vm.Nil, nil
+	})
+	natives.Register("double", 1, func(args []vm.Value) (vm.Value, error) {
+		return vm.Value{Kind: vm.NumberValue, Content: args[0].Content.(float64) * 2}, nil
+	})
+
+	program, errs := compile(t, "print(double(len([1, 2])))", natives)
+	if len(errs) > 0 {
+		t.Fatal(errs)
+	}
+	names := mnemonics(program)
+	if !contains(names, "callnative") || contains(names, "print") {
+		t.Errorf("compiled to %v, want callnative in place of print", names)
+	}
+
+	out, err := run(t, "print(double(len([1, 2])))", natives)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out != "" || strings.Join(printed, ",") != "4" {
+		t.Errorf("printed %q and %q natively, want only 4 natively", out, printed)
+	}
+}
+
+var compileErrorTests = []errorTest{
+	{"undefined variable", "print(x)", []string{"1:7: undefined variable x"}},
+	{"undefined assignment", "x = 1", []string{"1:1: undefined variable x"}},
+	{"out of scope", "if true { let y = 1 }\nprint(y)", []string{"2:7: undefined variable y"}},
+	{"undefined function", "f(1)", []string{"1:2: undefined function f"}},
+	{"too few arguments", "fun f(a, b) {}\nf(1)", []string{"2:2: f expects 2 arguments, found 1"}},
+	{"too many arguments", "fun f() {}\nf(1)", []string{"2:2: f expects 0 arguments, found 1"}},
+	{"builtin arguments", "len([], [])", []string{"1:4: len expects 1 argument, found 2"}},
+	{"native arguments", "double()", []string{"1:7: double expects 1 arguments, found 0"}},
+	{"redeclared", "let x = 1\nlet x = 2", []string{"2:1: x is already declared"}},
+	{"redeclared in block", "if true {\n let x = 1\n set x = 2\n}", []string{"3:2: x is already declared"}},
+	{"function redeclared", "fun f() {}\nfun f() {}", []string{"2:1: function f is already declared"}},
+	{"variable named as function", "fun f() {}\nlet f = 1", []string{"2:1: f is already declared as a function"}},
+	{"return at top level", "return 1", []string{"1:1: cannot return from outside of a function"}},
+	{"nested export", "fun f() {\n let x = 1\n export x\n}", []string{"3:2: names may only be exported from the top level"}},
+	{"nested import", "if true { import maths }", []string{"1:11: modules may only be imported at the top level"}},
+	{"missing module", "import maths", []string{"1:1: cannot find module maths"}},
+	{"several errors", "print(a)\nb = 1\nreturn", []string{
+		"1:7: undefined variable a",
+		"2:1: undefined variable b",
+		"3:1: cannot return from outside of a function",
+	}},
+}
+
+func TestCompileErrors(t *testing.T) {
+	natives := vm.NewNatives()
+	natives.Register("double", 1, func(args []vm.Value) (vm.Value, error) {
+		return args[0], nil
+	})
+	checkErrors(t, compileErrorTests, natives)
+}
+
+// Names declared with set, and those declared on their behalf
+// such as entities and args, cannot be assigned
+var constantTests = []errorTest{
+	{"global", "set pi = 3.14\npi = 3", []string{"2:1: cannot assign to pi, which is declared with set"}},
+	{"local", "fun f() {\n set x = 1\n x = 2\n}", []string{"3:2: cannot assign to x, which is declared with set"}},
+	{"block", "if true {\n set x = 1\n x = 2\n}", []string{"3:2: cannot assign to x, which is declared with set"}},
+	{"upvalue", "fun f() {\n set x = 1\n return fun() { x = 2 }\n}", []string{"3:17: cannot assign to x, which is declared with set"}},
+	{"entity", "entity A { a }\nA = 1", []string{"2:1: cannot assign to A, which is declared with set"}},
+	{"args", "args = []", []string{"1:1: cannot assign to args, which is declared with set"}},
+}
+
+func TestConstants(t *testing.T) {
+	checkErrors(t, constantTests, nil)
+
+	// Shadowing a constant declares a new variable
+	checkPrograms(t, []programTest{
+		{"shadowed", "set x = 1\nif true {\n let x = 2\n x = 3\n print(x)\n}\nprint(x)", "3\n1\n"},
+	}, nil)
+
+	// Constant globals are defined with gdefine, so that
+	// the vm refuses to store to them as well
+	program, _ := compile(t, "set x = 1\nlet y = 2", nil)
+	names := mnemonics(program)
+	if !contains(names, "gdefine") || !contains(names, "gstore") {
+		t.Errorf("compiled to %v, want gdefine for x and gstore for y", names)
+	}
+}
@@ -0,0 +1,70 @@
+package compiler
+
+import (
+	"testing"
+
+	"github.com/chickencoder/run/vm"
+)
+
+const animal = `
+entity Animal { mass, species }
+
+Animal fun eat(f) {
+	self.mass = self.mass + f
+	return self.mass
+}
+
+Animal fun describe() {
+	return [self.species, self.eat(0)]
+}
+`
+
+var entityTests = []programTest{
+	{"construct", animal + `print(Animal(40, "dog"))`, "Animal{mass: 40, species: \"dog\"}\n"},
+	{"entity", animal + "print(Animal)", "<entity Animal>\n"},
+	{"no fields", "entity Unit {}\nprint(Unit())", "Unit{}\n"},
+	{"get field", animal + `let a = Animal(40, "dog")` + "\nprint(a.species)", "dog\n"},
+	{"set field", animal + `let a = Animal(40, "dog")` + "\na.mass = 50\nprint(a.mass)", "50\n"},
+	{"method", animal + `let a = Animal(40, "dog")` + "\nprint(a.eat(2))\nprint(a.mass)", "42\n42\n"},
+	{"method calls method", animal + `let a = Animal(40, "dog")` + "\nprint(a.describe())", "[\"dog\", 40]\n"},
+	{"explicit self", "entity A { x }\nA fun get(self) { return self.x }\nprint(A(3).get())", "3\n"},
+	{"bound method", animal + `let a = Animal(40, "dog")` + "\nlet eat = a.eat\neat(1)\nprint(a.mass)", "41\n"},
+	{"bound method value", animal + `print(Animal(1, "cat").eat)`, "<fun eat/1>\n"},
+	{"shared", animal + `let a = Animal(40, "dog")` + "\nlet b = a\nb.mass = 1\nprint(a.mass)", "1\n"},
+	{"separate", animal + `let a = Animal(40, "dog")` + "\n" + `let b = Animal(40, "dog")` + "\nb.eat(1)\nprint(a.mass)", "40\n"},
+	{"entity value", "entity P { x }\nfun make(e) { return e(1) }\nprint(make(P).x)", "1\n"},
+	{"later method", "entity A { x }\nlet a = A(1)\nA fun get() { return self.x }\nprint(a.get())", "1\n"},
+	{"local entity", "fun f() {\n entity L { v }\n return L(2)\n}\nprint(f().v)", "2\n"},
+	{"nested fields", "entity N { next, v }\nlet n = N(N(nil, 2), 1)\nprint(n.next.v)\nn.next.v = 3\nprint(n.next.v)", "2\n3\n"},
+}
+
+func TestEntities(t *testing.T) {
+	checkPrograms(t, entityTests, nil)
+}
+
+var entityErrorTests = []runtimeErrorTest{
+	{"too few fields", animal + "Animal(1)", vm.ValueError, "Animal expects 2 fields, found 1"},
+	{"too many fields", animal + `Animal(1, "a", 3)`, vm.ValueError, "Animal expects 2 fields, found 3"},
+	{"missing field", animal + `print(Animal(1, "a").legs)`, vm.ValueError, "Animal has no field or method legs"},
+	{"set missing field", animal + `let a = Animal(1, "a")` + "\na.legs = 4", vm.ValueError, "Animal has no field legs"},
+	{"set method", animal + `let a = Animal(1, "a")` + "\na.eat = 4", vm.ValueError, "Animal has no field eat"},
+	{"method arity", animal + `Animal(1, "a").eat()`, vm.ValueError, "eat expects 1 arguments, found 0"},
+	{"field of number", "let x = 1\nprint(x.y)", vm.ValueError, "cannot get field of number value"},
+	{"set field of list", "let x = []\nx.y = 1", vm.ValueError, "cannot set field of list value"},
+	{"field of entity", "entity A { x }\nprint(A.x)", vm.ValueError, "cannot get field of entity value"},
+	{"method of instance", "entity A { x }\nlet a = A(1)\na fun f() {}", vm.ValueError, "cannot declare function value as method of instance value"},
+}
+
+func TestEntityErrors(t *testing.T) {
+	checkRuntimeErrors(t, entityErrorTests)
+}
+
+var entityCompileErrorTests = []errorTest{
+	{"undefined entity", "B fun f() {}", []string{"1:1: undefined entity B"}},
+	{"redeclared", "entity A { x }\nentity A { y }", []string{"2:1: A is already declared"}},
+	{"assigned", "entity A { x }\nA = 1", []string{"2:1: cannot assign to A, which is declared with set"}},
+}
+
+func TestEntityCompileErrors(t *testing.T) {
+	checkErrors(t, entityCompileErrorTests, nil)
+}
@@ -0,0 +1,207 @@
+package compiler
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+
+	"github.com/chickencoder/run/ast"
+	"github.com/chickencoder/run/parser"
+	"github.com/chickencoder/run/vm"
+)
+
+// module is a source file loaded as part of a program
+type module struct {
+	path    string // Absolute path, identifying the module
+	display string // Path as shown in errors, relative to the program
+	name    string // Name qualifying the labels of its functions, empty for the program
+	tree    *ast.Program
+	imports map[string]string // Path of each imported module by import name
+	loading bool              // Its imports are still being loaded
+}
+
+// loader reads every module imported by a program,
+// ordering them so that each follows its imports
+type loader struct {
+	root    string  // Directory of the program, used to shorten paths
+	dir     string  // Directory of the program as it was given
+	source  *string // Source of the program, if it is not read from its file
+	modules map[string]*module
+	order   []*module
+	chain   []string // Modules currently being loaded, each importing the next
+	errors  []Error
+}
+
+// Load reads and compiles the program at path along with every
+// module it imports. Imported modules must be within the directory
+// of the file importing them, or a lower directory. Each module is
+// compiled once and its top level runs once, before that of the
+// modules which import it. Calls to natives, which may be nil,
+// are compiled into callnative instructions
+func Load(path string, natives *vm.Natives) ([]*vm.Instruction, []Error) {
+	c := NewCompiler()
+	c.SetNatives(natives)
+	errs := c.Load(path)
+	return c.code, errs
+}
+
+// Load compiles the program at path and the modules it imports,
+// as the package level Load, into a Compiler which has not yet
+// compiled anything else
+func (c *Compiler) Load(path string) []Error {
+	return c.load(path, nil)
+}
+
+// LoadSource compiles source as if it were the program at path,
+// such as for a program which is not stored in a file. Modules
+// it imports are found relative to the directory of path
+func (c *Compiler) LoadSource(path, source string) []Error {
+	return c.load(path, &source)
+}
+
+func (c *Compiler) load(path string, source *string) []Error {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return []Error{{Path: path, Message: err.Error()}}
+	}
+
+	l := &loader{
+		root:    filepath.Dir(abs),
+		dir:     filepath.Dir(path),
+		source:  source,
+		modules: map[string]*module{},
+	}
+	main := l.load(abs, nil, nil)
+	if len(l.errors) > 0 {
+		return l.errors
+	}
+
+	for _, m := range l.order {
+		if m != main {
+			c.module(m)
+		}
+	}
+	c.reset(main)
+	c.Program(main.tree)
+	c.entry()
+	return c.Errors
+}
+
+// load reads a module along with its imports, reporting any
+// errors at the import statement in the importing module
+func (l *loader) load(path string, importer *module, stmt *ast.ImportStmt) *module {
+	if m, ok := l.modules[path]; ok {
+		if m.loading {
+			chain := make([]string, 0, len(l.chain)+1)
+			for _, p := range append(l.chain, path) {
+				chain = append(chain, l.relative(p))
+			}
+			l.errorf(importer, stmt, "import cycle: %s", strings.Join(chain, " -> "))
+		}
+		return m
+	}
+
+	display := filepath.Join(l.dir, l.relative(path))
+	dat, err := l.read(path, importer)
+	if err != nil {
+		if importer == nil {
+			l.errors = append(l.errors, Error{Path: display, Message: "couldn't open file"})
+		} else {
+			l.errorf(importer, stmt, "cannot find module %s", stmt.Name)
+		}
+		return nil
+	}
+
+	tree, errs := parser.Parse(string(dat))
+	for _, e := range errs {
+		l.errors = append(l.errors, Error{Path: display, Line: e.Line, Column: e.Column, Message: e.Message})
+	}
+
+	m := &module{
+		path:    path,
+		display: display,
+		tree:    tree,
+		imports: map[string]string{},
+		loading: true,
+	}
+	if importer != nil {
+		m.name = l.name(path)
+	}
+	l.modules[path] = m
+	l.chain = append(l.chain, path)
+
+	for _, s := range tree.Stmts {
+		if s, ok := s.(*ast.ImportStmt); ok {
+			file, err := resolve(filepath.Dir(path), s.Name)
+			if err != nil {
+				l.errorf(m, s, "%s", err)
+				continue
+			}
+			if dep := l.load(file, m, s); dep != nil {
+				m.imports[s.Name] = dep.path
+			}
+		}
+	}
+
+	l.chain = l.chain[:len(l.chain)-1]
+	m.loading = false
+	l.order = append(l.order, m)
+	return m
+}
+
+// read returns the source of a module, which for the
+// program itself may have been given instead of its file
+func (l *loader) read(path string, importer *module) ([]byte, error) {
+	if importer == nil && l.source != nil {
+		return []byte(*l.source), nil
+	}
+	return ioutil.ReadFile(path)
+}
+
+// resolve finds the file of a module imported from dir, refusing
+// any which would lie outside of dir once links are followed
+func resolve(dir, name string) (string, error) {
+	file := filepath.Join(dir, filepath.FromSlash(strings.Replace(name, ".", "/", -1))+".run")
+
+	real, err := filepath.EvalSymlinks(file)
+	if err != nil {
+		// Missing files are reported when they are read
+		return file, nil
+	}
+	realDir, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		return "", err
+	}
+
+	rel, err := filepath.Rel(realDir, real)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("cannot import module %s from outside of the directory of the importing file", name)
+	}
+	return file, nil
+}
+
+// name returns the name of a module as it would be imported by
+// the program, such as lib.maths for the file lib/maths.run
+func (l *loader) name(path string) string {
+	rel := strings.TrimSuffix(l.relative(path), filepath.Ext(path))
+	return strings.Replace(filepath.ToSlash(rel), "/", ".", -1)
+}
+
+// relative shortens a path to be relative to the directory of the program
+func (l *loader) relative(path string) string {
+	if rel, err := filepath.Rel(l.root, path); err == nil {
+		return rel
+	}
+	return path
+}
+
+func (l *loader) errorf(m *module, node ast.Node, format string, args ...interface{}) {
+	pos := node.Position()
+	l.errors = append(l.errors, Error{
+		Path:    m.display,
+		Line:    pos.Line,
+		Column:  pos.Column,
+		Message: fmt.Sprintf(format, args...),
+	})
+}
@@ -0,0 +1,214 @@
+package compiler
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/chickencoder/run/vm"
+)
+
+// writeFiles writes each file to a temporary directory,
+// returning the directory
+func writeFiles(t *testing.T, files map[string]string) string {
+	t.Helper()
+	dir := t.TempDir()
+	for name, source := range files {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(source), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+// runFile loads and runs the program main.run in dir,
+// returning what it printed
+func runFile(t *testing.T, dir string) (string, error) {
+	t.Helper()
+	program, errs := Load(filepath.Join(dir, "main.run"), nil)
+	if len(errs) > 0 {
+		t.Fatal(errs)
+	}
+	main, err := vm.Entry(program, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var out bytes.Buffer
+	r := vm.NewRunner(program, 256, main, false)
+	r.SetOutput(&out)
+	r.SetGlobal(ArgsGlobal, vm.NewList(nil))
+	err = r.Run()
+	return out.String(), err
+}
+
+const maths = `
+set Pi = 3
+fun double(x) { return x * 2 }
+fun hidden() { return 0 }
+export Pi, double
+`
+
+var importTests = []struct {
+	name   string
+	files  map[string]string
+	output string
+}{
+	{"import", map[string]string{
+		"main.run":  "import maths\nprint(maths.double(maths.Pi))",
+		"maths.run": maths,
+	}, "6\n"},
+	{"lower directory", map[string]string{
+		"main.run":             "import shapes.circle\nprint(circle.area(1))",
+		"shapes/circle.run":    "import shapes.pi\nfun area(r) { return pi.value * r * r }\nexport area",
+		"shapes/shapes/pi.run": "set value = 3\nexport value",
+	}, "3\n"},
+	{"module value", map[string]string{
+		"main.run":  "import maths\nprint(maths)",
+		"maths.run": maths,
+	}, "<module maths>\n"},
+
+	// Imported modules run once, before the modules importing them
+	{"order", map[string]string{
+		"main.run": "import a\nimport b\nprint(\"main\")",
+		"a.run":    "import c\nprint(\"a\")",
+		"b.run":    "import c\nprint(\"b\")",
+		"c.run":    "print(\"c\")",
+	}, "c\na\nb\nmain\n"},
+	{"shared state", map[string]string{
+		"main.run":    "import a\nimport counter\na.bump()\ncounter.bump()\nprint(counter.get())",
+		"a.run":       "import counter\nfun bump() { counter.bump() }\nexport bump",
+		"counter.run": "let n = 0\nfun bump() { n = n + 1 }\nfun get() { return n }\nexport bump, get",
+	}, "2\n"},
+
+	// Modules have their own globals and functions
+	{"same names", map[string]string{
+		"main.run": "import a\nlet x = \"main\"\nfun f() { return x }\nprint(f())\nprint(a.f())",
+		"a.run":    "let x = \"a\"\nfun f() { return x }\nexport f",
+	}, "main\na\n"},
+	{"function named main", map[string]string{
+		"main.run": "import a\nfun main() { return a.main() + 1 }\nprint(main())",
+		"a.run":    "fun main() { return 1 }\nexport main",
+	}, "2\n"},
+}
+
+func TestImports(t *testing.T) {
+	for _, test := range importTests {
+		out, err := runFile(t, writeFiles(t, test.files))
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+		} else if out != test.output {
+			t.Errorf("%s: printed %q, want %q", test.name, out, test.output)
+		}
+	}
+}
+
+// Functions of imported modules are labelled with the name
+// the program would import them by, leaving bare labels
+// to the functions of the program
+func TestModuleLabels(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"main.run":          "import maths\nimport shapes.circle\nfun double(x) { return x }\nfun main() {}",
+		"maths.run":         maths,
+		"shapes/circle.run": "fun area(r) { return r }\nexport area",
+	})
+	program, errs := Load(filepath.Join(dir, "main.run"), nil)
+	if len(errs) > 0 {
+		t.Fatal(errs)
+	}
+
+	labels := vm.Labels(program)
+	for _, label := range []string{"double", "maths.double", "maths.hidden", "shapes.circle.area", "main_"} {
+		address, ok := labels[label]
+		if !ok {
+			t.Errorf("program has no label %s", label)
+		} else if program[address].Code != vm.Enter {
+			t.Errorf("label %s is on %s, want the enter of a function", label, program[address].Display())
+		}
+	}
+	if labels[vm.EntryLabel] != 0 {
+		t.Errorf("entry label at %d, want 0", labels[vm.EntryLabel])
+	}
+}
+
+var loadErrorTests = []struct {
+	name   string
+	files  map[string]string
+	errors []string // With the directory removed
+}{
+	{"missing module", map[string]string{
+		"main.run": "let x = 1\nimport nope",
+	}, []string{"main.run:2:1: cannot find module nope"}},
+	{"missing in module", map[string]string{
+		"main.run": "import a",
+		"a.run":    "\nimport nope",
+	}, []string{"a.run:2:1: cannot find module nope"}},
+	{"cycle", map[string]string{
+		"main.run": "import a",
+		"a.run":    "import b",
+		"b.run":    "import a",
+	}, []string{"b.run:1:1: import cycle: main.run -> a.run -> b.run -> a.run"}},
+	{"self import", map[string]string{
+		"main.run": "import main",
+	}, []string{"main.run:1:1: import cycle: main.run -> main.run"}},
+	{"syntax error", map[string]string{
+		"main.run": "import a",
+		"a.run":    "let = 1",
+	}, []string{"a.run:1:5: expected variable name, found '='"}},
+	{"compile error", map[string]string{
+		"main.run": "import a",
+		"a.run":    "export x",
+	}, []string{"a.run:1:1: undefined variable x"}},
+	{"name clash", map[string]string{
+		"main.run": "let a = 1\nimport a",
+		"a.run":    "",
+	}, []string{"main.run:2:1: a is already declared"}},
+}
+
+func TestLoadErrors(t *testing.T) {
+	for _, test := range loadErrorTests {
+		dir := writeFiles(t, test.files)
+		_, errs := Load(filepath.Join(dir, "main.run"), nil)
+
+		found := make([]string, len(errs))
+		for i, err := range errs {
+			found[i] = strings.TrimPrefix(err.Error(), dir+string(filepath.Separator))
+		}
+		if strings.Join(found, "\n") != strings.Join(test.errors, "\n") {
+			t.Errorf("%s: errors %q, want %q", test.name, found, test.errors)
+		}
+	}
+}
+
+func TestUnexported(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"main.run":  "import maths\nmaths.hidden()",
+		"maths.run": maths,
+	})
+	_, err := runFile(t, dir)
+	if rerr, ok := err.(*vm.RuntimeError); !ok || rerr.Message != "module maths does not export hidden" {
+		t.Errorf("returned %v, expected a ValueError for hidden", err)
+	}
+}
+
+// Links may not be used to import modules from
+// outside of the directory of the importing file
+func TestImportOutside(t *testing.T) {
+	outside := writeFiles(t, map[string]string{"secret.run": "export x\nlet x = 1"})
+	dir := writeFiles(t, map[string]string{"main.run": "import secret"})
+	if err := os.Symlink(filepath.Join(outside, "secret.run"), filepath.Join(dir, "secret.run")); err != nil {
+		t.Skip(err)
+	}
+
+	_, errs := Load(filepath.Join(dir, "main.run"), nil)
+	if len(errs) != 1 || !strings.HasSuffix(errs[0].Error(), "cannot import module secret from outside of the directory of the importing file") {
+		t.Errorf("errors %v, want one for importing secret", errs)
+	}
+}
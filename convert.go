@@ -0,0 +1,415 @@
+package run
+
+import (
+	"fmt"
+	"math"
+	"reflect"
+	"sort"
+
+	"github.com/chickencoder/run/vm"
+)
+
+// ToValue converts a Go value into a Run value. Numbers of any
+// type become numbers, slices and arrays become lists, and maps
+// and structs become maps. Struct fields are named as they are
+// declared, or by a run tag such as `run:"name"`, and fields
+// tagged `run:"-"` or not exported are left out. A vm.Value is
+// passed as it is. Values which refer to themselves, such as a
+// map holding itself, cannot be converted
+func ToValue(x interface{}) (vm.Value, error) {
+	switch x := x.(type) {
+	case nil:
+		return vm.Nil, nil
+	case vm.Value:
+		return x, nil
+	}
+	return toValue(reflect.ValueOf(x), map[reference]bool{})
+}
+
+// reference identifies a pointer, map or slice being converted.
+// Slices of different lengths may share an address
+type reference struct {
+	ptr    uintptr
+	typ    reflect.Type
+	length int
+}
+
+// toValue converts a Go value, returning an error rather than
+// recursing forever if it refers to a value being converted
+func toValue(v reflect.Value, path map[reference]bool) (vm.Value, error) {
+	switch v.Kind() {
+	case reflect.Ptr, reflect.Map, reflect.Slice:
+		if !v.IsNil() {
+			ref := reference{v.Pointer(), v.Type(), 0}
+			if v.Kind() == reflect.Slice {
+				ref.length = v.Len()
+			}
+			if path[ref] {
+				return vm.Nil, fmt.Errorf("cannot convert %s to a Run value as it refers to itself", v.Type())
+			}
+			path[ref] = true
+			defer delete(path, ref)
+		}
+	}
+
+	switch v.Kind() {
+	case reflect.Bool:
+		return vm.Value{Kind: vm.BoolValue, Content: v.Bool()}, nil
+
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return vm.Value{Kind: vm.NumberValue, Content: float64(v.Int())}, nil
+
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return vm.Value{Kind: vm.NumberValue, Content: float64(v.Uint())}, nil
+
+	case reflect.Float32, reflect.Float64:
+		return vm.Value{Kind: vm.NumberValue, Content: v.Float()}, nil
+
+	case reflect.String:
+		return vm.Value{Kind: vm.StringValue, Content: v.String()}, nil
+
+	case reflect.Slice, reflect.Array:
+		items := make([]vm.Value, v.Len())
+		for i := range items {
+			item, err := toValue(v.Index(i), path)
+			if err != nil {
+				return vm.Nil, err
+			}
+			items[i] = item
+		}
+		return vm.NewList(items), nil
+
+	case reflect.Map:
+		return mapToValue(v, path)
+
+	case reflect.Struct:
+		if item, ok := v.Interface().(vm.Value); ok {
+			return item, nil
+		}
+		return structToValue(v, path)
+
+	case reflect.Ptr, reflect.Interface:
+		if v.IsNil() {
+			return vm.Nil, nil
+		}
+		return toValue(v.Elem(), path)
+	}
+	return vm.Nil, fmt.Errorf("cannot convert %s to a Run value", v.Type())
+}
+
+// mapToValue converts a Go map, whose keys must be strings or
+// numbers, into a map with its keys in order
+func mapToValue(v reflect.Value, path map[reference]bool) (vm.Value, error) {
+	keys := make([]vm.Value, 0, v.Len())
+	items := make(map[vm.Value]vm.Value, v.Len())
+	for _, k := range v.MapKeys() {
+		key, err := toValue(k, path)
+		if err != nil {
+			return vm.Nil, err
+		}
+		if key.Kind != vm.StringValue && key.Kind != vm.NumberValue {
+			return vm.Nil, fmt.Errorf("cannot convert %s to a Run value as its keys are not strings or numbers", v.Type())
+		}
+
+		item, err := toValue(v.MapIndex(k), path)
+		if err != nil {
+			return vm.Nil, err
+		}
+		keys = append(keys, key)
+		items[key] = item
+	}
+
+	// Numbers come before strings, as Go maps have no order
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].Kind != keys[j].Kind {
+			return keys[i].Kind == vm.NumberValue
+		}
+		if keys[i].Kind == vm.NumberValue {
+			return keys[i].Content.(float64) < keys[j].Content.(float64)
+		}
+		return keys[i].Content.(string) < keys[j].Content.(string)
+	})
+
+	m := vm.NewMap()
+	for _, key := range keys {
+		m.Content.(*vm.Map).Set(key, items[key])
+	}
+	return m, nil
+}
+
+// structToValue converts the exported fields of a struct into a map
+func structToValue(v reflect.Value, path map[reference]bool) (vm.Value, error) {
+	m := vm.NewMap()
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		name, ok := fieldName(t.Field(i))
+		if !ok {
+			continue
+		}
+
+		item, err := toValue(v.Field(i), path)
+		if err != nil {
+			return vm.Nil, err
+		}
+		m.Content.(*vm.Map).Set(vm.Value{Kind: vm.StringValue, Content: name}, item)
+	}
+	return m, nil
+}
+
+// fieldName returns the name of a struct field in Run,
+// or false if the field is not converted
+func fieldName(field reflect.StructField) (string, bool) {
+	if field.PkgPath != "" {
+		return "", false
+	}
+
+	switch tag := field.Tag.Get("run"); tag {
+	case "-":
+		return "", false
+	case "":
+		return field.Name, true
+	default:
+		return tag, true
+	}
+}
+
+// FromValue converts a Run value into a Go value. Numbers become
+// float64s, lists become []interface{}, and maps become either
+// map[string]interface{}, if every key is a string, or otherwise
+// map[interface{}]interface{}. Instances become maps of their
+// fields. Functions, entities, modules and iterators are returned
+// as the vm.Value itself, so that they may be passed back
+func FromValue(v vm.Value) interface{} {
+	return fromValue(v, map[interface{}]interface{}{})
+}
+
+// fromValue converts a value, reusing the conversion of any
+// list, map or instance already seen so that cycles terminate
+func fromValue(v vm.Value, seen map[interface{}]interface{}) interface{} {
+	switch v.Kind {
+	case vm.NilValue:
+		return nil
+
+	case vm.NumberValue, vm.StringValue, vm.BoolValue:
+		return v.Content
+
+	case vm.ListValue:
+		list := v.Content.(*vm.List)
+		if items, ok := seen[list]; ok {
+			return items
+		}
+
+		items := make([]interface{}, len(list.Items))
+		seen[list] = items
+		for i, item := range list.Items {
+			items[i] = fromValue(item, seen)
+		}
+		return items
+
+	case vm.MapValue:
+		m := v.Content.(*vm.Map)
+		if items, ok := seen[m]; ok {
+			return items
+		}
+
+		strings := true
+		for _, key := range m.Keys() {
+			strings = strings && key.Kind == vm.StringValue
+		}
+
+		if strings {
+			items := make(map[string]interface{}, m.Len())
+			seen[m] = items
+			for _, key := range m.Keys() {
+				item, _ := m.Get(key)
+				items[key.Content.(string)] = fromValue(item, seen)
+			}
+			return items
+		}
+
+		items := make(map[interface{}]interface{}, m.Len())
+		seen[m] = items
+		for _, key := range m.Keys() {
+			item, _ := m.Get(key)
+			items[key.Content] = fromValue(item, seen)
+		}
+		return items
+
+	case vm.InstanceValue:
+		instance := v.Content.(*vm.Instance)
+		if fields, ok := seen[instance]; ok {
+			return fields
+		}
+
+		fields := make(map[string]interface{}, len(instance.Fields))
+		seen[instance] = fields
+		for i, item := range instance.Fields {
+			fields[instance.Entity.Fields[i]] = fromValue(item, seen)
+		}
+		return fields
+	}
+	return v
+}
+
+// Decode converts a value returned by an Interpreter into the Go
+// value target points to, such as a struct whose fields are named
+// as in ToValue. Maps and instances decode into structs, and lists
+// into slices and arrays
+func Decode(value interface{}, target interface{}) error {
+	t := reflect.ValueOf(target)
+	if t.Kind() != reflect.Ptr || t.IsNil() {
+		return fmt.Errorf("cannot decode into %T, which is not a pointer", target)
+	}
+
+	v, err := ToValue(value)
+	if err != nil {
+		return err
+	}
+	return decode(v, t.Elem())
+}
+
+func decode(v vm.Value, t reflect.Value) error {
+	if t.Kind() == reflect.Interface && t.NumMethod() == 0 {
+		if item := FromValue(v); item != nil {
+			t.Set(reflect.ValueOf(item))
+		} else {
+			t.Set(reflect.Zero(t.Type()))
+		}
+		return nil
+	}
+
+	if v.Kind == vm.NilValue {
+		t.Set(reflect.Zero(t.Type()))
+		return nil
+	}
+
+	mismatch := fmt.Errorf("cannot decode %s value into %s", vm.ValueKinds[v.Kind], t.Type())
+	switch t.Kind() {
+	case reflect.Bool:
+		if v.Kind != vm.BoolValue {
+			return mismatch
+		}
+		t.SetBool(v.Content.(bool))
+
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		if v.Kind != vm.NumberValue {
+			return mismatch
+		}
+		f := v.Content.(float64)
+		if f != math.Trunc(f) || t.OverflowInt(int64(f)) {
+			return fmt.Errorf("cannot decode %v into %s", f, t.Type())
+		}
+		t.SetInt(int64(f))
+
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		if v.Kind != vm.NumberValue {
+			return mismatch
+		}
+		f := v.Content.(float64)
+		if f != math.Trunc(f) || f < 0 || t.OverflowUint(uint64(f)) {
+			return fmt.Errorf("cannot decode %v into %s", f, t.Type())
+		}
+		t.SetUint(uint64(f))
+
+	case reflect.Float32, reflect.Float64:
+		if v.Kind != vm.NumberValue {
+			return mismatch
+		}
+		t.SetFloat(v.Content.(float64))
+
+	case reflect.String:
+		if v.Kind != vm.StringValue {
+			return mismatch
+		}
+		t.SetString(v.Content.(string))
+
+	case reflect.Slice, reflect.Array:
+		if v.Kind != vm.ListValue {
+			return mismatch
+		}
+		items := v.Content.(*vm.List).Items
+		if t.Kind() == reflect.Array && len(items) != t.Len() {
+			return fmt.Errorf("cannot decode list of %d items into %s", len(items), t.Type())
+		}
+		if t.Kind() == reflect.Slice {
+			t.Set(reflect.MakeSlice(t.Type(), len(items), len(items)))
+		}
+		for i, item := range items {
+			if err := decode(item, t.Index(i)); err != nil {
+				return err
+			}
+		}
+
+	case reflect.Map:
+		keys, items, ok := entries(v)
+		if !ok {
+			return mismatch
+		}
+		t.Set(reflect.MakeMapWithSize(t.Type(), len(keys)))
+		for n, key := range keys {
+			k := reflect.New(t.Type().Key()).Elem()
+			if err := decode(key, k); err != nil {
+				return err
+			}
+			item := reflect.New(t.Type().Elem()).Elem()
+			if err := decode(items[n], item); err != nil {
+				return err
+			}
+			t.SetMapIndex(k, item)
+		}
+
+	case reflect.Struct:
+		keys, items, ok := entries(v)
+		if !ok {
+			return mismatch
+		}
+		fields := map[string]int{}
+		for i := 0; i < t.NumField(); i++ {
+			if name, ok := fieldName(t.Type().Field(i)); ok {
+				fields[name] = i
+			}
+		}
+		for n, key := range keys {
+			if i, ok := fields[fmt.Sprint(key.Content)]; ok {
+				if err := decode(items[n], t.Field(i)); err != nil {
+					return err
+				}
+			}
+		}
+
+	case reflect.Ptr:
+		item := reflect.New(t.Type().Elem())
+		if err := decode(v, item.Elem()); err != nil {
+			return err
+		}
+		t.Set(item)
+
+	default:
+		return mismatch
+	}
+	return nil
+}
+
+// entries returns the keys and items of a map, or the field
+// names and fields of an instance
+func entries(v vm.Value) ([]vm.Value, []vm.Value, bool) {
+	switch v.Kind {
+	case vm.MapValue:
+		m := v.Content.(*vm.Map)
+		keys := m.Keys()
+		items := make([]vm.Value, len(keys))
+		for i, key := range keys {
+			items[i], _ = m.Get(key)
+		}
+		return keys, items, true
+
+	case vm.InstanceValue:
+		instance := v.Content.(*vm.Instance)
+		keys := make([]vm.Value, len(instance.Fields))
+		for i, name := range instance.Entity.Fields {
+			keys[i] = vm.Value{Kind: vm.StringValue, Content: name}
+		}
+		return keys, instance.Fields, true
+	}
+	return nil, nil, false
+}
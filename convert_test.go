@@ -0,0 +1,53 @@
+package run
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/chickencoder/run/vm"
+)
+
+type node struct {
+	Name string
+	Next *node
+}
+
+func TestToValueCycles(t *testing.T) {
+	n := &node{Name: "loop"}
+	n.Next = n
+
+	m := map[string]interface{}{}
+	m["self"] = m
+
+	s := []interface{}{1, nil}
+	s[1] = s
+
+	for _, x := range []interface{}{n, m, s} {
+		if _, err := ToValue(x); err == nil || !strings.Contains(err.Error(), "refers to itself") {
+			t.Errorf("converting %T returned %v, expected an error", x, err)
+		}
+	}
+}
+
+func TestToValueShared(t *testing.T) {
+	shared := &node{Name: "shared"}
+	pair := []*node{shared, shared}
+
+	v, err := ToValue(pair)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if items := v.Content.(*vm.List).Items; len(items) != 2 {
+		t.Errorf("converted %d items, expected 2", len(items))
+	}
+}
+
+func TestDecodeCycle(t *testing.T) {
+	m := vm.NewMap()
+	m.Content.(*vm.Map).Set(vm.Value{Kind: vm.StringValue, Content: "self"}, m)
+
+	var x map[string]interface{}
+	if err := Decode(FromValue(m), &x); err == nil {
+		t.Error("decoding a map holding itself returned no error")
+	}
+}
@@ -0,0 +1,272 @@
+// Package run embeds the Run language in Go programs. An
+// Interpreter loads a program, runs its top level and then
+// calls its functions, converting Go values to Run values
+// and back as they are passed in and out
+package run
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/chickencoder/run/compiler"
+	"github.com/chickencoder/run/stdlib"
+	"github.com/chickencoder/run/vm"
+)
+
+// Version of the Run language and its tools
+const Version = "0.1.0"
+
+// LoadError holds the errors found compiling a program
+type LoadError struct {
+	Errors []compiler.Error
+}
+
+func (e *LoadError) Error() string {
+	messages := make([]string, len(e.Errors))
+	for i, err := range e.Errors {
+		messages[i] = err.Error()
+	}
+	return strings.Join(messages, "\n")
+}
+
+// Interpreter runs a Run program on behalf of a Go host. The
+// host registers natives and sets globals, loads a program,
+// which runs its top level, and may then call its functions
+// any number of times. An Interpreter is not safe for use by
+// several goroutines at once
+type Interpreter struct {
+	StackSize int           // Fixed size of the stack of each program loaded
+	Budget    int           // Maximum number of instructions run by each load or call, 0 for no limit
+	Timeout   time.Duration // Maximum duration of each load or call, 0 for no limit
+	Limits    vm.Limits     // Memory each load or call may use
+
+	// Capabilities granted to the standard library, none by default
+	Capabilities stdlib.Capabilities
+
+	natives  *vm.Natives
+	names    []string            // Globals declared by the host, in order
+	globals  map[string]vm.Value // Values of the globals declared by the host
+	out      io.Writer
+	compiler *compiler.Compiler // Compiler of the program loaded last, nil if none
+	runner   *vm.Runner
+}
+
+// New returns an Interpreter with no program loaded. Its
+// programs may call the natives of the standard library, which
+// are denied anything not granted by its Capabilities
+func New() *Interpreter {
+	i := &Interpreter{
+		StackSize: 1024,
+		natives:   vm.NewNatives(),
+		globals:   map[string]vm.Value{},
+		out:       os.Stdout,
+	}
+	stdlib.Register(i.natives, &i.Capabilities)
+	return i
+}
+
+// Register adds a native function which programs loaded
+// afterwards may call by name, expecting arity arguments
+// or any number if arity is -1. It replaces any native of
+// the standard library of the same name
+func (i *Interpreter) Register(name string, arity int, fn vm.NativeFunction) {
+	i.natives.Register(name, arity, fn)
+}
+
+// RegisterContext adds a native function as Register does,
+// which is passed a context that is done once the load or
+// call running it is cancelled or exceeds its Timeout
+func (i *Interpreter) RegisterContext(name string, arity int, fn vm.NativeContextFunction) {
+	i.natives.RegisterContext(name, arity, fn)
+}
+
+// SetOutput directs the output of programs, which is written
+// to stdout by default
+func (i *Interpreter) SetOutput(w io.Writer) {
+	i.out = w
+	if i.runner != nil {
+		i.runner.SetOutput(w)
+	}
+}
+
+// LoadFile compiles the program at path along with the modules
+// it imports and runs its top level, replacing any program loaded
+// before. Compile errors are returned as a *LoadError
+func (i *Interpreter) LoadFile(path string) error {
+	return i.LoadFileContext(context.Background(), path)
+}
+
+// LoadFileContext loads a program as LoadFile does, stopping
+// its top level once ctx is cancelled or expires
+func (i *Interpreter) LoadFileContext(ctx context.Context, path string) error {
+	return i.load(ctx, func(c *compiler.Compiler) []compiler.Error {
+		return c.Load(path)
+	})
+}
+
+// LoadString compiles and runs a program as LoadFile does.
+// Modules it imports are found in the working directory
+func (i *Interpreter) LoadString(source string) error {
+	return i.LoadStringContext(context.Background(), source)
+}
+
+// LoadStringContext loads a program as LoadString does, stopping
+// its top level once ctx is cancelled or expires
+func (i *Interpreter) LoadStringContext(ctx context.Context, source string) error {
+	return i.load(ctx, func(c *compiler.Compiler) []compiler.Error {
+		return c.LoadSource(filepath.Join(".", "<string>"), source)
+	})
+}
+
+func (i *Interpreter) load(ctx context.Context, compile func(c *compiler.Compiler) []compiler.Error) error {
+	c := compiler.NewCompiler()
+	c.SetNatives(i.natives)
+	for _, name := range i.names {
+		c.Declare(name)
+	}
+
+	if errs := compile(c); len(errs) > 0 {
+		return &LoadError{Errors: errs}
+	}
+
+	program := c.Code()
+	main, err := vm.Entry(program, "")
+	if err != nil {
+		return err
+	}
+
+	runner := vm.NewRunner(program, i.StackSize, main, false)
+	runner.SetNatives(i.natives)
+	runner.SetOutput(i.out)
+	runner.SetBudget(i.Budget)
+	runner.SetTimeout(i.Timeout)
+	runner.SetLimits(i.Limits)
+	runner.SetGlobal(compiler.ArgsGlobal, vm.NewList(nil))
+	for _, name := range i.names {
+		runner.SetGlobal(c.Declare(name), i.globals[name])
+	}
+
+	if err := runner.RunContext(ctx); err != nil {
+		return err
+	}
+	i.compiler, i.runner = c, runner
+	return nil
+}
+
+// Call calls a function of the loaded program, converting its
+// arguments with ToValue and its result with FromValue. The name
+// is that of a top level function or of a global holding one,
+// and may select the export of a module or the method of an
+// instance, such as maths.pow
+func (i *Interpreter) Call(name string, args ...interface{}) (interface{}, error) {
+	return i.CallContext(context.Background(), name, args...)
+}
+
+// CallContext calls a function as Call does, stopping
+// once ctx is cancelled or expires
+func (i *Interpreter) CallContext(ctx context.Context, name string, args ...interface{}) (interface{}, error) {
+	if i.runner == nil {
+		return nil, errors.New("no program loaded")
+	}
+
+	fn, err := i.lookup(name)
+	if err != nil {
+		return nil, err
+	}
+
+	values := make([]vm.Value, len(args))
+	for n, arg := range args {
+		if values[n], err = ToValue(arg); err != nil {
+			return nil, fmt.Errorf("argument %d of %s: %s", n+1, name, err)
+		}
+	}
+
+	i.runner.SetBudget(i.Budget)
+	i.runner.SetTimeout(i.Timeout)
+	i.runner.SetLimits(i.Limits)
+	result, err := i.runner.CallContext(ctx, fn, values)
+	if err != nil {
+		return nil, err
+	}
+	return FromValue(result), nil
+}
+
+// lookup finds the value named by a call, following each
+// field of a dotted name
+func (i *Interpreter) lookup(name string) (vm.Value, error) {
+	parts := strings.Split(name, ".")
+
+	var item vm.Value
+	if address, arity, ok := i.compiler.Function(parts[0]); ok {
+		item = vm.NewClosure(parts[0], address, arity)
+	} else if slot, _, ok := i.compiler.Global(parts[0]); ok {
+		item = i.runner.Global(slot)
+	} else {
+		return vm.Nil, fmt.Errorf("undefined function %s", parts[0])
+	}
+
+	for _, field := range parts[1:] {
+		var err error
+		switch item.Kind {
+		case vm.ModuleValue:
+			item, err = item.Content.(*vm.Module).Get(field)
+		case vm.InstanceValue:
+			item, err = item.Content.(*vm.Instance).Get(field)
+		default:
+			err = fmt.Errorf("cannot get field %s of %s value", field, vm.ValueKinds[item.Kind])
+		}
+		if err != nil {
+			return vm.Nil, err
+		}
+	}
+	return item, nil
+}
+
+// SetGlobal sets a global of the loaded program. A global which
+// the program does not declare is instead declared on behalf of
+// the host, and is visible to every program loaded afterwards
+func (i *Interpreter) SetGlobal(name string, value interface{}) error {
+	item, err := ToValue(value)
+	if err != nil {
+		return fmt.Errorf("global %s: %s", name, err)
+	}
+
+	if i.compiler != nil {
+		if slot, constant, ok := i.compiler.Global(name); ok {
+			if constant {
+				return fmt.Errorf("cannot set constant global %s", name)
+			}
+			i.runner.SetGlobal(slot, item)
+			if _, host := i.globals[name]; host {
+				i.globals[name] = item
+			}
+			return nil
+		}
+	}
+
+	if _, ok := i.globals[name]; !ok {
+		i.names = append(i.names, name)
+	}
+	i.globals[name] = item
+	return nil
+}
+
+// GetGlobal returns a global of the loaded program, or one
+// set by the host, converted with FromValue
+func (i *Interpreter) GetGlobal(name string) (interface{}, error) {
+	if i.compiler != nil {
+		if slot, _, ok := i.compiler.Global(name); ok {
+			return FromValue(i.runner.Global(slot)), nil
+		}
+	}
+	if item, ok := i.globals[name]; ok {
+		return FromValue(item), nil
+	}
+	return nil, fmt.Errorf("undefined global %s", name)
+}
@@ -0,0 +1,219 @@
+package run
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/chickencoder/run/vm"
+)
+
+// load returns an Interpreter with source loaded,
+// along with the buffer holding its output
+func load(t *testing.T, i *Interpreter, source string) *bytes.Buffer {
+	t.Helper()
+	var out bytes.Buffer
+	i.SetOutput(&out)
+	if err := i.LoadString(source); err != nil {
+		t.Fatal(err)
+	}
+	return &out
+}
+
+func TestCallRepeatedly(t *testing.T) {
+	i := New()
+	i.StackSize = 64
+	out := load(t, i, `
+let total = 0
+fun add(n) {
+	total = total + n
+	return total
+}
+print("loaded")
+`)
+
+	// Each call leaves the stack as it found it,
+	// so a small stack survives any number of them
+	for n := 1; n <= 1000; n++ {
+		result, err := i.Call("add", 1)
+		if err != nil {
+			t.Fatalf("call %d: %v", n, err)
+		}
+		if result != float64(n) {
+			t.Fatalf("call %d returned %v", n, result)
+		}
+	}
+	if total, _ := i.GetGlobal("total"); total != float64(1000) {
+		t.Errorf("total is %v, expected 1000", total)
+	}
+	if out.String() != "loaded\n" {
+		t.Errorf("printed %q, expected the top level to run once", out)
+	}
+}
+
+func TestCallValues(t *testing.T) {
+	i := New()
+	load(t, i, `
+entity Point { x, y }
+Point fun sum() { return self.x + self.y }
+let origin = Point(1, 2)
+let double = fun(n) { return n * 2 }
+fun pair(a, b) { return [a, b] }
+`)
+
+	tests := []struct {
+		name string
+		args []interface{}
+		want interface{}
+	}{
+		{"pair", []interface{}{"a", true}, []interface{}{"a", true}},
+		{"pair", []interface{}{nil, map[string]interface{}{"k": 1}}, []interface{}{nil, map[string]interface{}{"k": float64(1)}}},
+		{"double", []interface{}{21}, float64(42)},
+		{"origin.sum", nil, float64(3)},
+	}
+	for _, test := range tests {
+		result, err := i.Call(test.name, test.args...)
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+		} else if !reflect.DeepEqual(result, test.want) {
+			t.Errorf("%s returned %#v, expected %#v", test.name, result, test.want)
+		}
+	}
+}
+
+func TestCallErrors(t *testing.T) {
+	i := New()
+	if _, err := i.Call("f"); err == nil || err.Error() != "no program loaded" {
+		t.Errorf("calling before loading returned %v", err)
+	}
+
+	load(t, i, "fun f(a) { return a.b }\nlet n = 1\nentity E { x }\nlet e = E(1)\nfun g() { return e.x }")
+	tests := []struct {
+		name    string
+		args    []interface{}
+		message string
+	}{
+		{"missing", nil, "undefined function missing"},
+		{"f.x", nil, "cannot get field x of function value"},
+		{"e.y", nil, "E has no field or method y"},
+		{"f", []interface{}{make(chan int)}, "argument 1 of f: cannot convert chan int"},
+		{"f", nil, "ValueError: f expects 1 arguments, found 0"},
+		{"f", []interface{}{1}, "ValueError: cannot get field of number value"},
+		{"n", nil, "ValueError: cannot call number value"},
+	}
+	for _, test := range tests {
+		_, err := i.Call(test.name, test.args...)
+		if err == nil || !strings.HasPrefix(err.Error(), test.message) {
+			t.Errorf("%s: returned %v, expected %s", test.name, err, test.message)
+		}
+	}
+
+	// Calls still work after those which failed
+	if result, err := i.Call("g"); err != nil || result != float64(1) {
+		t.Errorf("returned %v, %v after failed calls", result, err)
+	}
+}
+
+func TestHostGlobals(t *testing.T) {
+	i := New()
+	if err := i.SetGlobal("limit", 3); err != nil {
+		t.Fatal(err)
+	}
+	if limit, err := i.GetGlobal("limit"); err != nil || limit != float64(3) {
+		t.Errorf("limit is %v, %v before loading", limit, err)
+	}
+
+	load(t, i, "let doubled = limit * 2\nfun get() { return limit }\nset fixed = 1")
+	if doubled, err := i.GetGlobal("doubled"); err != nil || doubled != float64(6) {
+		t.Errorf("doubled is %v, %v, expected 6", doubled, err)
+	}
+
+	// Setting a global after loading is seen by the program
+	if err := i.SetGlobal("limit", 10); err != nil {
+		t.Fatal(err)
+	}
+	if limit, err := i.Call("get"); err != nil || limit != float64(10) {
+		t.Errorf("get returned %v, %v, expected 10", limit, err)
+	}
+	if err := i.SetGlobal("doubled", []interface{}{1}); err != nil {
+		t.Fatal(err)
+	}
+	if doubled, _ := i.GetGlobal("doubled"); !reflect.DeepEqual(doubled, []interface{}{float64(1)}) {
+		t.Errorf("doubled is %v, expected [1]", doubled)
+	}
+
+	if err := i.SetGlobal("fixed", 2); err == nil {
+		t.Error("set a constant global")
+	}
+	if _, err := i.GetGlobal("missing"); err == nil {
+		t.Error("got an undefined global")
+	}
+
+	// Globals of the host are declared for later programs,
+	// whereas those of the program are not
+	load(t, i, "let seen = limit")
+	if seen, _ := i.GetGlobal("seen"); seen != float64(10) {
+		t.Errorf("seen is %v, expected 10", seen)
+	}
+	if _, err := i.GetGlobal("doubled"); err == nil {
+		t.Error("got a global of the program loaded before")
+	}
+}
+
+func TestRegister(t *testing.T) {
+	i := New()
+	var received []vm.Value
+	i.Register("record", -1, func(args []vm.Value) (vm.Value, error) {
+		received = args
+		return vm.NewList(args), nil
+	})
+	i.Register("print", 1, func(args []vm.Value) (vm.Value, error) {
+		received = append(received, args[0])
+		return vm.Nil, nil
+	})
+
+	out := load(t, i, "fun f(a, b, c, d) { return record(a, b, c, d) }\nprint(\"replaced\")")
+	if out.String() != "" || len(received) != 1 || received[0].String() != "replaced" {
+		t.Errorf("print was not replaced, printing %q", out)
+	}
+
+	result, err := i.Call("f", "s", 2, []int{1, 2}, map[string]bool{"k": true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	kinds := make([]vm.ValueKind, len(received))
+	for n, arg := range received {
+		kinds[n] = arg.Kind
+	}
+	want := []vm.ValueKind{vm.StringValue, vm.NumberValue, vm.ListValue, vm.MapValue}
+	if !reflect.DeepEqual(kinds, want) {
+		t.Errorf("record received %v, expected %v", received, want)
+	}
+	if !reflect.DeepEqual(result, []interface{}{"s", float64(2), []interface{}{float64(1), float64(2)}, map[string]interface{}{"k": true}}) {
+		t.Errorf("f returned %#v", result)
+	}
+
+	// Natives are only compiled into programs loaded after
+	// they are registered
+	if err := New().LoadString("record(1)"); err == nil {
+		t.Error("called a native registered with another interpreter")
+	}
+}
+
+func TestLoadErrors(t *testing.T) {
+	i := New()
+	err := i.LoadString("print(x)\nlet = 1")
+	lerr, ok := err.(*LoadError)
+	if !ok || len(lerr.Errors) != 1 || !strings.HasSuffix(lerr.Error(), "2:5: expected variable name, found '='") {
+		t.Fatalf("returned %v, expected a LoadError for the syntax error", err)
+	}
+
+	load(t, i, "fun f() { return 1 }")
+	if err := i.LoadString("fun g() { return y }"); err == nil {
+		t.Fatal("loaded a program which does not compile")
+	}
+	if result, err := i.Call("f"); err != nil || result != float64(1) {
+		t.Errorf("f returned %v, %v after a failed load, expected the program to remain", result, err)
+	}
+}
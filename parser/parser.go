@@ -1,7 +1,654 @@
 package parser
 
-import "fmt"
+import (
+	"fmt"
+	"strconv"
 
-func main() {
-	fmt.Println("vim-go")
+	"github.com/chickencoder/run/ast"
+	"github.com/chickencoder/run/scanner"
+)
+
+// Error is a syntax error found by the Parser
+type Error struct {
+	Line    int
+	Column  int
+	Message string
+}
+
+func (e Error) Error() string {
+	return fmt.Sprintf("%d:%d: %s", e.Line, e.Column, e.Message)
+}
+
+// Parser builds a syntax tree from the tokens of a source file
+// by recursive descent. After a syntax error the parser skips to
+// the start of the next statement so that every error in the
+// file can be reported at once
+type Parser struct {
+	tokens   []scanner.Token
+	current  int
+	depth    int // Number of enclosing blocks
+	unclosed int // Braces left open by abandoned statements
+	Errors   []Error
+}
+
+// bailout abandons the statement being parsed after an error
+type bailout struct{}
+
+// NewParser returns a Parser over tokens, which must end with EOF
+func NewParser(tokens []scanner.Token) *Parser {
+	return &Parser{tokens: tokens}
+}
+
+// Parse parses a source file, returning the program along
+// with every lexical and syntax error found
+func Parse(source string) (*ast.Program, []Error) {
+	tokens, _ := scanner.Tokenize(source)
+	p := NewParser(tokens)
+	program := p.Program()
+	return program, p.Errors
+}
+
+// Program parses statements until the end of the file
+func (p *Parser) Program() *ast.Program {
+	program := &ast.Program{}
+	for !p.check(scanner.EOF) {
+		if p.closesAbandoned() {
+			continue
+		}
+		if stmt := p.statement(); stmt != nil {
+			program.Stmts = append(program.Stmts, stmt)
+		}
+	}
+	return program
+}
+
+// Token handling
+
+// peek returns the current token, reporting and
+// skipping over any lexical errors
+func (p *Parser) peek() scanner.Token {
+	for p.tokens[p.current].Type == scanner.ErrorToken {
+		tok := p.tokens[p.current]
+		p.errorAt(tok, "%s", tok.Value)
+		p.current++
+	}
+	return p.tokens[p.current]
+}
+
+// peekAt returns the token n tokens ahead of the current token
+func (p *Parser) peekAt(n int) scanner.Token {
+	p.peek()
+	if p.current+n < len(p.tokens) {
+		return p.tokens[p.current+n]
+	}
+	return p.tokens[len(p.tokens)-1]
+}
+
+func (p *Parser) advance() scanner.Token {
+	tok := p.peek()
+	if tok.Type != scanner.EOF {
+		p.current++
+	}
+	return tok
+}
+
+func (p *Parser) check(typ scanner.TokenType) bool {
+	return p.peek().Type == typ
+}
+
+// match consumes the current token if it is one of types
+func (p *Parser) match(types ...scanner.TokenType) bool {
+	for _, typ := range types {
+		if p.check(typ) {
+			p.advance()
+			return true
+		}
+	}
+	return false
+}
+
+// expect consumes a token of type typ or fails the statement
+func (p *Parser) expect(typ scanner.TokenType, what string) scanner.Token {
+	if !p.check(typ) {
+		p.fail(p.peek(), "expected %s, found %s", what, describe(p.peek()))
+	}
+	return p.advance()
+}
+
+func (p *Parser) errorAt(tok scanner.Token, format string, args ...interface{}) {
+	p.Errors = append(p.Errors, Error{
+		Line:    tok.Line,
+		Column:  tok.Column,
+		Message: fmt.Sprintf(format, args...),
+	})
+}
+
+// fail reports an error then abandons the current statement. An
+// error on the same line as the previous error is most likely
+// caused by it, so is not reported
+func (p *Parser) fail(tok scanner.Token, format string, args ...interface{}) {
+	if n := len(p.Errors); n == 0 || p.Errors[n-1].Line != tok.Line {
+		p.errorAt(tok, format, args...)
+	}
+	panic(bailout{})
+}
+
+// describe names a token for use in error messages
+func describe(tok scanner.Token) string {
+	switch tok.Type {
+	case scanner.EOF:
+		return "end of file"
+	case scanner.StringToken, scanner.NumberToken, scanner.BooleanToken, scanner.IdentiferToken:
+		return fmt.Sprintf("%s %s", tok.Type, tok)
+	}
+	return fmt.Sprintf("'%s'", tok.Type)
+}
+
+func pos(tok scanner.Token) ast.Pos {
+	return ast.Pos{Line: tok.Line, Column: tok.Column}
+}
+
+// synchronize skips to the start of the next statement or the
+// end of the enclosing block. A statement starts at a keyword, or
+// at the first token of a line outside of the braces opened by the
+// abandoned statement, whose contents are skipped
+func (p *Parser) synchronize(start int) {
+	if p.current == start {
+		p.advance()
+	}
+
+	open := 0
+	for _, tok := range p.tokens[start:p.current] {
+		switch tok.Type {
+		case scanner.LeftBraceToken:
+			open++
+		case scanner.RightBraceToken:
+			if open > 0 {
+				open--
+			}
+		}
+	}
+
+	for {
+		tok := p.peek()
+		switch tok.Type {
+		case scanner.EOF:
+			return
+		case scanner.LetToken, scanner.SetToken, scanner.FunToken, scanner.IfToken,
+			scanner.ForToken, scanner.ReturnToken, scanner.ImportToken,
+			scanner.ExportToken, scanner.EntityToken:
+			p.unclosed += open
+			return
+		case scanner.LeftBraceToken:
+			open++
+		case scanner.RightBraceToken:
+			if open > 0 {
+				open--
+			} else if p.depth > 0 {
+				return
+			}
+		default:
+			if open == 0 && tok.Line > p.tokens[p.current-1].Line {
+				return
+			}
+		}
+		p.advance()
+	}
+}
+
+// closesAbandoned skips a closing brace which matches a
+// brace opened by an abandoned statement
+func (p *Parser) closesAbandoned() bool {
+	if p.unclosed > 0 && p.check(scanner.RightBraceToken) {
+		p.advance()
+		p.unclosed--
+		return true
+	}
+	return false
+}
+
+// Statements
+
+// statement parses a statement, returning nil if
+// it contained a syntax error
+func (p *Parser) statement() (stmt ast.Stmt) {
+	start := p.current
+	defer func() {
+		if r := recover(); r != nil {
+			if _, ok := r.(bailout); !ok {
+				panic(r)
+			}
+			p.synchronize(start)
+			stmt = nil
+		}
+	}()
+
+	switch p.peek().Type {
+	case scanner.LetToken, scanner.SetToken:
+		return p.letStmt()
+	case scanner.IfToken:
+		return p.ifStmt()
+	case scanner.ForToken:
+		return p.forStmt()
+	case scanner.ReturnToken:
+		return p.returnStmt()
+	case scanner.EntityToken:
+		return p.entityStmt()
+	case scanner.ImportToken:
+		return p.importStmt()
+	case scanner.ExportToken:
+		return p.exportStmt()
+	case scanner.FunToken:
+		if p.peekAt(1).Type == scanner.IdentiferToken {
+			return p.funStmt()
+		}
+	case scanner.IdentiferToken:
+		if p.peekAt(1).Type == scanner.FunToken {
+			return p.methodStmt()
+		}
+	}
+	return p.simpleStmt()
+}
+
+func (p *Parser) block() *ast.Block {
+	tok := p.expect(scanner.LeftBraceToken, "'{'")
+	block := &ast.Block{Pos: pos(tok)}
+	p.depth++
+	defer func() { p.depth-- }()
+
+	for !p.check(scanner.EOF) {
+		if p.closesAbandoned() {
+			continue
+		}
+		if p.check(scanner.RightBraceToken) {
+			break
+		}
+		if stmt := p.statement(); stmt != nil {
+			block.Stmts = append(block.Stmts, stmt)
+		}
+	}
+	p.expect(scanner.RightBraceToken, "'}'")
+	return block
+}
+
+func (p *Parser) letStmt() ast.Stmt {
+	tok := p.advance()
+	stmt := &ast.LetStmt{
+		Pos:      pos(tok),
+		Name:     p.expect(scanner.IdentiferToken, "variable name").Value,
+		Constant: tok.Type == scanner.SetToken,
+	}
+
+	if p.match(scanner.EqualToken) {
+		stmt.Value = p.expression()
+	} else if stmt.Constant {
+		p.fail(p.peek(), "expected '=' after set %s, constants must be given a value", stmt.Name)
+	}
+	return stmt
+}
+
+// simpleStmt parses an expression statement or an assignment
+func (p *Parser) simpleStmt() ast.Stmt {
+	tok := p.peek()
+	x := p.expression()
+
+	if p.check(scanner.EqualToken) {
+		eq := p.advance()
+		switch x.(type) {
+		case *ast.Ident, *ast.DotExpr, *ast.IndexExpr:
+		default:
+			p.fail(tok, "cannot assign to this expression")
+		}
+
+		return &ast.AssignStmt{
+			Pos:    pos(eq),
+			Target: x,
+			Value:  p.expression(),
+		}
+	}
+
+	return &ast.ExprStmt{Pos: pos(tok), X: x}
+}
+
+func (p *Parser) ifStmt() ast.Stmt {
+	tok := p.advance()
+	stmt := &ast.IfStmt{
+		Pos:  pos(tok),
+		Cond: p.expression(),
+		Then: p.block(),
+	}
+
+	if p.match(scanner.ElseToken) {
+		if p.check(scanner.IfToken) {
+			stmt.Else = p.ifStmt()
+		} else {
+			stmt.Else = p.block()
+		}
+	}
+	return stmt
+}
+
+// forStmt parses the infinite, conditional and of-iterator
+// forms of the for loop
+func (p *Parser) forStmt() ast.Stmt {
+	tok := p.advance()
+
+	if p.check(scanner.LeftBraceToken) {
+		return &ast.ForStmt{Pos: pos(tok), Body: p.block()}
+	}
+
+	if p.check(scanner.IdentiferToken) && p.peekAt(1).Type == scanner.OfToken {
+		name := p.advance().Value
+		p.advance()
+		return &ast.ForOfStmt{
+			Pos:        pos(tok),
+			Name:       name,
+			Collection: p.expression(),
+			Body:       p.block(),
+		}
+	}
+
+	return &ast.ForStmt{
+		Pos:  pos(tok),
+		Cond: p.expression(),
+		Body: p.block(),
+	}
+}
+
+func (p *Parser) returnStmt() ast.Stmt {
+	tok := p.advance()
+	stmt := &ast.ReturnStmt{Pos: pos(tok)}
+	if p.startsExpression() {
+		stmt.Value = p.expression()
+	}
+	return stmt
+}
+
+func (p *Parser) funStmt() ast.Stmt {
+	tok := p.advance()
+	name := p.advance().Value
+	return &ast.FunStmt{
+		Pos:  pos(tok),
+		Name: name,
+		Fun:  p.function(tok),
+	}
+}
+
+func (p *Parser) methodStmt() ast.Stmt {
+	tok := p.advance()
+	fun := p.advance()
+	name := p.expect(scanner.IdentiferToken, "method name").Value
+	return &ast.MethodStmt{
+		Pos:    pos(tok),
+		Entity: tok.Value,
+		Name:   name,
+		Fun:    p.function(fun),
+	}
+}
+
+func (p *Parser) entityStmt() ast.Stmt {
+	tok := p.advance()
+	stmt := &ast.EntityStmt{
+		Pos:  pos(tok),
+		Name: p.expect(scanner.IdentiferToken, "entity name").Value,
+	}
+
+	p.expect(scanner.LeftBraceToken, "'{'")
+	for !p.check(scanner.RightBraceToken) {
+		field := p.expect(scanner.IdentiferToken, "field name")
+		for _, f := range stmt.Fields {
+			if f == field.Value {
+				p.errorAt(field, "duplicate field %s in entity %s", f, stmt.Name)
+			}
+		}
+		stmt.Fields = append(stmt.Fields, field.Value)
+
+		if !p.match(scanner.CommaToken) {
+			break
+		}
+	}
+	p.expect(scanner.RightBraceToken, "'}'")
+	return stmt
+}
+
+func (p *Parser) importStmt() ast.Stmt {
+	tok := p.advance()
+	name := p.expect(scanner.IdentiferToken, "module name").Value
+	for p.match(scanner.DotToken) {
+		name += "." + p.expect(scanner.IdentiferToken, "module name").Value
+	}
+	return &ast.ImportStmt{
+		Pos:  pos(tok),
+		Name: name,
+	}
+}
+
+func (p *Parser) exportStmt() ast.Stmt {
+	tok := p.advance()
+	stmt := &ast.ExportStmt{Pos: pos(tok)}
+	for {
+		stmt.Names = append(stmt.Names, p.expect(scanner.IdentiferToken, "name to export").Value)
+		if !p.match(scanner.CommaToken) {
+			return stmt
+		}
+	}
+}
+
+// function parses the parameters and body of a function
+// whose fun keyword is tok
+func (p *Parser) function(tok scanner.Token) *ast.FunLit {
+	fun := &ast.FunLit{Pos: pos(tok)}
+
+	p.expect(scanner.LeftParenToken, "'('")
+	for !p.check(scanner.RightParenToken) {
+		param := p.expect(scanner.IdentiferToken, "parameter name")
+		for _, name := range fun.Params {
+			if name == param.Value {
+				p.errorAt(param, "duplicate parameter %s", name)
+			}
+		}
+		fun.Params = append(fun.Params, param.Value)
+
+		if !p.match(scanner.CommaToken) {
+			break
+		}
+	}
+	p.expect(scanner.RightParenToken, "')'")
+
+	fun.Body = p.block()
+	return fun
+}
+
+// Expressions
+
+// startsExpression reports whether the current token
+// may begin an expression
+func (p *Parser) startsExpression() bool {
+	switch p.peek().Type {
+	case scanner.StringToken, scanner.NumberToken, scanner.BooleanToken,
+		scanner.IdentiferToken, scanner.NilToken, scanner.FunToken,
+		scanner.LeftParenToken, scanner.LeftBracketToken, scanner.LeftBraceToken,
+		scanner.BangToken, scanner.MinusToken:
+		return true
+	}
+	return false
+}
+
+func (p *Parser) expression() ast.Expr {
+	return p.or()
+}
+
+// binary parses a left associative chain of operators
+// whose operands are parsed by next
+func (p *Parser) binary(next func() ast.Expr, ops ...scanner.TokenType) ast.Expr {
+	x := next()
+	for {
+		op := p.peek()
+		if !p.match(ops...) {
+			return x
+		}
+		x = &ast.BinaryExpr{
+			Pos:   pos(op),
+			Op:    op.Type,
+			Left:  x,
+			Right: next(),
+		}
+	}
+}
+
+func (p *Parser) or() ast.Expr {
+	return p.binary(p.and, scanner.OrToken)
+}
+
+func (p *Parser) and() ast.Expr {
+	return p.binary(p.equality, scanner.AndToken)
+}
+
+func (p *Parser) equality() ast.Expr {
+	return p.binary(p.comparison, scanner.EqualEqualToken, scanner.BangEqualToken, scanner.IsToken)
+}
+
+func (p *Parser) comparison() ast.Expr {
+	return p.binary(p.term, scanner.LessToken, scanner.LessEqualToken, scanner.GreaterToken, scanner.GreaterEqualToken)
+}
+
+func (p *Parser) term() ast.Expr {
+	return p.binary(p.factor, scanner.PlusToken, scanner.MinusToken)
+}
+
+func (p *Parser) factor() ast.Expr {
+	return p.binary(p.unary, scanner.StarToken, scanner.SlashToken)
+}
+
+func (p *Parser) unary() ast.Expr {
+	op := p.peek()
+	if p.match(scanner.BangToken, scanner.MinusToken) {
+		return &ast.UnaryExpr{
+			Pos: pos(op),
+			Op:  op.Type,
+			X:   p.unary(),
+		}
+	}
+	return p.postfix()
+}
+
+// postfix parses calls, dot access and indexing
+func (p *Parser) postfix() ast.Expr {
+	x := p.primary()
+	for {
+		tok := p.peek()
+		switch {
+		case p.match(scanner.LeftParenToken):
+			call := &ast.CallExpr{Pos: pos(tok), Fun: x}
+			for !p.check(scanner.RightParenToken) {
+				call.Args = append(call.Args, p.expression())
+				if !p.match(scanner.CommaToken) {
+					break
+				}
+			}
+			p.expect(scanner.RightParenToken, "')'")
+			x = call
+		case p.match(scanner.DotToken):
+			x = &ast.DotExpr{
+				Pos:  pos(tok),
+				X:    x,
+				Name: p.expect(scanner.IdentiferToken, "name after '.'").Value,
+			}
+		case p.match(scanner.LeftBracketToken):
+			x = &ast.IndexExpr{
+				Pos:   pos(tok),
+				X:     x,
+				Index: p.expression(),
+			}
+			p.expect(scanner.RightBracketToken, "']'")
+		default:
+			return x
+		}
+	}
+}
+
+func (p *Parser) primary() ast.Expr {
+	tok := p.peek()
+	switch tok.Type {
+	case scanner.NumberToken:
+		p.advance()
+		val, err := strconv.ParseFloat(tok.Value, 64)
+		if err != nil {
+			p.errorAt(tok, "number %s is out of range", tok.Value)
+		}
+		return &ast.NumberLit{Pos: pos(tok), Value: val}
+
+	case scanner.StringToken:
+		p.advance()
+		return &ast.StringLit{Pos: pos(tok), Value: tok.Value}
+
+	case scanner.BooleanToken:
+		p.advance()
+		return &ast.BoolLit{Pos: pos(tok), Value: tok.Value == "true"}
+
+	case scanner.NilToken:
+		p.advance()
+		return &ast.NilLit{Pos: pos(tok)}
+
+	case scanner.IdentiferToken:
+		p.advance()
+		return &ast.Ident{Pos: pos(tok), Name: tok.Value}
+
+	case scanner.FunToken:
+		p.advance()
+		return p.function(tok)
+
+	case scanner.LeftParenToken:
+		p.advance()
+		x := p.expression()
+		p.expect(scanner.RightParenToken, "')'")
+		return x
+
+	case scanner.LeftBracketToken:
+		p.advance()
+		list := &ast.ListLit{Pos: pos(tok)}
+		for !p.check(scanner.RightBracketToken) {
+			list.Items = append(list.Items, p.expression())
+			if !p.match(scanner.CommaToken) {
+				break
+			}
+		}
+		p.expect(scanner.RightBracketToken, "']'")
+		return list
+
+	case scanner.LeftBraceToken:
+		return p.mapLit()
+	}
+
+	p.fail(tok, "expected expression, found %s", describe(tok))
+	return nil
+}
+
+// mapLit parses a map literal, whose keys may be
+// identifiers, strings or numbers
+func (p *Parser) mapLit() ast.Expr {
+	tok := p.advance()
+	m := &ast.MapLit{Pos: pos(tok)}
+
+	for !p.check(scanner.RightBraceToken) {
+		key := p.peek()
+		switch key.Type {
+		case scanner.IdentiferToken:
+			p.advance()
+			m.Keys = append(m.Keys, &ast.StringLit{Pos: pos(key), Value: key.Value})
+		case scanner.StringToken, scanner.NumberToken:
+			m.Keys = append(m.Keys, p.primary())
+		default:
+			p.fail(key, "expected map key, found %s", describe(key))
+		}
+
+		p.expect(scanner.ColonToken, "':'")
+		m.Values = append(m.Values, p.expression())
+
+		if !p.match(scanner.CommaToken) {
+			break
+		}
+	}
+	p.expect(scanner.RightBraceToken, "'}'")
+	return m
 }
@@ -0,0 +1,297 @@
+package parser
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/chickencoder/run/ast"
+)
+
+// sexpr prints a node as an s-expression, leaving out positions
+func sexpr(node ast.Node) string {
+	switch n := node.(type) {
+	case nil:
+		return "_"
+	case *ast.Block:
+		return "{" + stmts(n.Stmts) + "}"
+	case *ast.LetStmt:
+		keyword := "let"
+		if n.Constant {
+			keyword = "set"
+		}
+		if n.Value == nil {
+			return fmt.Sprintf("(%s %s)", keyword, n.Name)
+		}
+		return fmt.Sprintf("(%s %s %s)", keyword, n.Name, sexpr(n.Value))
+	case *ast.AssignStmt:
+		return fmt.Sprintf("(= %s %s)", sexpr(n.Target), sexpr(n.Value))
+	case *ast.ExprStmt:
+		return sexpr(n.X)
+	case *ast.IfStmt:
+		if n.Else == nil {
+			return fmt.Sprintf("(if %s %s)", sexpr(n.Cond), sexpr(n.Then))
+		}
+		return fmt.Sprintf("(if %s %s %s)", sexpr(n.Cond), sexpr(n.Then), sexpr(n.Else))
+	case *ast.ForStmt:
+		if n.Cond == nil {
+			return fmt.Sprintf("(for %s)", sexpr(n.Body))
+		}
+		return fmt.Sprintf("(for %s %s)", sexpr(n.Cond), sexpr(n.Body))
+	case *ast.ForOfStmt:
+		return fmt.Sprintf("(for %s of %s %s)", n.Name, sexpr(n.Collection), sexpr(n.Body))
+	case *ast.FunStmt:
+		return fmt.Sprintf("(fun %s %s)", n.Name, function(n.Fun))
+	case *ast.MethodStmt:
+		return fmt.Sprintf("(fun %s.%s %s)", n.Entity, n.Name, function(n.Fun))
+	case *ast.ReturnStmt:
+		if n.Value == nil {
+			return "(return)"
+		}
+		return fmt.Sprintf("(return %s)", sexpr(n.Value))
+	case *ast.EntityStmt:
+		return fmt.Sprintf("(entity %s %s)", n.Name, strings.Join(n.Fields, " "))
+	case *ast.ImportStmt:
+		return "(import " + n.Name + ")"
+	case *ast.ExportStmt:
+		return "(export " + strings.Join(n.Names, " ") + ")"
+	case *ast.Ident:
+		return n.Name
+	case *ast.NumberLit:
+		return strconv.FormatFloat(n.Value, 'g', -1, 64)
+	case *ast.StringLit:
+		return strconv.Quote(n.Value)
+	case *ast.BoolLit:
+		return strconv.FormatBool(n.Value)
+	case *ast.NilLit:
+		return "nil"
+	case *ast.ListLit:
+		return "[" + exprs(n.Items) + "]"
+	case *ast.MapLit:
+		pairs := make([]string, len(n.Keys))
+		for i := range n.Keys {
+			pairs[i] = sexpr(n.Keys[i]) + ":" + sexpr(n.Values[i])
+		}
+		return "{" + strings.Join(pairs, " ") + "}"
+	case *ast.FunLit:
+		return "(fun " + function(n) + ")"
+	case *ast.UnaryExpr:
+		return fmt.Sprintf("(%s %s)", n.Op, sexpr(n.X))
+	case *ast.BinaryExpr:
+		return fmt.Sprintf("(%s %s %s)", n.Op, sexpr(n.Left), sexpr(n.Right))
+	case *ast.CallExpr:
+		if len(n.Args) == 0 {
+			return "(" + sexpr(n.Fun) + ")"
+		}
+		return "(" + sexpr(n.Fun) + " " + exprs(n.Args) + ")"
+	case *ast.DotExpr:
+		return sexpr(n.X) + "." + n.Name
+	case *ast.IndexExpr:
+		return fmt.Sprintf("%s[%s]", sexpr(n.X), sexpr(n.Index))
+	}
+	return fmt.Sprintf("?%T", node)
+}
+
+func function(fun *ast.FunLit) string {
+	return "(" + strings.Join(fun.Params, " ") + ") " + sexpr(fun.Body)
+}
+
+func stmts(list []ast.Stmt) string {
+	s := make([]string, len(list))
+	for i, stmt := range list {
+		s[i] = sexpr(stmt)
+	}
+	return strings.Join(s, " ")
+}
+
+func exprs(list []ast.Expr) string {
+	s := make([]string, len(list))
+	for i, x := range list {
+		s[i] = sexpr(x)
+	}
+	return strings.Join(s, " ")
+}
+
+// The constructs shown in the readme
+var parseTests = []struct {
+	name   string
+	source string
+	tree   string
+}{
+	{"hello", `print("Hello World")`, `(print "Hello World")`},
+	{"constants", "set pi = 3.141592654\npi = 3.1", "(set pi 3.141592654) (= pi 3.1)"},
+	{"variables", "let tau = 2 * pi\ntau = 6.283185307", "(let tau (* 2 pi)) (= tau 6.283185307)"},
+	{"let without value", "let x", "(let x)"},
+	{"comments", "# Numbers\nlet age = 10.12932 # years", "(let age 10.12932)"},
+	{"list", `let languages = [ "Go", "Python", "Javascript" ]`, `(let languages ["Go" "Python" "Javascript"])`},
+	{"empty list", "let x = []", "(let x [])"},
+	{"map", "let m = { go: message, \"py\": message, 3: nil }", `(let m {"go":message "py":message 3:nil})`},
+	{"empty map", "let m = {}", "(let m {})"},
+	{"if else", "if x < 20 {\n print(1)\n} else {\n print(2)\n}", "(if (< x 20) {(print 1)} {(print 2)})"},
+	{"else if", "if a {} else if b {} else {}", "(if a {} (if b {} {}))"},
+	{"for ever", "for {\n print(\"Forever\")\n}", `(for {(print "Forever")})`},
+	{"for condition", `for name is "Gregory" {}`, `(for (is name "Gregory") {})`},
+	{"for of", "for name of names {\n print(name)\n}", "(for name of names {(print name)})"},
+	{"functions", "fun sayHello() {\n print(\"No.\")\n}", `(fun sayHello () {(print "No.")})`},
+	{"parameters", "fun add(a, b) { return a + b }", "(fun add (a b) {(return (+ a b))})"},
+	{"bare return", "fun f() { return }", "(fun f () {(return)})"},
+	{"anonymous function", "let f = fun(x) { return x }", "(let f (fun (x) {(return x)}))"},
+	{"entity", "entity Circle {\n radius\n}", "(entity Circle radius)"},
+	{"entity fields", "entity Animal { name, legs }", "(entity Animal name legs)"},
+	{"method", "Circle fun calcArea(self) {\n return maths.Pi * maths.pow(self.radius, 2)\n}",
+		"(fun Circle.calcArea (self) {(return (* maths.Pi (maths.pow self.radius 2)))})"},
+	{"import", "import maths\nimport shapes.circle", "(import maths) (import shapes.circle)"},
+	{"export", "export area, Circle", "(export area Circle)"},
+	{"field assignment", "self.radius = 2", "(= self.radius 2)"},
+	{"index assignment", "xs[0] = xs[1]", "(= xs[0] xs[1])"},
+	{"calls", "f()(1)(2, 3)", "(((f) 1) 2 3)"},
+
+	// Precedence and associativity
+	{"arithmetic", "x = 1 + 2 * 3 - 4 / 5", "(= x (- (+ 1 (* 2 3)) (/ 4 5)))"},
+	{"grouping", "x = (1 + 2) * 3", "(= x (* (+ 1 2) 3))"},
+	{"unary", "x = -a * !b", "(= x (* (- a) (! b)))"},
+	{"logic", "x = a or b and c == d", "(= x (or a (and b (== c d))))"},
+	{"comparison", "x = a + 1 <= b != c > d", "(= x (!= (<= (+ a 1) b) (> c d)))"},
+	{"literals", "x = [true, false, nil, \"s\\n\"]", `(= x [true false nil "s\n"])`},
+}
+
+func TestParse(t *testing.T) {
+	for _, test := range parseTests {
+		program, errs := Parse(test.source)
+		if len(errs) > 0 {
+			t.Errorf("%s: unexpected errors %v", test.name, errs)
+			continue
+		}
+		if tree := stmts(program.Stmts); tree != test.tree {
+			t.Errorf("%s: parsed as\n\t%s\nwant\n\t%s", test.name, tree, test.tree)
+		}
+	}
+}
+
+func TestPositions(t *testing.T) {
+	program, _ := Parse("let x = 1\n  x = a + f(b)")
+	assign := program.Stmts[1].(*ast.AssignStmt)
+	binary := assign.Value.(*ast.BinaryExpr)
+	call := binary.Right.(*ast.CallExpr)
+
+	nodes := []struct {
+		node ast.Node
+		want ast.Pos
+	}{
+		{program.Stmts[0], ast.Pos{Line: 1, Column: 1}},
+		{assign, ast.Pos{Line: 2, Column: 5}},
+		{assign.Target, ast.Pos{Line: 2, Column: 3}},
+		{binary, ast.Pos{Line: 2, Column: 9}},
+		{call, ast.Pos{Line: 2, Column: 12}},
+		{call.Args[0], ast.Pos{Line: 2, Column: 13}},
+	}
+	for _, n := range nodes {
+		if pos := n.node.Position(); pos != n.want {
+			t.Errorf("%s at %d:%d, want %d:%d", sexpr(n.node), pos.Line, pos.Column, n.want.Line, n.want.Column)
+		}
+	}
+}
+
+var errorTests = []struct {
+	name   string
+	source string
+	errors []Error
+}{
+	{"missing name", "let = 1", []Error{{1, 5, "expected variable name, found '='"}}},
+	{"set without value", "set y", []Error{{1, 6, "expected '=' after set y, constants must be given a value"}}},
+	{"missing paren", "print(1", []Error{{1, 8, "expected ')', found end of file"}}},
+	{"missing brace", "if x {\n  print(1)\n", []Error{{3, 1, "expected '}', found end of file"}}},
+	{"missing expression", "let x = ", []Error{{1, 9, "expected expression, found end of file"}}},
+	{"bad operand", "x = 1 + }", []Error{{1, 9, "expected expression, found '}'"}}},
+	{"bad target", "x + 1 = 2", []Error{{1, 1, "cannot assign to this expression"}}},
+	{"duplicate field", "entity A { a, a }", []Error{{1, 15, "duplicate field a in entity A"}}},
+	{"duplicate parameter", "fun f(a, a) {}", []Error{{1, 10, "duplicate parameter a"}}},
+	{"bad map key", "let m = { [1]: 2 }", []Error{{1, 11, "expected map key, found '['"}}},
+	{"bad method name", "A fun 1() {}", []Error{{1, 7, "expected method name, found number 1"}}},
+	{"number out of range", "let x = 1e999", []Error{{1, 9, "number 1e999 is out of range"}}},
+	{"unterminated string", `let s = "abc`, []Error{{1, 9, "unterminated string"}}},
+	{"lexical error with verb", "let x = 5 % 2", []Error{{1, 11, `unexpected character "%"`}}},
+}
+
+func TestErrors(t *testing.T) {
+	for _, test := range errorTests {
+		_, errs := Parse(test.source)
+		if !reflect.DeepEqual(errs, test.errors) {
+			t.Errorf("%s: errors %v, want %v", test.name, errs, test.errors)
+		}
+	}
+}
+
+// After an error the parser should carry on from the next
+// statement, reporting every error and keeping good statements
+var recoveryTests = []struct {
+	name   string
+	source []string // Lines of the source file
+	errors []Error
+	tree   string
+}{
+	{
+		"statements",
+		[]string{
+			"let = 1",
+			"let a = 1",
+			"fun f(x {",
+			"  return x",
+			"}",
+			"if a {",
+			"  let b = * 2",
+			"  print(b)",
+			"}",
+			"set c",
+			"print(a %)",
+		},
+		[]Error{
+			{1, 5, "expected variable name, found '='"},
+			{3, 9, "expected ')', found '{'"},
+			{7, 11, "expected expression, found '*'"},
+			{11, 1, "expected '=' after set c, constants must be given a value"},
+			{11, 9, `unexpected character "%"`},
+		},
+		"(let a 1) (return x) (if a {(print b)}) (print a)",
+	},
+	{
+		"nested blocks",
+		[]string{
+			"if a {",
+			"  fun f(x {",
+			"    return x",
+			"  }",
+			"  let m = { [1]: 2 }",
+			"  print(1 + )",
+			"  print(2)",
+			"}",
+			"print(3)",
+		},
+		[]Error{
+			{2, 11, "expected ')', found '{'"},
+			{5, 13, "expected map key, found '['"},
+			{6, 13, "expected expression, found ')'"},
+		},
+		"(if a {(return x) (print 2)}) (print 3)",
+	},
+	{
+		"stray brace",
+		[]string{"print(1)", "}", "print(2)"},
+		[]Error{{2, 1, "expected expression, found '}'"}},
+		"(print 1) (print 2)",
+	},
+}
+
+func TestRecovery(t *testing.T) {
+	for _, test := range recoveryTests {
+		program, errs := Parse(strings.Join(test.source, "\n"))
+		if !reflect.DeepEqual(errs, test.errors) {
+			t.Errorf("%s: errors\n\t%v\nwant\n\t%v", test.name, errs, test.errors)
+		}
+		if tree := stmts(program.Stmts); tree != test.tree {
+			t.Errorf("%s: recovered\n\t%s\nwant\n\t%s", test.name, tree, test.tree)
+		}
+	}
+}
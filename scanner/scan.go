@@ -7,97 +7,340 @@ import (
 
 const eof = ""
 
+// Error is a lexical error found by the Scanner
+type Error struct {
+	Line    int
+	Column  int
+	Message string
+}
+
+func (e Error) Error() string {
+	return fmt.Sprintf("%d:%d: %s", e.Line, e.Column, e.Message)
+}
+
+// Scanner splits Run source into Tokens. Each call to Next sends
+// exactly one token on the Tokens channel, lexical errors are sent
+// as ErrorTokens and also collected in Errors
 type Scanner struct {
-	start  int
-	cursor int
-	line   int
-	source string
+	start  int // Index of the first rune of the token being scanned
+	cursor int // Index of the current rune
+	line   int // Position of the current rune
+	column int
+	first  Token // Position of the token being scanned
+	source []rune
 	Tokens chan Token
+	Errors []Error
 }
 
 func NewScanner(source string) *Scanner {
-	return &Scanner{
-		source: source,
+	l := &Scanner{
+		line:   1,
+		column: 1,
+		source: []rune(source),
 		Tokens: make(chan Token, 2),
 	}
+	l.Ignore()
+	return l
 }
 
-func (l *Scanner) Peek() string {
-	if l.cursor < len([]rune(l.source)) {
-		return string([]rune(l.source)[l.cursor+1])
-	} else {
-		return eof
+// Scan returns the next token from the source
+func (l *Scanner) Scan() Token {
+	l.Next()
+	return <-l.Tokens
+}
+
+// Tokenize scans an entire source, returning every token
+// up to and including the EOF token
+func Tokenize(source string) ([]Token, []Error) {
+	l := NewScanner(source)
+
+	var tokens []Token
+	for {
+		token := l.Scan()
+		tokens = append(tokens, token)
+		if token.Type == EOF {
+			return tokens, l.Errors
+		}
 	}
 }
 
+// Peek returns the rune after the current rune
+func (l *Scanner) Peek() string {
+	return l.lookahead(1)
+}
+
+// Current returns the rune under the cursor
 func (l *Scanner) Current() string {
-	if l.cursor < len([]rune(l.source)) {
-		return string([]rune(l.source)[l.cursor])
-	} else {
-		return eof
+	return l.lookahead(0)
+}
+
+func (l *Scanner) lookahead(n int) string {
+	if l.cursor+n < len(l.source) {
+		return string(l.source[l.cursor+n])
 	}
+	return eof
 }
 
+// Emit sends the runes scanned since the last token as a token
 func (l *Scanner) Emit(typ TokenType) {
-	val := l.source[l.start:l.cursor]
-	token := Token{
-		Type:  typ,
-		Value: val,
-	}
+	l.emitValue(typ, string(l.source[l.start:l.cursor]))
+}
 
-	l.start = l.cursor
+func (l *Scanner) emitValue(typ TokenType, val string) {
+	token := l.first
+	token.Type = typ
+	token.Value = val
+
+	l.Ignore()
 	l.Tokens <- token
 }
 
+// Ignore skips over the runes scanned since the last token
+func (l *Scanner) Ignore() {
+	l.start = l.cursor
+	l.first = Token{
+		Line:   l.line,
+		Column: l.column,
+	}
+}
+
 func (l *Scanner) Step() {
+	if l.cursor >= len(l.source) {
+		return
+	}
+
+	if l.Current() == "\n" {
+		l.line++
+		l.column = 1
+	} else {
+		l.column++
+	}
 	l.cursor++
 }
 
+// Error sends an ErrorToken positioned at the start of
+// the token being scanned
 func (l *Scanner) Error(msg string) {
-	fmt.Println("Scanning Error Occured")
-	fmt.Printf("Line %d, at %d: %s\n", l.line, l.cursor, msg)
+	l.errorAt(l.first.Line, l.first.Column, msg)
 }
 
+func (l *Scanner) errorAt(line, column int, msg string) {
+	l.Errors = append(l.Errors, Error{
+		Line:    line,
+		Column:  column,
+		Message: msg,
+	})
+
+	l.first.Line = line
+	l.first.Column = column
+	l.emitValue(ErrorToken, msg)
+}
+
+// Next scans the next token from the source
 func (l *Scanner) Next() {
-	if l.cursor < len([]rune(l.source)) {
+	l.skip()
+
+	char := l.Current()
+	switch {
+	case char == eof:
+		l.Emit(EOF)
+	case isDigit(char):
+		l.number()
+	case isQuote(char):
+		l.string()
+	case isIdentifierStart(char):
+		l.identifier()
+	default:
+		l.operator()
+	}
+}
+
+// skip passes over whitespace and comments
+func (l *Scanner) skip() {
+	for {
 		if isWhiteSpace(l.Current()) {
-			for isWhiteSpace(l.Peek()) {
+			l.Step()
+		} else if isComment(l.Current()) {
+			for l.Current() != "\n" && l.Current() != eof {
 				l.Step()
 			}
+		} else {
+			break
+		}
+	}
+	l.Ignore()
+}
+
+func (l *Scanner) number() {
+	for isDigit(l.Current()) {
+		l.Step()
+	}
+
+	if l.Current() == "." && isDigit(l.Peek()) {
+		l.Step()
+		for isDigit(l.Current()) {
+			l.Step()
 		}
+	}
 
-		if isDigit(l.Current()) {
-			for isDigit(l.Peek()) {
-				fmt.Println(l.Current())
+	if l.Current() == "e" || l.Current() == "E" {
+		sign := l.Peek() == "+" || l.Peek() == "-"
+		if isDigit(l.Peek()) || sign && isDigit(l.lookahead(2)) {
+			l.Step()
+			if sign {
 				l.Step()
 			}
-			l.Emit(NumberToken)
+			for isDigit(l.Current()) {
+				l.Step()
+			}
+		}
+	}
+
+	if isIdentifierPart(l.Current()) {
+		for isIdentifierPart(l.Current()) {
+			l.Step()
 		}
+		l.Error(fmt.Sprintf("invalid number %s", string(l.source[l.start:l.cursor])))
+		return
+	}
+
+	l.Emit(NumberToken)
+}
+
+var escapes = map[string]string{
+	"n": "\n",
+	"t": "\t",
+	"r": "\r",
+	"0": "\x00",
+	`"`: `"`,
+	`\`: `\`,
+}
+
+func (l *Scanner) string() {
+	var value string
+	var invalid *Error
+	l.Step()
+
+	for !isQuote(l.Current()) {
+		char := l.Current()
+		if char == eof || char == "\n" {
+			l.Error("unterminated string")
+			return
+		}
+
+		if char == `\` {
+			line, column := l.line, l.column
+			l.Step()
+			escaped, ok := escapes[l.Current()]
+			if !ok && invalid == nil {
+				invalid = &Error{
+					Line:    line,
+					Column:  column,
+					Message: fmt.Sprintf("invalid escape sequence \\%s", l.Current()),
+				}
+			}
+			if l.Current() == eof || l.Current() == "\n" {
+				continue
+			}
+			char = escaped
+		}
+
+		value += char
+		l.Step()
+	}
+	l.Step()
+
+	if invalid != nil {
+		l.errorAt(invalid.Line, invalid.Column, invalid.Message)
+		return
+	}
+	l.emitValue(StringToken, value)
+}
+
+func (l *Scanner) identifier() {
+	for isIdentifierPart(l.Current()) {
+		l.Step()
+	}
 
+	if typ, ok := Keywords[string(l.source[l.start:l.cursor])]; ok {
+		l.Emit(typ)
 	} else {
-		l.Emit(EOF)
+		l.Emit(IdentiferToken)
+	}
+}
+
+var operators = map[string]TokenType{
+	"(":  LeftParenToken,
+	")":  RightParenToken,
+	"{":  LeftBraceToken,
+	"}":  RightBraceToken,
+	"[":  LeftBracketToken,
+	"]":  RightBracketToken,
+	"+":  PlusToken,
+	"-":  MinusToken,
+	"*":  StarToken,
+	"/":  SlashToken,
+	",":  CommaToken,
+	".":  DotToken,
+	":":  ColonToken,
+	"!":  BangToken,
+	"!=": BangEqualToken,
+	"=":  EqualToken,
+	"==": EqualEqualToken,
+	">":  GreaterToken,
+	">=": GreaterEqualToken,
+	"<":  LessToken,
+	"<=": LessEqualToken,
+}
+
+func (l *Scanner) operator() {
+	// Prefer the longest operator, such as <= over <
+	if typ, ok := operators[l.Current()+l.Peek()]; ok {
+		l.Step()
+		l.Step()
+		l.Emit(typ)
+		return
+	}
+
+	char := l.Current()
+	l.Step()
+	if typ, ok := operators[char]; ok {
+		l.Emit(typ)
+	} else {
+		l.Error(fmt.Sprintf("unexpected character %q", char))
 	}
 }
 
 func isDigit(s string) bool {
 	r := []rune(s)
-	return '0' <= r[0] && r[0] <= '9'
+	return len(r) > 0 && '0' <= r[0] && r[0] <= '9'
 }
 
-func isIdentifier(s string) bool {
-	first := true
-	for _, r := range s {
-		if unicode.IsDigit(r) {
-			if first {
-				return false
-			}
-		} else if r != '_' && !unicode.IsLetter(r) {
-			return false
-		}
-		first = false
+func isQuote(s string) bool {
+	return s == `"`
+}
+
+func isComment(s string) bool {
+	return s == "#"
+}
+
+// isIdentifierStart reports whether s may begin an identifier.
+// Identifiers are made of letters, digits and underscores, or
+// any other printable character outside of ASCII
+func isIdentifierStart(s string) bool {
+	return isIdentifierPart(s) && !isDigit(s)
+}
+
+func isIdentifierPart(s string) bool {
+	if s == eof {
+		return false
 	}
 
-	return true
+	r := []rune(s)[0]
+	if r > unicode.MaxASCII {
+		return unicode.IsGraphic(r) && !unicode.IsSpace(r)
+	}
+	return r == '_' || unicode.IsLetter(r) || unicode.IsDigit(r)
 }
 
 func isWhiteSpace(s string) bool {
@@ -0,0 +1,191 @@
+package scanner
+
+import (
+	"reflect"
+	"testing"
+)
+
+// tok is an expected token. Its position is only checked
+// if line is set
+type tok struct {
+	typ    TokenType
+	value  string
+	line   int
+	column int
+}
+
+var scanTests = []struct {
+	name   string
+	source string
+	tokens []tok // Expected tokens, before the EOF
+	errors []Error
+}{
+	{"empty", "", nil, nil},
+
+	// Literals
+	{"string", `"hello world"`, []tok{{StringToken, "hello world", 1, 1}}, nil},
+	{"empty string", `""`, []tok{{StringToken, "", 1, 1}}, nil},
+	{"escapes", `"a\n\t\r\0\"\\b"`, []tok{{StringToken, "a\n\t\r\x00\"\\b", 1, 1}}, nil},
+	{"unicode string", `"héllo" x`, []tok{{StringToken, "héllo", 1, 1}, {IdentiferToken, "x", 1, 9}}, nil},
+	{"integer", "42", []tok{{NumberToken, "42", 1, 1}}, nil},
+	{"fraction", "3.14", []tok{{NumberToken, "3.14", 1, 1}}, nil},
+	{"exponents", "1e10 2.5E-3 6e+2", []tok{
+		{NumberToken, "1e10", 1, 1},
+		{NumberToken, "2.5E-3", 1, 6},
+		{NumberToken, "6e+2", 1, 13},
+	}, nil},
+	{"number then field", "1.x", []tok{
+		{NumberToken, "1", 1, 1},
+		{DotToken, ".", 1, 2},
+		{IdentiferToken, "x", 1, 3},
+	}, nil},
+	{"number then minus", "2e-x", []tok{
+		{ErrorToken, "invalid number 2e", 1, 1},
+		{MinusToken, "-", 1, 3},
+		{IdentiferToken, "x", 1, 4},
+	}, []Error{{1, 1, "invalid number 2e"}}},
+	{"booleans", "true false", []tok{
+		{BooleanToken, "true", 1, 1},
+		{BooleanToken, "false", 1, 6},
+	}, nil},
+	{"identifiers", "foo _bar x1 héllo", []tok{
+		{IdentiferToken, "foo", 1, 1},
+		{IdentiferToken, "_bar", 1, 5},
+		{IdentiferToken, "x1", 1, 10},
+		{IdentiferToken, "héllo", 1, 13},
+	}, nil},
+	{"keywords", "and or is if else for of nil let set fun return import export entity", []tok{
+		{AndToken, "and", 1, 1},
+		{OrToken, "or", 1, 5},
+		{IsToken, "is", 1, 8},
+		{IfToken, "if", 1, 11},
+		{ElseToken, "else", 1, 14},
+		{ForToken, "for", 1, 19},
+		{OfToken, "of", 1, 23},
+		{NilToken, "nil", 1, 26},
+		{LetToken, "let", 1, 30},
+		{SetToken, "set", 1, 34},
+		{FunToken, "fun", 1, 38},
+		{ReturnToken, "return", 1, 42},
+		{ImportToken, "import", 1, 49},
+		{ExportToken, "export", 1, 56},
+		{EntityToken, "entity", 1, 63},
+	}, nil},
+	{"keyword prefix", "iffy", []tok{{IdentiferToken, "iffy", 1, 1}}, nil},
+
+	// Punctuation and operators
+	{"punctuation", "(){}[]+-*/,.:", []tok{
+		{LeftParenToken, "(", 1, 1},
+		{RightParenToken, ")", 1, 2},
+		{LeftBraceToken, "{", 1, 3},
+		{RightBraceToken, "}", 1, 4},
+		{LeftBracketToken, "[", 1, 5},
+		{RightBracketToken, "]", 1, 6},
+		{PlusToken, "+", 1, 7},
+		{MinusToken, "-", 1, 8},
+		{StarToken, "*", 1, 9},
+		{SlashToken, "/", 1, 10},
+		{CommaToken, ",", 1, 11},
+		{DotToken, ".", 1, 12},
+		{ColonToken, ":", 1, 13},
+	}, nil},
+	{"operators", "! != = == > >= < <=", []tok{
+		{BangToken, "!", 1, 1},
+		{BangEqualToken, "!=", 1, 3},
+		{EqualToken, "=", 1, 6},
+		{EqualEqualToken, "==", 1, 8},
+		{GreaterToken, ">", 1, 11},
+		{GreaterEqualToken, ">=", 1, 13},
+		{LessToken, "<", 1, 16},
+		{LessEqualToken, "<=", 1, 18},
+	}, nil},
+	{"longest operator", "a<=b===c", []tok{
+		{IdentiferToken, "a", 1, 1},
+		{LessEqualToken, "<=", 1, 2},
+		{IdentiferToken, "b", 1, 4},
+		{EqualEqualToken, "==", 1, 5},
+		{EqualToken, "=", 1, 7},
+		{IdentiferToken, "c", 1, 8},
+	}, nil},
+
+	// Whitespace and comments
+	{"comments", "# comment\nx # trailing\n# end", []tok{{IdentiferToken, "x", 2, 1}}, nil},
+	{"comment only", "# nothing here", nil, nil},
+	{"lines", "a\n  b\r\n\tc", []tok{
+		{IdentiferToken, "a", 1, 1},
+		{IdentiferToken, "b", 2, 3},
+		{IdentiferToken, "c", 3, 2},
+	}, nil},
+
+	// Errors
+	{"unexpected character", "a @ b", []tok{
+		{IdentiferToken, "a", 1, 1},
+		{ErrorToken, `unexpected character "@"`, 1, 3},
+		{IdentiferToken, "b", 1, 5},
+	}, []Error{{1, 3, `unexpected character "@"`}}},
+	{"invalid number", "x = 12abc", []tok{
+		{IdentiferToken, "x", 1, 1},
+		{EqualToken, "=", 1, 3},
+		{ErrorToken, "invalid number 12abc", 1, 5},
+	}, []Error{{1, 5, "invalid number 12abc"}}},
+	{"unterminated string", `x = "abc`, []tok{
+		{IdentiferToken, "x", 1, 1},
+		{EqualToken, "=", 1, 3},
+		{ErrorToken, "unterminated string", 1, 5},
+	}, []Error{{1, 5, "unterminated string"}}},
+	{"string across lines", "\"ab\ncd", []tok{
+		{ErrorToken, "unterminated string", 1, 1},
+		{IdentiferToken, "cd", 2, 1},
+	}, []Error{{1, 1, "unterminated string"}}},
+	{"invalid escape", `"a\qb" c`, []tok{
+		{ErrorToken, `invalid escape sequence \q`, 1, 3},
+		{IdentiferToken, "c", 1, 8},
+	}, []Error{{1, 3, `invalid escape sequence \q`}}},
+	{"invalid escape position", "x\n  \"ok\\z\"", []tok{
+		{IdentiferToken, "x", 1, 1},
+		{ErrorToken, `invalid escape sequence \z`, 2, 6},
+	}, []Error{{2, 6, `invalid escape sequence \z`}}},
+	{"several errors", "@\n$", []tok{
+		{ErrorToken, `unexpected character "@"`, 1, 1},
+		{ErrorToken, `unexpected character "$"`, 2, 1},
+	}, []Error{{1, 1, `unexpected character "@"`}, {2, 1, `unexpected character "$"`}}},
+}
+
+func TestTokenize(t *testing.T) {
+	for _, test := range scanTests {
+		t.Run(test.name, func(t *testing.T) {
+			tokens, errs := Tokenize(test.source)
+			if len(tokens) == 0 || tokens[len(tokens)-1].Type != EOF {
+				t.Fatalf("tokens %v do not end with EOF", tokens)
+			}
+			tokens = tokens[:len(tokens)-1]
+
+			if len(tokens) != len(test.tokens) {
+				t.Fatalf("scanned %v, expected %d tokens", tokens, len(test.tokens))
+			}
+			for i, want := range test.tokens {
+				got := tokens[i]
+				if got.Type != want.typ || got.Value != want.value {
+					t.Errorf("token %d is %s %q, expected %s %q", i, got.Type, got.Value, want.typ, want.value)
+				}
+				if want.line > 0 && (got.Line != want.line || got.Column != want.column) {
+					t.Errorf("token %d %q is at %d:%d, expected %d:%d", i, got.Value, got.Line, got.Column, want.line, want.column)
+				}
+			}
+
+			if len(errs) != 0 || len(test.errors) != 0 {
+				if !reflect.DeepEqual(errs, test.errors) {
+					t.Errorf("found errors %v, expected %v", errs, test.errors)
+				}
+			}
+		})
+	}
+}
+
+func TestEOFPosition(t *testing.T) {
+	tokens, _ := Tokenize("ab\ncd ")
+	eof := tokens[len(tokens)-1]
+	if eof.Type != EOF || eof.Line != 2 || eof.Column != 4 {
+		t.Errorf("EOF is %s at %d:%d, expected end of file at 2:4", eof.Type, eof.Line, eof.Column)
+	}
+}
@@ -1,7 +1,61 @@
 package scanner
 
+import "fmt"
+
 type TokenType int
 
+// TokenTypes contains string representations of TokenTypes
+// for simple formatting
+var TokenTypes = []string{
+	"string",
+	"number",
+	"boolean",
+	"identifier",
+
+	"(",
+	")",
+	"{",
+	"}",
+	"[",
+	"]",
+
+	"+",
+	"-",
+	"*",
+	"/",
+	",",
+	".",
+	":",
+
+	"!",
+	"!=",
+	"=",
+	"==",
+	">",
+	">=",
+	"<",
+	"<=",
+
+	"and",
+	"or",
+	"is",
+	"if",
+	"else",
+	"for",
+	"of",
+	"nil",
+	"let",
+	"set",
+	"fun",
+	"return",
+	"import",
+	"export",
+	"entity",
+
+	"error",
+	"end of file",
+}
+
 const (
 	// Literals
 	StringToken TokenType = iota
@@ -14,6 +68,8 @@ const (
 	RightParenToken
 	LeftBraceToken
 	RightBraceToken
+	LeftBracketToken
+	RightBracketToken
 
 	PlusToken
 	MinusToken
@@ -21,6 +77,7 @@ const (
 	SlashToken
 	CommaToken
 	DotToken
+	ColonToken
 
 	// Operators
 	BangToken
@@ -35,6 +92,7 @@ const (
 	// Keywords
 	AndToken
 	OrToken
+	IsToken
 	IfToken
 	ElseToken
 	ForToken
@@ -45,14 +103,43 @@ const (
 	FunToken
 	ReturnToken
 	ImportToken
+	ExportToken
 	EntityToken
 
+	ErrorToken // Value holds the error message
 	EOF
 )
 
+// Keywords maps reserved words to their TokenType
+var Keywords = map[string]TokenType{
+	"and":    AndToken,
+	"or":     OrToken,
+	"is":     IsToken,
+	"if":     IfToken,
+	"else":   ElseToken,
+	"for":    ForToken,
+	"of":     OfToken,
+	"nil":    NilToken,
+	"let":    LetToken,
+	"set":    SetToken,
+	"fun":    FunToken,
+	"return": ReturnToken,
+	"import": ImportToken,
+	"export": ExportToken,
+	"entity": EntityToken,
+	"true":   BooleanToken,
+	"false":  BooleanToken,
+}
+
+func (t TokenType) String() string {
+	return TokenTypes[t]
+}
+
 type Token struct {
-	Type  TokenType
-	Value string
+	Type   TokenType
+	Value  string // Source text, or the unescaped contents of a string
+	Line   int    // Line number, starting at 1
+	Column int    // Column in runes, starting at 1
 }
 
 func NewToken(typ TokenType, val string) *Token {
@@ -61,3 +148,13 @@ func NewToken(typ TokenType, val string) *Token {
 		Value: val,
 	}
 }
+
+func (t Token) String() string {
+	switch t.Type {
+	case StringToken:
+		return fmt.Sprintf("%q", t.Value)
+	case NumberToken, BooleanToken, IdentiferToken, ErrorToken:
+		return t.Value
+	}
+	return t.Type.String()
+}
@@ -0,0 +1,156 @@
+// Package stdlib provides the native functions of the Run standard
+// library. Every native which reaches outside of the program, such
+// as to read a file or run a command, first consults the
+// Capabilities granted by the host, raising a PermissionError
+// naming the capability if it has not been granted
+package stdlib
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/chickencoder/run/vm"
+)
+
+// Capability names a power which the host may grant to programs
+type Capability string
+
+const (
+	Read  Capability = "read"  // Read files within the Read roots
+	Write Capability = "write" // Create and write files within the Write roots
+	Exec  Capability = "exec"  // Run other programs
+	Env   Capability = "env"   // Read environment variables
+	Clock Capability = "clock" // Read the time
+	Net   Capability = "net"   // Make network requests
+)
+
+// Capabilities is the set of powers granted to programs. The
+// zero value grants nothing, so that untrusted programs may only
+// compute. Files may be read or written only if they lie within
+// one of the roots, once links are followed
+type Capabilities struct {
+	Read  []string // Directories whose files may be read
+	Write []string // Directories whose files may be written
+	Exec  bool
+	Env   bool
+	Clock bool
+	Net   bool
+}
+
+// All returns capabilities granting every power
+func All() Capabilities {
+	root := string(filepath.Separator)
+	return Capabilities{
+		Read:  []string{root},
+		Write: []string{root},
+		Exec:  true,
+		Env:   true,
+		Clock: true,
+		Net:   true,
+	}
+}
+
+// deny returns the PermissionError raised when a native
+// requires a capability which has not been granted
+func deny(capability Capability, format string, args ...interface{}) error {
+	return &vm.RuntimeError{
+		Kind:    vm.PermissionError,
+		Message: fmt.Sprintf("requires %s capability to %s", capability, fmt.Sprintf(format, args...)),
+	}
+}
+
+// path returns the real path of a file which may be read or
+// written, checking that it lies within one of the roots granted
+// for the capability. Links are followed, including a link to a
+// file which does not yet exist, so that a link within a root
+// cannot lead outside of it. The path returned has no links, so
+// it is the file which was checked that is read or written
+func (c *Capabilities) path(capability Capability, name string) (string, error) {
+	roots := c.Read
+	if capability == Write {
+		roots = c.Write
+	}
+
+	abs, err := filepath.Abs(name)
+	if err != nil {
+		return "", err
+	}
+
+	var real []string
+	for _, root := range roots {
+		root, err := filepath.Abs(root)
+		if err != nil {
+			continue
+		}
+		if root, err = filepath.EvalSymlinks(root); err == nil {
+			real = append(real, root)
+		}
+	}
+
+	// A path which cannot be resolved, such as within a missing
+	// directory, is only reported if it would have been allowed
+	path, err := resolve(abs, 0)
+	if err != nil {
+		for _, root := range real {
+			if within(root, abs) {
+				return "", err
+			}
+		}
+		return "", deny(capability, "access %s", name)
+	}
+
+	for _, root := range real {
+		if within(root, path) {
+			return path, nil
+		}
+	}
+	return "", deny(capability, "access %s", name)
+}
+
+// maxLinks is the number of links resolve follows before
+// giving up, as the links may form a loop
+const maxLinks = 40
+
+// resolve returns path with every link followed. Its directory
+// must exist, whereas the file itself may not, or may be a link
+// to a file which does not
+func resolve(path string, links int) (string, error) {
+	dir, err := filepath.EvalSymlinks(filepath.Dir(path))
+	if err != nil {
+		return "", err
+	}
+	path = filepath.Join(dir, filepath.Base(path))
+
+	info, err := os.Lstat(path)
+	if os.IsNotExist(err) {
+		return path, nil
+	} else if err != nil {
+		return "", err
+	}
+	if info.Mode()&os.ModeSymlink == 0 {
+		return path, nil
+	}
+
+	if links == maxLinks {
+		return "", fmt.Errorf("too many links in %s", path)
+	}
+	target, err := os.Readlink(path)
+	if err != nil {
+		return "", err
+	}
+	if !filepath.IsAbs(target) {
+		target = filepath.Join(dir, target)
+	}
+	return resolve(target, links+1)
+}
+
+// within reports whether path is root or lies beneath it
+func within(root, path string) bool {
+	rel, err := filepath.Rel(root, path)
+	if err != nil {
+		return false
+	}
+	return rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) && !filepath.IsAbs(rel)
+}
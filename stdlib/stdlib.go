@@ -0,0 +1,223 @@
+package stdlib
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/chickencoder/run/vm"
+)
+
+// fetchTimeout bounds each request made by fetch
+const fetchTimeout = 30 * time.Second
+
+// Register adds the natives of the standard library to a
+// registry. Each consults caps as it is called, so that the
+// host may grant or revoke capabilities between calls. Those
+// which wait, on a process or a request, stop once the run
+// is cancelled or times out, and those which read stop once
+// past the Allowance of the run
+func Register(natives *vm.Natives, caps *Capabilities) {
+	natives.RegisterContext("readFile", 1, func(ctx context.Context, args []vm.Value) (vm.Value, error) {
+		name, err := text(args[0])
+		if err != nil {
+			return vm.Nil, err
+		}
+		path, err := caps.path(Read, name)
+		if err != nil {
+			return vm.Nil, err
+		}
+		file, err := os.Open(path)
+		if err != nil {
+			return vm.Nil, err
+		}
+		defer file.Close()
+		return readAll(ctx, file)
+	})
+
+	natives.Register("listDir", 1, func(args []vm.Value) (vm.Value, error) {
+		name, err := text(args[0])
+		if err != nil {
+			return vm.Nil, err
+		}
+		path, err := caps.path(Read, name)
+		if err != nil {
+			return vm.Nil, err
+		}
+		files, err := ioutil.ReadDir(path)
+		if err != nil {
+			return vm.Nil, err
+		}
+		items := make([]vm.Value, len(files))
+		for i, file := range files {
+			items[i] = vm.Value{Kind: vm.StringValue, Content: file.Name()}
+		}
+		return vm.NewList(items), nil
+	})
+
+	natives.Register("writeFile", 2, func(args []vm.Value) (vm.Value, error) {
+		name, err := text(args[0])
+		if err != nil {
+			return vm.Nil, err
+		}
+		content, err := text(args[1])
+		if err != nil {
+			return vm.Nil, err
+		}
+		path, err := caps.path(Write, name)
+		if err != nil {
+			return vm.Nil, err
+		}
+		return vm.Nil, ioutil.WriteFile(path, []byte(content), 0644)
+	})
+
+	natives.RegisterContext("exec", 2, func(ctx context.Context, args []vm.Value) (vm.Value, error) {
+		name, err := text(args[0])
+		if err != nil {
+			return vm.Nil, err
+		}
+		if args[1].Kind != vm.ListValue {
+			return vm.Nil, fmt.Errorf("expected list of arguments, found %s", vm.ValueKinds[args[1].Kind])
+		}
+		if !caps.Exec {
+			return vm.Nil, deny(Exec, "run %s", name)
+		}
+
+		items := args[1].Content.(*vm.List).Items
+		argv := make([]string, len(items))
+		for i, item := range items {
+			if argv[i], err = text(item); err != nil {
+				return vm.Nil, err
+			}
+		}
+
+		stderr := &prefix{max: stderrSize}
+		cmd := exec.CommandContext(ctx, name, argv...)
+		cmd.Stderr = stderr
+		stdout, err := cmd.StdoutPipe()
+		if err != nil {
+			return vm.Nil, err
+		}
+		if err := cmd.Start(); err != nil {
+			return vm.Nil, err
+		}
+
+		out, err := readAll(ctx, stdout)
+		if err != nil {
+			cmd.Process.Kill()
+			cmd.Wait()
+			return vm.Nil, err
+		}
+		if err := cmd.Wait(); err != nil {
+			if msg := strings.TrimSpace(string(stderr.buf)); msg != "" {
+				return vm.Nil, fmt.Errorf("%s: %s", err, msg)
+			}
+			return vm.Nil, err
+		}
+		return out, nil
+	})
+
+	natives.Register("env", 1, func(args []vm.Value) (vm.Value, error) {
+		name, err := text(args[0])
+		if err != nil {
+			return vm.Nil, err
+		}
+		if !caps.Env {
+			return vm.Nil, deny(Env, "read %s", name)
+		}
+		if item, ok := os.LookupEnv(name); ok {
+			return vm.Value{Kind: vm.StringValue, Content: item}, nil
+		}
+		return vm.Nil, nil
+	})
+
+	natives.Register("clock", 0, func(args []vm.Value) (vm.Value, error) {
+		if !caps.Clock {
+			return vm.Nil, deny(Clock, "read the time")
+		}
+		seconds := float64(time.Now().UnixNano()) / float64(time.Second)
+		return vm.Value{Kind: vm.NumberValue, Content: seconds}, nil
+	})
+
+	natives.RegisterContext("fetch", 1, func(ctx context.Context, args []vm.Value) (vm.Value, error) {
+		url, err := text(args[0])
+		if err != nil {
+			return vm.Nil, err
+		}
+		if !caps.Net {
+			return vm.Nil, deny(Net, "fetch %s", url)
+		}
+
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+		if err != nil {
+			return vm.Nil, err
+		}
+		client := http.Client{Timeout: fetchTimeout}
+		res, err := client.Do(req)
+		if err != nil {
+			return vm.Nil, err
+		}
+		defer res.Body.Close()
+
+		if res.StatusCode >= 400 {
+			return vm.Nil, fmt.Errorf("%s returned %s", url, res.Status)
+		}
+		return readAll(ctx, res.Body)
+	})
+}
+
+// readAll reads r into a string, stopping with a LimitError
+// once it holds more than the Allowance of the run
+func readAll(ctx context.Context, r io.Reader) (vm.Value, error) {
+	n, limited := vm.Allowance(ctx)
+	if limited {
+		r = io.LimitReader(r, int64(n)+1)
+	}
+
+	dat, err := ioutil.ReadAll(r)
+	if err != nil {
+		return vm.Nil, err
+	}
+	if limited && len(dat) > n {
+		return vm.Nil, &vm.RuntimeError{
+			Kind:    vm.LimitError,
+			Message: fmt.Sprintf("result exceeds limit of %d bytes", n),
+		}
+	}
+	return vm.Value{Kind: vm.StringValue, Content: string(dat)}, nil
+}
+
+// stderrSize is the number of bytes of the error output
+// of a process kept to explain its failure
+const stderrSize = 4096
+
+// prefix keeps the first max bytes written to it,
+// discarding the rest
+type prefix struct {
+	buf []byte
+	max int
+}
+
+func (p *prefix) Write(b []byte) (int, error) {
+	if room := p.max - len(p.buf); room > 0 {
+		if len(b) < room {
+			room = len(b)
+		}
+		p.buf = append(p.buf, b[:room]...)
+	}
+	return len(b), nil
+}
+
+// text returns the content of a string argument
+func text(v vm.Value) (string, error) {
+	if v.Kind != vm.StringValue {
+		return "", fmt.Errorf("expected string argument, found %s", vm.ValueKinds[v.Kind])
+	}
+	return v.Content.(string), nil
+}
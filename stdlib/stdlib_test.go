@@ -0,0 +1,113 @@
+package stdlib
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/chickencoder/run/vm"
+)
+
+// call runs a program calling the native name with string
+// arguments, returning the error it stops with
+func call(t *testing.T, caps *Capabilities, limits vm.Limits, name string, args ...string) error {
+	var b strings.Builder
+	for _, arg := range args {
+		fmt.Fprintf(&b, "    const %s\n", strconv.Quote(arg))
+	}
+	fmt.Fprintf(&b, "    callnative %q %d\n    pop\n    halt\n", name, len(args))
+
+	program, diagnostics, err := vm.Assemble(b.String())
+	if err != nil {
+		t.Fatal(err, diagnostics)
+	}
+
+	natives := vm.NewNatives()
+	Register(natives, caps)
+	r := vm.NewRunner(program, 64, 0, false)
+	r.SetNatives(natives)
+	r.SetLimits(limits)
+	return r.Run()
+}
+
+// kind returns the kind of a RuntimeError, or -1 for any other error
+func kind(err error) vm.ErrorKind {
+	if rerr, ok := err.(*vm.RuntimeError); ok {
+		return rerr.Kind
+	}
+	return -1
+}
+
+func TestReadLimit(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "big.txt")
+	if err := ioutil.WriteFile(path, []byte(strings.Repeat("a", 10000)), 0644); err != nil {
+		t.Fatal(err)
+	}
+	caps := &Capabilities{Read: []string{dir}}
+
+	if err := call(t, caps, vm.Limits{}, "readFile", path); err != nil {
+		t.Errorf("reading without limits: %s", err)
+	}
+	for _, limits := range []vm.Limits{{StringLen: 100}, {HeapBytes: 5000}} {
+		err := call(t, caps, limits, "readFile", path)
+		if kind(err) != vm.LimitError {
+			t.Errorf("reading 10000 bytes with limits %+v returned %v, expected a LimitError", limits, err)
+		}
+	}
+}
+
+func TestWriteLinks(t *testing.T) {
+	dir := t.TempDir()
+	data := filepath.Join(dir, "data")
+	outside := filepath.Join(dir, "outside")
+	for _, d := range []string{data, outside} {
+		if err := os.Mkdir(d, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	links := map[string]string{
+		"escape.txt": filepath.Join(outside, "pwned.txt"), // Dangling, outside the root
+		"inner.txt":  "target.txt",                        // Dangling, within the root
+		"up":         filepath.Join("..", "outside"),
+		"loop":       "loop",
+	}
+	for name, target := range links {
+		if err := os.Symlink(target, filepath.Join(data, name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	caps := &Capabilities{Read: []string{data}, Write: []string{data}}
+
+	if err := call(t, caps, vm.Limits{}, "writeFile", filepath.Join(data, "escape.txt"), "x"); kind(err) != vm.PermissionError {
+		t.Errorf("writing through a dangling link out of the root returned %v, expected a PermissionError", err)
+	}
+	if _, err := os.Lstat(filepath.Join(outside, "pwned.txt")); !os.IsNotExist(err) {
+		t.Error("writing through a dangling link created a file outside of the root")
+	}
+
+	if err := call(t, caps, vm.Limits{}, "writeFile", filepath.Join(data, "inner.txt"), "x"); err != nil {
+		t.Errorf("writing through a dangling link within the root: %s", err)
+	}
+	if dat, err := ioutil.ReadFile(filepath.Join(data, "target.txt")); err != nil || string(dat) != "x" {
+		t.Errorf("writing through a dangling link within the root wrote %q, %v", dat, err)
+	}
+
+	if err := call(t, caps, vm.Limits{}, "writeFile", filepath.Join(data, "up", "file.txt"), "x"); kind(err) != vm.PermissionError {
+		t.Errorf("writing through a linked directory out of the root returned %v, expected a PermissionError", err)
+	}
+	if err := call(t, caps, vm.Limits{}, "readFile", filepath.Join(outside, "missing", "file.txt")); kind(err) != vm.PermissionError {
+		t.Errorf("reading a missing directory out of the root returned %v, expected a PermissionError", err)
+	}
+	if err := call(t, caps, vm.Limits{}, "readFile", filepath.Join(data, "missing", "file.txt")); kind(err) != vm.NativeError {
+		t.Errorf("reading a missing directory within the root returned %v, expected a NativeError", err)
+	}
+	if err := call(t, caps, vm.Limits{}, "writeFile", filepath.Join(data, "loop"), "x"); kind(err) != vm.NativeError {
+		t.Errorf("writing through a loop of links returned %v, expected a NativeError", err)
+	}
+}
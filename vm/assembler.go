@@ -2,19 +2,36 @@ package vm
 
 import (
 	"fmt"
-	"os"
-	"regexp"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
+	"unicode"
 )
 
-// Each instruction is on a seperate lines
+// Each instruction is on a seperate line
 // lines that start with a '#' are commented and are ignored
 // if the first word on a line is suffixed with a colon,
 // then the label is replaced with the current ip and all instances
-// of that label are replaced by the literal address
-
-var labels = map[string]int{}
+// of that label are replaced by the literal address.
+//
+// A label starting with a '.', such as .loop, is local to the
+// function marked by the label before it, so each function may
+// have its own .loop. Numeric labels such as 1 may be defined
+// any number of times, 1b referring to the nearest definition
+// before and 1f to the nearest definition after
+//
+// Lines whose first word starts with a '.' are directives:
+//
+//	.const NAME value     names a literal operand
+//	.global name          names the next free global slot
+//	.include "file"       assembles another file in its place
+//	.macro name a b       starts a macro with parameters a and b,
+//	...                   whose statements up to the .endm are
+//	.endm                 expanded wherever name is used
+//	.locals n, acc        names the slots of a function for
+//	                      fetch, store and capture, from 0
 
 var instructionOperand = map[string]int{
 	"halt":   0,
@@ -32,14 +49,111 @@ var instructionOperand = map[string]int{
 	"or":     0,
 	"xor":    0,
 	"ifeq":   1,
-	"lt":     1,
-	"lte":    1,
-	"gt":     1,
-	"gte":    1,
+	"iflt":   1,
+	"iflte":  1,
+	"ifgt":   1,
+	"ifgte":  1,
 	"goto":   1,
 	"print":  0, // temporary instruction
 	"call":   2,
 	"ret":    0,
+	"eq":     0,
+	"neq":    0,
+	"lt":     0,
+	"lte":    0,
+	"gt":     0,
+	"gte":    0,
+	"not":    0,
+	"jmpt":   1,
+	"jmpf":   1,
+	"list":   1,
+	"get":    0,
+	"set":    0,
+	"append": 0,
+	"len":    0,
+	"slice":  0,
+	"iter":   0,
+	"next":   1,
+	"map":    1,
+	"delete": 0,
+	"has":    0,
+
+	"gdefine": 1,
+	"enter":   1,
+
+	"closure":   3,
+	"capture":   1,
+	"captureup": 1,
+	"ufetch":    1,
+	"ustore":    1,
+	"callv":     1,
+
+	"entity":   2,
+	"method":   1,
+	"getfield": 1,
+	"setfield": 1,
+
+	"module": 2,
+
+	"callnative": 2,
+}
+
+// Diagnostic describes an error found in assembly source
+type Diagnostic struct {
+	File    string // File the error was found in, empty for the source passed to Assemble
+	Line    int    // Line number, starting at 1
+	Column  int    // Column in runes, starting at 1
+	Token   string // Offending token
+	Message string
+	Excerpt string // Source line with the token underlined
+}
+
+func (d Diagnostic) String() string {
+	if d.File != "" {
+		return fmt.Sprintf("%s:%d:%d: %s\n%s", d.File, d.Line, d.Column, d.Message, d.Excerpt)
+	}
+	return fmt.Sprintf("%d:%d: %s\n%s", d.Line, d.Column, d.Message, d.Excerpt)
+}
+
+// source is a file of assembly, or the string passed to Assemble
+type source struct {
+	path  string
+	lines []string
+}
+
+// token is a word or string literal read from the source
+type token struct {
+	text   string
+	line   int
+	column int
+	source *source
+}
+
+// macro is a sequence of statements defined by .macro and .endm,
+// whose parameters are replaced by the operands it is invoked with
+type macro struct {
+	params []string
+	body   [][]token
+}
+
+// assembler holds the state of a single call to Assemble
+type assembler struct {
+	sources     []*source
+	statements  [][]token  // Instructions in the order they are assembled
+	names       [][]string // Labels marking each statement
+	scopes      []string   // Function containing each statement
+	pending     []string   // Labels marking the next statement
+	labels      map[string]int
+	numeric     map[string][]int // Addresses of each numeric label, in order
+	scope       string           // Label of the function being assembled
+	slots       map[string]map[string]int
+	locals      []token // Names given by .locals, checked once every label is known
+	symbols     map[string]Value
+	macros      map[string]*macro
+	globals     int      // Number of global slots named by .global
+	including   []string // Files being included, to detect cycles
+	expanding   []string // Macros being expanded, to detect recursion
+	diagnostics []Diagnostic
 }
 
 func indexOf(element string, elements []string) int {
@@ -51,189 +165,658 @@ func indexOf(element string, elements []string) int {
 	return -1
 }
 
-func isNumber(token string) bool {
-	r, err := regexp.Compile(`(\d+(\.\d+)?)`)
-	if err != nil {
-		fmt.Println("Assembler: Internal Error")
-		os.Exit(1)
-	}
-	return r.MatchString(token)
+func isQuote(char rune) bool {
+	return char == '"'
 }
 
-func isWord(char string) bool {
-	r, err := regexp.Compile(`(\S+)`)
-	if err != nil {
-		fmt.Println("Assembler: Internal Error")
-		os.Exit(1)
-	}
-
-	return r.MatchString(char)
+func isComment(char rune) bool {
+	return char == '#'
 }
 
-func isQuote(char string) bool {
-	return char == `"`
+// isSeparator reports whether char separates tokens,
+// allowing operands to be written as call fact, 1
+func isSeparator(char rune) bool {
+	return unicode.IsSpace(char) || char == ','
 }
 
-func isNotQuote(char string) bool {
-	return char != `"`
+// errorf records a diagnostic pointing at tok
+func (a *assembler) errorf(tok token, format string, args ...interface{}) {
+	line := tok.source.lines[tok.line-1]
+
+	// Underline using the same whitespace as the source so
+	// that tabs line up with the excerpt
+	var caret strings.Builder
+	for i, r := range []rune(line) {
+		if i >= tok.column-1 {
+			break
+		}
+		if r == '\t' {
+			caret.WriteRune('\t')
+		} else {
+			caret.WriteRune(' ')
+		}
+	}
+	width := len([]rune(tok.text))
+	if width < 1 {
+		width = 1
+	}
+	caret.WriteString(strings.Repeat("^", width))
+
+	a.diagnostics = append(a.diagnostics, Diagnostic{
+		File:    tok.source.path,
+		Line:    tok.line,
+		Column:  tok.column,
+		Token:   tok.text,
+		Message: fmt.Sprintf(format, args...),
+		Excerpt: "    " + line + "\n    " + caret.String(),
+	})
 }
 
-func tokenize(source string) []string {
-	var tokens []string
-	var ip int
+// tokenize splits a line of source into words and string literals,
+// dropping anything after a comment
+func (a *assembler) tokenize(src *source, number int) []token {
+	var tokens []token
+	line := []rune(src.lines[number-1])
 	current := 0
 
-	// Remove unecessary whitespace
-	source = strings.Replace(source, "\n", " ; ", -1)
-	source = strings.Replace(source, "\t", " ", -1)
-	source += "\n"
+	for current < len(line) {
+		char := line[current]
 
-	for current < len([]rune(source)) {
-		char := string([]rune(source)[current])
-
-		if char == " " {
+		if isSeparator(char) {
 			current++
 			continue
 		}
 
-		if char == ";" {
-			ip++
-			current++
-			continue
+		if isComment(char) {
+			break
 		}
 
-		if char == "#" {
+		start := current
+		if isQuote(char) {
 			current++
-			for char != ";" {
+			for current < len(line) && !isQuote(line[current]) {
+				if line[current] == '\\' {
+					current++
+				}
+				current++
+			}
+			if current > len(line) {
+				current = len(line)
+			}
+
+			tok := token{
+				text:   string(line[start:current]),
+				line:   number,
+				column: start + 1,
+				source: src,
+			}
+			if current == len(line) {
+				a.errorf(tok, "unterminated string")
+			} else {
 				current++
-				char = string([]rune(source)[current])
 			}
 
+			tok.text += `"`
+			tokens = append(tokens, tok)
+			continue
+		}
+
+		for current < len(line) && !isSeparator(line[current]) {
 			current++
+		}
+		tokens = append(tokens, token{
+			text:   string(line[start:current]),
+			line:   number,
+			column: start + 1,
+			source: src,
+		})
+	}
+
+	return tokens
+}
+
+// expand reads the statements of a source, following its
+// directives, collecting macros and including other files
+func (a *assembler) expand(src *source) {
+	a.sources = append(a.sources, src)
+	for number := 1; number <= len(src.lines); number++ {
+		tokens := a.tokenize(src, number)
+		if len(tokens) > 0 && tokens[0].text == ".macro" {
+			number = a.macro(src, number, tokens)
 			continue
 		}
+		a.statement(tokens)
+	}
+}
 
-		if isQuote(char) {
-			value := ""
+// statement records the labels at the start of a line, and then
+// either follows a directive, expands a macro or records an
+// instruction to be decoded once every label is known
+func (a *assembler) statement(tokens []token) {
+	for len(tokens) > 0 && strings.HasSuffix(tokens[0].text, ":") {
+		a.label(tokens[0])
+		tokens = tokens[1:]
+	}
 
-			current++
-			char = string([]rune(source)[current])
+	if len(tokens) == 0 {
+		return
+	}
 
-			for isNotQuote(char) {
-				value += char
-				current++
-				char = string([]rune(source)[current])
-			}
+	first := tokens[0]
+	if m, ok := a.macros[first.text]; ok {
+		a.invoke(first, m, tokens[1:])
+		return
+	}
 
-			current++
-			value = `"` + value + `"`
+	switch first.text {
+	case ".const":
+		a.constant(tokens)
+	case ".global":
+		a.global(tokens)
+	case ".include":
+		a.include(tokens)
+	case ".locals":
+		a.local(tokens)
+	case ".endm":
+		a.errorf(first, ".endm without .macro")
+	default:
+		if strings.HasPrefix(first.text, ".") {
+			a.errorf(first, "unknown directive %s", first.text)
+			return
+		}
+		a.statements = append(a.statements, tokens)
+		a.names = append(a.names, a.pending)
+		a.scopes = append(a.scopes, a.scope)
+		a.pending = nil
+	}
+}
 
-			tokens = append(tokens, value)
-			continue
+// label records the address of the next statement. Labels
+// without a '.' start a function, which local labels and
+// the names given by .locals belong to
+func (a *assembler) label(tok token) {
+	name := strings.TrimSuffix(tok.text, ":")
+	address := len(a.statements)
+
+	if isNumeric(name) {
+		a.numeric[name] = append(a.numeric[name], address)
+		return
+	}
+
+	local := strings.HasPrefix(name, ".")
+	if local {
+		name = a.scope + name
+	}
+	if literals[name] {
+		a.errorf(tok, "%s is a literal and cannot be a label", name)
+		return
+	}
+	if !isLabel(strings.Replace(name, ".", "", -1)) {
+		a.errorf(tok, "invalid label %s", tok.text)
+		return
+	}
+	if _, ok := a.labels[name]; ok {
+		a.errorf(tok, "label %s is already defined", name)
+		return
+	}
+
+	if !local && !strings.Contains(name, ".") {
+		a.scope = name
+	}
+	a.labels[name] = address
+	a.pending = append(a.pending, name)
+}
+
+// declare checks that a directive names a new symbol
+func (a *assembler) declare(tok token) bool {
+	if literals[tok.text] {
+		a.errorf(tok, "%s is a literal and cannot be a name", tok.text)
+		return false
+	} else if !isLabel(tok.text) {
+		a.errorf(tok, "invalid name %s", tok.text)
+		return false
+	}
+	_, symbol := a.symbols[tok.text]
+	_, macro := a.macros[tok.text]
+	if symbol || macro || indexOf(tok.text, Instructions) != -1 {
+		a.errorf(tok, "%s is already defined", tok.text)
+		return false
+	}
+	return true
+}
+
+// constant follows .const NAME value, which names a literal
+func (a *assembler) constant(tokens []token) {
+	if len(tokens) != 3 {
+		a.errorf(tokens[0], "wrong number of operands for .const: expected 2, found %d", len(tokens)-1)
+		return
+	}
+
+	if value, ok := a.parseLiteral(tokens[2]); ok && a.declare(tokens[1]) {
+		a.symbols[tokens[1].text] = value
+	}
+}
+
+// global follows .global name, which names the next free global
+// slot so that it can be used by gstore and gfetch
+func (a *assembler) global(tokens []token) {
+	if len(tokens) != 2 {
+		a.errorf(tokens[0], "wrong number of operands for .global: expected 1, found %d", len(tokens)-1)
+		return
+	}
+
+	if a.declare(tokens[1]) {
+		a.symbols[tokens[1].text] = Value{Kind: NumberValue, Content: float64(a.globals)}
+		a.globals++
+	}
+}
+
+// local follows .locals a, b, naming the slots of the current
+// function fetched and stored by those names. The slots are
+// numbered from 0, after any named by previous .locals
+func (a *assembler) local(tokens []token) {
+	if a.scope == "" {
+		a.errorf(tokens[0], ".locals must follow the label of a function")
+		return
+	}
+
+	slots, ok := a.slots[a.scope]
+	if !ok {
+		slots = map[string]int{}
+		a.slots[a.scope] = slots
+	}
+	for _, tok := range tokens[1:] {
+		if _, ok := slots[tok.text]; ok {
+			a.errorf(tok, "local %s is already defined", tok.text)
+		} else if literals[tok.text] {
+			a.errorf(tok, "%s is a literal and cannot be a name", tok.text)
+		} else if !isLabel(tok.text) {
+			a.errorf(tok, "invalid name %s", tok.text)
+		} else {
+			slots[tok.text] = len(slots)
+			a.locals = append(a.locals, tok)
 		}
+	}
+}
 
-		if isWord(char) {
-			value := ""
+// clashes reports the names given by .locals which are also
+// labels or symbols, as they would be hidden in fetch and store
+func (a *assembler) clashes() {
+	for _, tok := range a.locals {
+		if _, ok := a.labels[tok.text]; ok {
+			a.errorf(tok, "local %s has the same name as a label", tok.text)
+		} else if _, ok := a.symbols[tok.text]; ok {
+			a.errorf(tok, "local %s has the same name as a symbol", tok.text)
+		}
+	}
+}
 
-			for isWord(char) {
-				value += char
-				current++
-				char = string([]rune(source)[current])
-			}
+// include follows .include "path", assembling another file in
+// place of the directive. Paths are relative to the including
+// file, and a file may not include itself through any other
+func (a *assembler) include(tokens []token) {
+	if len(tokens) != 2 || !strings.HasPrefix(tokens[1].text, `"`) {
+		a.errorf(tokens[0], ".include expects the path of a file as a string")
+		return
+	}
 
-			if strings.HasSuffix(value, ":") {
-				label := strings.TrimSuffix(value, ":")
-				labels[label] = ip
-			} else {
-				tokens = append(tokens, value)
-			}
+	name, err := strconv.Unquote(tokens[1].text)
+	if err != nil {
+		a.errorf(tokens[1], "invalid escape sequence in string")
+		return
+	}
+
+	path := name
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(filepath.Dir(tokens[0].source.path), name)
+	}
+
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		a.errorf(tokens[1], "cannot include %s: %s", name, err)
+		return
+	}
+	if n := indexOf(abs, a.including); n != -1 {
+		chain := append(append([]string{}, a.including[n:]...), abs)
+		for i := range chain {
+			chain[i] = filepath.Base(chain[i])
+		}
+		a.errorf(tokens[1], "include cycle: %s", strings.Join(chain, " -> "))
+		return
+	}
+
+	dat, err := ioutil.ReadFile(path)
+	if err != nil {
+		a.errorf(tokens[1], "cannot include %s: file not found", name)
+		return
+	}
+
+	a.including = append(a.including, abs)
+	a.expand(newSource(path, string(dat)))
+	a.including = a.including[:len(a.including)-1]
+}
+
+// macro collects the statements of a macro up to its .endm,
+// returning the number of the line the macro ends on
+func (a *assembler) macro(src *source, number int, tokens []token) int {
+	start := tokens[0]
+	if len(tokens) < 2 {
+		a.errorf(start, ".macro expects a name")
+	}
+
+	m := &macro{}
+	for i := 2; i < len(tokens); i++ {
+		param := tokens[i]
+		if !isLabel(param.text) {
+			a.errorf(param, "invalid parameter %s", param.text)
+		}
+		m.params = append(m.params, param.text)
+	}
 
+	for number++; number <= len(src.lines); number++ {
+		body := a.tokenize(src, number)
+		if len(body) == 0 {
 			continue
 		}
-		break
+
+		switch body[0].text {
+		case ".endm":
+			if len(tokens) >= 2 && a.declare(tokens[1]) {
+				a.macros[tokens[1].text] = m
+			}
+			return number
+		case ".macro":
+			a.errorf(body[0], "macros cannot be defined inside another macro")
+		default:
+			m.body = append(m.body, body)
+		}
 	}
 
-	return tokens
+	a.errorf(start, "missing .endm")
+	return number
 }
 
-func parseOperand(token string) Value {
-	// Is operand a string?
-	if token == "nil" {
-		return Nil
-	} else if strings.HasPrefix(token, "\"") && strings.HasSuffix(token, "\"") {
-		innerString := strings.TrimSuffix(strings.TrimPrefix(token, "\""), "\"")
-		return Value{
-			Kind:    StringValue,
-			Content: innerString,
+// invoke expands a macro in place, replacing each
+// parameter in its body with the matching operand
+func (a *assembler) invoke(name token, m *macro, args []token) {
+	if len(args) != len(m.params) {
+		a.errorf(name, "wrong number of operands for %s: expected %d, found %d", name.text, len(m.params), len(args))
+		return
+	}
+	if indexOf(name.text, a.expanding) != -1 {
+		a.errorf(name, "macro %s expands itself", name.text)
+		return
+	}
+
+	a.expanding = append(a.expanding, name.text)
+	for _, body := range m.body {
+		tokens := make([]token, len(body))
+		for i, tok := range body {
+			tokens[i] = tok
+			if n := indexOf(tok.text, m.params); n != -1 {
+				tokens[i].text = args[n].text
+			}
 		}
-	} else if isNumber(token) {
-		val, err := strconv.ParseFloat(token, 64)
+		a.statement(tokens)
+	}
+	a.expanding = a.expanding[:len(a.expanding)-1]
+}
+
+// parseLiteral converts a literal or named constant into a Value
+func (a *assembler) parseLiteral(tok token) (Value, bool) {
+	if tok.text == "nil" {
+		return Nil, true
+	}
+
+	if tok.text == "true" || tok.text == "false" {
+		return Value{
+			Kind:    BoolValue,
+			Content: tok.text == "true",
+		}, true
+	}
+
+	if strings.HasPrefix(tok.text, `"`) {
+		str, err := strconv.Unquote(tok.text)
 		if err != nil {
-			fmt.Println("Assembler: Couldn't parse float")
-			os.Exit(1)
+			a.errorf(tok, "invalid escape sequence in string")
+			return Nil, false
 		}
+		return Value{
+			Kind:    StringValue,
+			Content: str,
+		}, true
+	}
+
+	if value, ok := a.symbols[tok.text]; ok {
+		return value, true
+	}
+
+	if val, err := strconv.ParseFloat(tok.text, 64); err == nil {
 		return Value{
 			Kind:    NumberValue,
 			Content: val,
+		}, true
+	}
+
+	if isLabel(tok.text) {
+		a.errorf(tok, "undefined name %s", tok.text)
+	} else {
+		a.errorf(tok, "could not parse operand %s", tok.text)
+	}
+	return Nil, false
+}
+
+// parseOperand converts an operand of a statement into a Value,
+// resolving labels to the address of the instruction they mark
+// and, if the operand is a local slot, the names of local slots
+// to their number
+func (a *assembler) parseOperand(tok token, statement int, local bool) (Value, bool) {
+	scope := a.scopes[statement]
+	if slot, ok := a.slots[scope][tok.text]; ok && local {
+		return Value{Kind: NumberValue, Content: float64(slot)}, true
+	}
+
+	name := tok.text
+	if strings.HasPrefix(name, ".") {
+		name = scope + name
+	}
+	if ip, ok := a.labels[name]; ok {
+		return Value{Kind: NumberValue, Content: float64(ip)}, true
+	}
+
+	if ip, ok := a.reference(tok.text, statement); ok {
+		return Value{Kind: NumberValue, Content: float64(ip)}, true
+	} else if n := len(tok.text) - 1; n > 0 && isNumeric(tok.text[:n]) && (tok.text[n] == 'b' || tok.text[n] == 'f') {
+		a.errorf(tok, "undefined label %s", tok.text)
+		return Nil, false
+	}
+
+	if strings.HasPrefix(tok.text, ".") {
+		a.errorf(tok, "undefined label %s", name)
+		return Nil, false
+	}
+	return a.parseLiteral(tok)
+}
+
+// reference resolves a numeric label such as 1b or 1f, used
+// by a statement, to its nearest definition before or after
+func (a *assembler) reference(ref string, statement int) (int, bool) {
+	n := len(ref) - 1
+	if n < 1 || !isNumeric(ref[:n]) {
+		return 0, false
+	}
+
+	addresses := a.numeric[ref[:n]]
+	switch ref[n] {
+	case 'b':
+		for i := len(addresses) - 1; i >= 0; i-- {
+			if addresses[i] <= statement {
+				return addresses[i], true
+			}
+		}
+	case 'f':
+		for _, address := range addresses {
+			if address > statement {
+				return address, true
+			}
 		}
 	}
-	fmt.Printf("Assembler: Could not parse operand: %s\n", token)
-	os.Exit(1)
+	return 0, false
+}
 
-	return Nil // Will never return
+// isNumeric reports whether s is the name of a numeric label
+func isNumeric(s string) bool {
+	for _, r := range s {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+	return s != ""
 }
 
-// Assemble scans a source string into a slice of
-// instructions that can be fed into a vm instance
-func Assemble(source string) []*Instruction {
-	var instructions []*Instruction
-	var ip int
-	var count int
-	tokens := tokenize(source)
-
-	// Replace labels through entire program
-	for label, ip := range labels {
-		for index, token := range tokens {
-			if label == token {
-				tokens[index] = strconv.Itoa(ip)
+// literals are the names of literal operands, which may not
+// be used as the names of labels or symbols
+var literals = map[string]bool{
+	"nil":   true,
+	"true":  true,
+	"false": true,
+}
+
+// isLabel reports whether s could be used as the name of a label
+func isLabel(s string) bool {
+	if literals[s] {
+		return false
+	}
+	for i, r := range s {
+		if unicode.IsDigit(r) {
+			if i == 0 {
+				return false
 			}
+		} else if r != '_' && !unicode.IsLetter(r) {
+			return false
+		}
+	}
+	return s != ""
+}
+
+// EntryLabel is the label at which a program starts, if it has one
+const EntryLabel = "main"
+
+// Labels returns the label table of a program, mapping each
+// label to the address of the instruction it marks
+func Labels(program []*Instruction) map[string]int {
+	labels := map[string]int{}
+	for address, instr := range program {
+		for _, label := range instr.Labels {
+			labels[label] = address
 		}
 	}
+	return labels
+}
 
-	fmt.Println(tokens)
+// Entry returns the address a program starts at. An empty name
+// starts at the EntryLabel, or at 0 if the program has no such
+// label. Otherwise name is a label, or a literal address
+func Entry(program []*Instruction, name string) (int, error) {
+	labels := Labels(program)
+	if name == "" {
+		return labels[EntryLabel], nil
+	}
 
-	for count < len(tokens) {
-		// Only increment ip once we've successfully
-		// consumed an instruction
-		token := tokens[count]
+	if address, ok := labels[name]; ok {
+		return address, nil
+	}
+	if address, err := strconv.Atoi(name); err == nil && address >= 0 && address < len(program) {
+		return address, nil
+	}
+	return 0, fmt.Errorf("entry point %s is not a label of the program", name)
+}
 
-		// Is token an opcode
-		if indexOf(token, Instructions) != -1 {
-			var operands []Value
+// Assemble scans a source string into a slice of instructions that
+// can be fed into a vm instance. Every problem found in the source
+// is reported as a Diagnostic, in which case no instructions are
+// returned and the error is non-nil. Files included by the source
+// are found relative to the working directory
+func Assemble(source string) ([]*Instruction, []Diagnostic, error) {
+	return AssembleFile("", source)
+}
 
-			// Skip over operand
-			// count++
+// AssembleFile assembles source read from the file at path,
+// which is used to find the files it includes and to name
+// the file in each Diagnostic
+func AssembleFile(path, source string) ([]*Instruction, []Diagnostic, error) {
+	a := &assembler{
+		labels:  map[string]int{},
+		numeric: map[string][]int{},
+		slots:   map[string]map[string]int{},
+		symbols: map[string]Value{},
+		macros:  map[string]*macro{},
+	}
+	if abs, err := filepath.Abs(path); err == nil && path != "" {
+		a.including = []string{abs}
+	}
 
-			// Determine how many operands are required
-			nops := instructionOperand[token]
+	// First pass follows directives and records the address
+	// of each label so that instructions may jump forwards
+	a.expand(newSource(path, source))
+	a.clashes()
 
-			// Parse Operands
-			for i := 0; i < nops; i++ {
-				count++
-				operands = append(operands, parseOperand(tokens[count]))
-			}
+	// Second pass decodes each instruction and its operands
+	var instructions []*Instruction
+	for i, tokens := range a.statements {
+		mnemonic := tokens[0]
+		opcode := indexOf(mnemonic.text, Instructions)
+		if opcode == -1 {
+			a.errorf(mnemonic, "unknown instruction %s", mnemonic.text)
+			continue
+		}
+
+		nops := instructionOperand[mnemonic.text]
+		if len(tokens)-1 != nops {
+			a.errorf(mnemonic, "wrong number of operands for %s: expected %d, found %d", mnemonic.text, nops, len(tokens)-1)
+			continue
+		}
 
-			// Append to instructions
-			instructions = append(instructions, NewInstruction(
-				Opcode(indexOf(token, Instructions)), operands,
-			))
+		var operands []Value
+		valid := true
+		for n, tok := range tokens[1:] {
+			local := n == 0 && (opcode == int(Fetch) || opcode == int(Store) || opcode == int(Capture))
+			operand, ok := a.parseOperand(tok, i, local)
+			valid = valid && ok
+			operands = append(operands, operand)
+		}
 
-			// Increment the ip
-			ip++
+		if valid {
+			instr := NewInstruction(Opcode(opcode), operands)
+			instr.Labels = a.names[i]
+			instr.Line = mnemonic.line
+			instructions = append(instructions, instr)
 		}
+	}
 
-		count++
+	if len(a.diagnostics) > 0 {
+		order := map[string]int{}
+		for i, src := range a.sources {
+			if _, ok := order[src.path]; !ok {
+				order[src.path] = i
+			}
+		}
+		sort.SliceStable(a.diagnostics, func(i, j int) bool {
+			di, dj := a.diagnostics[i], a.diagnostics[j]
+			if fi, fj := order[di.File], order[dj.File]; fi != fj {
+				return fi < fj
+			}
+			return di.Line < dj.Line || di.Line == dj.Line && di.Column < dj.Column
+		})
+		return nil, a.diagnostics, fmt.Errorf("assembler: found %d errors", len(a.diagnostics))
 	}
+	return instructions, nil, nil
+}
 
-	return instructions
+// newSource splits the text of a source into lines
+func newSource(path, text string) *source {
+	return &source{
+		path:  path,
+		lines: strings.Split(strings.Replace(text, "\r\n", "\n", -1), "\n"),
+	}
 }
@@ -0,0 +1,178 @@
+package vm
+
+import "testing"
+
+func TestLocalOperands(t *testing.T) {
+	program, diagnostics, err := Assemble(`
+f:
+    .locals a, b
+    enter 1
+    fetch b
+    store a
+    const 1
+    goto f
+`)
+	if err != nil {
+		t.Fatal(err, diagnostics)
+	}
+
+	want := []float64{1, 1, 0, 1, 0}
+	for i, n := range want {
+		if got := program[i].Operands[0]; got.Kind != NumberValue || got.Content != n {
+			t.Errorf("instruction %d is %s, expected operand %v", i, program[i].Display(), n)
+		}
+	}
+}
+
+// diagnosticTest is a source which fails to assemble with a
+// single diagnostic. The excerpt is only checked if it is given
+type diagnosticTest struct {
+	name    string
+	source  string
+	line    int
+	column  int
+	token   string
+	message string
+	excerpt string
+}
+
+var diagnosticTests = []diagnosticTest{
+	{"unknown instruction", "main:\n    load 1\n", 2, 5, "load", "unknown instruction load",
+		"        load 1\n        ^^^^"},
+	{"too few operands", "    const\n", 1, 5, "const", "wrong number of operands for const: expected 1, found 0",
+		"        const\n        ^^^^^"},
+	{"too many operands", "    add 1 2\n", 1, 5, "add", "wrong number of operands for add: expected 0, found 2",
+		"        add 1 2\n        ^^^"},
+	{"undefined label", "    goto nowhere\n", 1, 10, "nowhere", "undefined name nowhere",
+		"        goto nowhere\n             ^^^^^^^"},
+	{"caret after tabs", "\tgoto\tnowhere\n", 1, 7, "nowhere", "undefined name nowhere",
+		"    \tgoto\tnowhere\n    \t    \t^^^^^^^"},
+	{"undefined local label", "f:\n    goto .loop\n", 2, 10, ".loop", "undefined label f.loop",
+		"        goto .loop\n             ^^^^^"},
+	{"undefined numeric label", "    goto 1f\n1:\n    halt\n    goto 2b\n", 4, 10, "2b", "undefined label 2b", ""},
+	{"invalid operand", "    const 1x\n", 1, 11, "1x", "could not parse operand 1x", ""},
+
+	{"local and constant", ".const LIMIT 10\nf:\n.locals LIMIT\n    const LIMIT\n", 3, 9, "LIMIT", "local LIMIT has the same name as a symbol", ""},
+	{"local and global", ".global count\nf:\n.locals count\n    halt\n", 3, 9, "count", "local count has the same name as a symbol", ""},
+	{"local and label", "f:\n.locals g\n    halt\ng:\n    halt\n", 2, 9, "g", "local g has the same name as a label", ""},
+	{"local outside of slot", "f:\n.locals x\n    const x\n", 3, 11, "x", "undefined name x", ""},
+
+	// Literals cannot name labels or symbols, as operands
+	// naming them would be read as the literal
+	{"true label", "true:\n    halt\n", 1, 1, "true:", "true is a literal and cannot be a label",
+		"    true:\n    ^^^^^"},
+	{"false label", "    halt\n  false:\n", 2, 3, "false:", "false is a literal and cannot be a label",
+		"      false:\n      ^^^^^^"},
+	{"nil label", "nil: halt\n", 1, 1, "nil:", "nil is a literal and cannot be a label",
+		"    nil: halt\n    ^^^^"},
+	{"literal constant", ".const false 1\n", 1, 8, "false", "false is a literal and cannot be a name",
+		"    .const false 1\n           ^^^^^"},
+	{"literal global", ".global nil\n", 1, 9, "nil", "nil is a literal and cannot be a name",
+		"    .global nil\n            ^^^"},
+	{"literal macro", ".macro true\n.endm\n", 1, 8, "true", "true is a literal and cannot be a name",
+		"    .macro true\n           ^^^^"},
+	{"literal local", "f:\n.locals a, true\n", 2, 12, "true", "true is a literal and cannot be a name",
+		"    .locals a, true\n               ^^^^"},
+}
+
+func checkDiagnostics(t *testing.T, tests []diagnosticTest) {
+	for _, test := range tests {
+		_, diagnostics, err := Assemble(test.source)
+		if err == nil || len(diagnostics) != 1 {
+			t.Errorf("%s: found %v, expected %q", test.name, diagnostics, test.message)
+			continue
+		}
+
+		d := diagnostics[0]
+		if d.Message != test.message {
+			t.Errorf("%s: found %q, expected %q", test.name, d.Message, test.message)
+		}
+		if d.Line != test.line || d.Column != test.column || d.Token != test.token {
+			t.Errorf("%s: found %q at %d:%d, expected %q at %d:%d", test.name, d.Token, d.Line, d.Column, test.token, test.line, test.column)
+		}
+		if test.excerpt != "" && d.Excerpt != test.excerpt {
+			t.Errorf("%s: excerpt is\n%s\nexpected\n%s", test.name, d.Excerpt, test.excerpt)
+		}
+	}
+}
+
+func TestDiagnostics(t *testing.T) {
+	checkDiagnostics(t, diagnosticTests)
+}
+
+func TestEveryDiagnostic(t *testing.T) {
+	// Every error is reported in one pass, in the order of the source
+	program, diagnostics, err := Assemble("    load 1\n    const\n    goto nowhere\n    halt\n")
+	if err == nil || program != nil {
+		t.Fatalf("assembled %v, %v, expected an error", program, err)
+	}
+
+	lines := []int{1, 2, 3}
+	if len(diagnostics) != len(lines) {
+		t.Fatalf("found %d diagnostics, expected %d: %v", len(diagnostics), len(lines), diagnostics)
+	}
+	for i, line := range lines {
+		if diagnostics[i].Line != line {
+			t.Errorf("diagnostic %d is on line %d, expected line %d", i, diagnostics[i].Line, line)
+		}
+	}
+	if err.Error() != "assembler: found 3 errors" {
+		t.Errorf("error is %q", err)
+	}
+}
+
+func TestLabels(t *testing.T) {
+	program, _, err := Assemble("start:\n    const 1\nmain:\nagain:\n    pop\nf:\n.end:\n    halt\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	labels := Labels(program)
+	want := map[string]int{"start": 0, "main": 1, "again": 1, "f": 2, "f.end": 2}
+	if len(labels) != len(want) {
+		t.Errorf("found labels %v, expected %v", labels, want)
+	}
+	for label, address := range want {
+		if labels[label] != address {
+			t.Errorf("label %s is at %d, expected %d", label, labels[label], address)
+		}
+	}
+}
+
+func TestEntry(t *testing.T) {
+	program, _, err := Assemble("start:\n    const 1\nmain:\n    pop\n    halt\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	withoutMain, _, err := Assemble("    halt\nf:\n    halt\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		program []*Instruction
+		name    string
+		address int
+		ok      bool
+	}{
+		{program, "", 1, true},
+		{program, "main", 1, true},
+		{program, "start", 0, true},
+		{program, "2", 2, true},
+		{program, "0", 0, true},
+		{program, "3", 0, false},
+		{program, "-1", 0, false},
+		{program, "missing", 0, false},
+		{withoutMain, "", 0, true},
+		{withoutMain, "f", 1, true},
+		{withoutMain, "main", 0, false},
+	}
+	for _, test := range tests {
+		address, err := Entry(test.program, test.name)
+		if test.ok && (err != nil || address != test.address) {
+			t.Errorf("entry %q is %d, %v, expected %d", test.name, address, err, test.address)
+		} else if !test.ok && err == nil {
+			t.Errorf("entry %q is %d, expected an error", test.name, address)
+		}
+	}
+}
@@ -22,14 +22,48 @@ var Instructions = []string{
 	"or",
 	"xor",
 	"ifeq",
-	"lt",
-	"lte",
-	"gt",
-	"gte",
+	"iflt",
+	"iflte",
+	"ifgt",
+	"ifgte",
 	"goto",
 	"print", // temporary instruction
 	"call",
 	"ret",
+	"eq",
+	"neq",
+	"lt",
+	"lte",
+	"gt",
+	"gte",
+	"not",
+	"jmpt",
+	"jmpf",
+	"list",
+	"get",
+	"set",
+	"append",
+	"len",
+	"slice",
+	"iter",
+	"next",
+	"map",
+	"delete",
+	"has",
+	"gdefine",
+	"enter",
+	"closure",
+	"capture",
+	"captureup",
+	"ufetch",
+	"ustore",
+	"callv",
+	"entity",
+	"method",
+	"getfield",
+	"setfield",
+	"module",
+	"callnative",
 }
 
 // Instruction declarations
@@ -37,8 +71,8 @@ const (
 	Halt Opcode = iota
 
 	Const  // Pushes constant onto stack
-	Store  // Stores top of stack into local variable
-	Fetch  // Pushes local variable onto stack
+	Store  // Stores top of stack into argument or local variable
+	Fetch  // Pushes argument or local variable onto stack
 	GStore // Pops item and creates as a global
 	GFetch // Pushes items from globals onto stack
 	Pop    // Pop Item from stack
@@ -52,6 +86,8 @@ const (
 	Xor // Bitwise XOR
 
 	// Control Instructions
+	// Comparisons pop the top item a and then b, jumping
+	// to their operand if b compares to a (as in b < a)
 	IfEqual
 	IfLessThan
 	IfLessThanOrEqual
@@ -64,13 +100,73 @@ const (
 	// Function Instructions
 	Call // location, n args
 	Return
+
+	// Boolean Instructions
+	// Comparisons pop the top item a and then b, pushing
+	// whether b compares to a (as in b < a)
+	Equal              // Pushes true if both items are identical
+	NotEqual           // Pushes true if the items differ
+	LessThan           // Numbers or strings only
+	LessThanOrEqual    // Numbers or strings only
+	GreaterThan        // Numbers or strings only
+	GreaterThanOrEqual // Numbers or strings only
+	Not                // Pushes the inverse truthiness of the top item
+	JumpIfTrue         // Pops item and jumps to operand if truthy
+	JumpIfFalse        // Pops item and jumps to operand if not truthy
+
+	// Collection Instructions
+	MakeList // Pops n items into a new list, in the order they were pushed
+	Get      // Pops index then collection, pushes the indexed item
+	Set      // Pops item, index then collection, replacing the indexed item
+	Append   // Pops item then list, adding the item to the end of the list
+	Length   // Pops collection, pushes the number of items it holds
+	Slice    // Pops end, start then collection, pushes a copy of the items between
+	Iter     // Pops collection, pushes an iterator over its items
+	Next     // Pushes the next item of the iterator on top of the stack or pops it and jumps to operand once done
+	MakeMap  // Pops n key and item pairs into a new map, in the order they were pushed
+	Delete   // Pops key then map, removing the key from the map
+	Has      // Pops key then map, pushes whether the map holds the key
+
+	GDefine // Pops item and creates as a constant global, which cannot be stored to again
+	Enter   // Reserves n local slots in the current frame, initialised to nil
+
+	// Closure Instructions
+	MakeClosure // location, arity, name: pushes a new function value
+	Capture     // Adds local n of the current frame to the upvalues of the function on top of the stack
+	CaptureUp   // Adds upvalue n of the running closure to the upvalues of the function on top of the stack
+	UFetch      // Pushes upvalue n of the running closure onto stack
+	UStore      // Stores top of stack into upvalue n of the running closure
+	CallValue   // Pops a function or entity value then calls it with the n items beneath as arguments
+
+	// Entity Instructions
+	MakeEntity // n, name: pops n field names into a new entity
+	Method     // name: pops function then entity, declaring the function as a method of the entity
+	GetField   // name: pops instance or module, pushes its field, bound method or export
+	SetField   // name: pops item then instance, replacing the field of the instance
+
+	MakeModule // n, name: pops n name and item pairs into a new module exporting them
+
+	CallNative // name, n: pops n arguments, pushes the result of the native function registered as name
 )
 
+// IsBranch reports whether the first operand of the opcode
+// is the address of another instruction
+func (op Opcode) IsBranch() bool {
+	switch op {
+	case IfEqual, IfLessThan, IfLessThanOrEqual, IfGreaterThan, IfGreaterThanOrEqual, Goto, Call,
+		JumpIfTrue, JumpIfFalse, Next, MakeClosure:
+		return true
+	}
+	return false
+}
+
 // Instruction is an Opcode and optional Operand(s)
 type Instruction struct {
 	Code     Opcode
 	Operands []Value
 	Index    int
+	Labels   []string // Labels marking the address of this instruction
+	Line     int      // Source line the instruction came from, 0 if unknown
 }
 
 // NewInstruction returns reference to a Instruction
@@ -98,19 +194,24 @@ func (i *Instruction) Display() string {
 			line += op.Content.(string)
 		} else if op.Kind == NumberValue {
 			line += fmt.Sprintf("%.2f", op.Content.(float64))
+		} else if op.Kind == BoolValue {
+			line += fmt.Sprint(op.Content.(bool))
 		}
 	}
 
 	return line
 }
 
-// NextOperand returns the next operand within the instruction
+// NextOperand returns the next operand within the instruction,
+// starting again from the first after the last has been read
 func (i *Instruction) NextOperand() Value {
-	if i.Index < len(i.Operands)-1 {
-		i.Index++
-	} else {
+	if len(i.Operands) == 0 {
+		return Nil
+	}
+	if i.Index >= len(i.Operands) {
 		i.Index = 0
 	}
 	val := i.Operands[i.Index]
+	i.Index++
 	return val
 }
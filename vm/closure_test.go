@@ -0,0 +1,75 @@
+package vm
+
+import "testing"
+
+// makeCounter calls counter, which returns a closure over its
+// local count. Each call of the closure adds one to count
+const makeCounter = `call counter 0
+goto 1f
+counter:
+	enter 1
+	const 0
+	store 0
+	closure next 0 "next"
+	capture 0
+	ret
+next:
+	enter 0
+	ufetch 0
+	const 1
+	add
+	ustore 0
+	ufetch 0
+	ret
+1:
+`
+
+// outer returns a closure which returns a closure
+// over the local of outer, captured through both
+const nested = `call outer 0
+callv 0
+callv 0
+goto 1f
+outer:
+	enter 1
+	const "x"
+	store 0
+	closure middle 0 "middle"
+	capture 0
+	ret
+middle:
+	enter 0
+	closure inner 0 "inner"
+	captureup 0
+	ret
+inner:
+	enter 0
+	ufetch 0
+	ret
+1:
+`
+
+var closureTests = []programTest{
+	{"closure", `closure f 2 "f"` + "\nf:", "<fun f/2>", -1},
+	{"callv", `const 2` + "\n" + `closure f 1 "f"` + "\ncallv 1\ngoto 1f\nf:\n\tenter 0\n\tfetch 0\n\tconst 1\n\tadd\n\tret\n1:", "3", -1},
+	{"upvalue", makeCounter + "callv 0", "1", -1},
+	{"closed upvalue", makeCounter + "gstore 0\ngfetch 0\ncallv 0\npop\ngfetch 0\ncallv 0", "2", -1},
+	{"separate upvalues", makeCounter + "gstore 0\ncall counter 0\ngstore 1\ngfetch 0\ncallv 0\npop\ngfetch 0\ncallv 0\npop\ngfetch 1\ncallv 0", "1", -1},
+	{"captureup", nested, "x", -1},
+
+	{"callv number", "const 1\ncallv 0", "", ValueError},
+	{"callv arity", `closure f 1 "f"` + "\ncallv 0\nf:", "", ValueError},
+	{"callv empty", "callv 0", "", StackError},
+	{"callv missing arguments", `closure f 1 "f"` + "\ncallv 1\nf:", "", StackError},
+	{"closure operands", `closure "f" 0 "f"`, "", CodeError},
+	{"capture number", "enter 1\nconst 1\ncapture 0", "", ValueError},
+	{"capture out of range", "enter 0\n" + `closure f 0 "f"` + "\ncapture 3\nf:", "", CodeError},
+	{"captureup outside closure", "enter 0\n" + `closure f 0 "f"` + "\ncaptureup 0\nf:", "", CodeError},
+	{"ufetch outside closure", "ufetch 0", "", CodeError},
+	{"ustore outside closure", "const 1\nustore 0", "", CodeError},
+	{"ufetch out of range", `closure f 0 "f"` + "\ncallv 0\nf:\n\tenter 0\n\tufetch 0\n\tret", "", CodeError},
+}
+
+func TestClosures(t *testing.T) {
+	checkPrograms(t, closureTests)
+}
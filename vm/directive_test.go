@@ -0,0 +1,155 @@
+package vm
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+var directiveTests = []programTest{
+	{"const number", ".const N 5\nconst N", "5", -1},
+	{"const string", ".const S \"hi\"\nconst S", "hi", -1},
+	{"const literal", ".const NOTHING nil\n.const YES true\nconst NOTHING\nconst YES\nlist 2", "[nil, true]", -1},
+	{"const operand", ".const N 2\nconst 1\nconst 2\nlist N", "[1, 2]", -1},
+	{"const before use", "const N\n.const N 3", "3", -1},
+	{"global", ".global a\n.global b\nconst 1\ngstore b\ngfetch 1", "1", -1},
+	{"global fetch", ".global a\nconst 4\ngstore 0\ngfetch a", "4", -1},
+	{"macro", ".macro push2 x y\n\tconst x\n\tconst y\n.endm\npush2 3 4\nadd", "7", -1},
+	{"macro without parameters", ".macro one\n\tconst 1\n.endm\none\none\nadd", "2", -1},
+	{"macro constant argument", ".const N 2\n.macro twice x\n\tconst x\n\tconst x\n\tadd\n.endm\ntwice N", "4", -1},
+	{"macro string argument", ".macro push x\n\tconst x\n.endm\npush \"a b\"", "a b", -1},
+	{"macro in macro", ".macro one\n\tconst 1\n.endm\n.macro two\n\tone\n\tone\n\tadd\n.endm\ntwo\ntwo\nadd", "4", -1},
+	{"macro labels", ".macro skip\n\tgoto 1f\n\tconst 0\n1:\n.endm\nconst 1\nskip\nskip", "1", -1},
+	{"locals", "call f 0\ngoto 1f\nf:\n.locals a, b\n\tenter 2\n\tconst 3\n\tstore b\n\tconst 4\n\tstore a\n\tfetch b\n\tret\n1:", "3", -1},
+	{"more locals", "call f 0\ngoto 1f\nf:\n.locals a\n.locals b\n\tenter 2\n\tconst 5\n\tstore 1\n\tfetch b\n\tret\n1:", "5", -1},
+	{"locals per function", "call g 0\ngoto 1f\nf:\n.locals a, b\n\tenter 2\n\tret\ng:\n.locals b\n\tenter 1\n\tconst 6\n\tstore 0\n\tfetch b\n\tret\n1:", "6", -1},
+}
+
+func TestDirectives(t *testing.T) {
+	checkPrograms(t, directiveTests)
+}
+
+var directiveDiagnosticTests = []diagnosticTest{
+	{"unknown directive", ".foo 1\n", 1, 1, ".foo", "unknown directive .foo", ""},
+	{"const operands", ".const N\n", 1, 1, ".const", "wrong number of operands for .const: expected 2, found 1", ""},
+	{"const value", ".const N 1x\n", 1, 10, "1x", "could not parse operand 1x", ""},
+	{"const redefined", ".const N 1\n.const N 2\n", 2, 8, "N", "N is already defined",
+		"    .const N 2\n           ^"},
+	{"const instruction", ".const add 1\n", 1, 8, "add", "add is already defined", ""},
+	{"invalid name", ".const 1x 1\n", 1, 8, "1x", "invalid name 1x", ""},
+	{"global operands", ".global\n", 1, 1, ".global", "wrong number of operands for .global: expected 1, found 0", ""},
+	{"global redefined", ".const a 1\n.global a\n", 2, 9, "a", "a is already defined", ""},
+	{"locals outside function", ".locals a\n", 1, 1, ".locals", ".locals must follow the label of a function", ""},
+	{"locals redefined", "f:\n.locals a, b\n.locals a\n", 3, 9, "a", "local a is already defined", ""},
+	{"include operand", ".include helpers\n", 1, 1, ".include", ".include expects the path of a file as a string", ""},
+	{"include missing", ".include \"nope.runasm\"\n", 1, 10, "\"nope.runasm\"", "cannot include nope.runasm: file not found",
+		"    .include \"nope.runasm\"\n             ^^^^^^^^^^^^^"},
+
+	// Macros
+	{"too few arguments", ".macro push2 x y\n\tconst x\n\tconst y\n.endm\npush2 1\n", 5, 1, "push2",
+		"wrong number of operands for push2: expected 2, found 1", "    push2 1\n    ^^^^^"},
+	{"too many arguments", ".macro one\n\tconst 1\n.endm\n  one 1 2\n", 4, 3, "one",
+		"wrong number of operands for one: expected 0, found 2", "      one 1 2\n      ^^^"},
+	{"macro name", ".macro\n.endm\n", 1, 1, ".macro", ".macro expects a name", ""},
+	{"macro parameter", ".macro m 1x\n.endm\n", 1, 10, "1x", "invalid parameter 1x", ""},
+	{"literal parameter", ".macro m nil\n.endm\n", 1, 10, "nil", "invalid parameter nil", ""},
+	{"macro redefined", ".macro m\n.endm\n.macro m\n.endm\n", 3, 8, "m", "m is already defined", ""},
+	{"macro instruction", ".macro add\n.endm\n", 1, 8, "add", "add is already defined", ""},
+	{"missing endm", ".macro m\n\tconst 1\n", 1, 1, ".macro", "missing .endm", ""},
+	{"endm without macro", "\tconst 1\n.endm\n", 2, 1, ".endm", ".endm without .macro", ""},
+	{"nested macro", ".macro m\n.macro n\n.endm\n", 2, 1, ".macro", "macros cannot be defined inside another macro", ""},
+	{"recursive macro", ".macro m\n\tm\n.endm\nm\n", 2, 2, "m", "macro m expands itself", ""},
+	{"error in macro", ".macro m\n\tload 1\n.endm\nm\n", 2, 2, "load", "unknown instruction load", ""},
+}
+
+func TestDirectiveDiagnostics(t *testing.T) {
+	checkDiagnostics(t, directiveDiagnosticTests)
+}
+
+// writeFiles writes each file to a temporary directory,
+// returning the directory
+func writeFiles(t *testing.T, files map[string]string) string {
+	dir := t.TempDir()
+	for name, source := range files {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(source), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func assembleFile(t *testing.T, path string) ([]*Instruction, []Diagnostic, error) {
+	dat, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return AssembleFile(path, string(dat))
+}
+
+func TestInclude(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"main.runasm":          ".include \"lib/square.runasm\"\n.include \"lib/square.runasm\"\nmain:\n\tconst N\n\tcall square 1\n\thalt\n",
+		"lib/square.runasm":    ".include \"constants.runasm\"\nsquare:\n\tenter 0\n\tfetch 0\n\tfetch 0\n\tmul\n\tret\n",
+		"lib/constants.runasm": ".const N 7\n",
+	})
+
+	// Including a file twice defines everything in it twice,
+	// which is reported within the included files
+	_, diagnostics, err := assembleFile(t, filepath.Join(dir, "main.runasm"))
+	if err == nil || len(diagnostics) != 2 {
+		t.Fatalf("found %v, expected square and N to be defined twice", diagnostics)
+	}
+	found := map[string]string{}
+	for _, d := range diagnostics {
+		found[d.Message] = fmt.Sprintf("%s:%d", filepath.Base(d.File), d.Line)
+	}
+	want := map[string]string{
+		"label square is already defined": "square.runasm:2",
+		"N is already defined":            "constants.runasm:1",
+	}
+	if !reflect.DeepEqual(found, want) {
+		t.Errorf("found %v, expected %v", found, want)
+	}
+
+	source := ".include \"lib/square.runasm\"\nmain:\n\tconst N\n\tcall square 1\n\thalt\n"
+	program, diagnostics, err := AssembleFile(filepath.Join(dir, "main.runasm"), source)
+	if err != nil {
+		t.Fatal(err, diagnostics)
+	}
+	main, _ := Entry(program, "")
+	r := NewRunner(program, 64, main, false)
+	if err := r.Run(); err != nil {
+		t.Fatal(err)
+	}
+	if stack := r.Stack(); len(stack) != 1 || stack[0] != number(49) {
+		t.Errorf("stack is %v, expected [49]", stack)
+	}
+}
+
+func TestIncludeCycle(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"a.runasm":     ".include \"b.runasm\"\n",
+		"b.runasm":     "\thalt\n.include \"sub/c.runasm\"\n",
+		"sub/c.runasm": ".include \"../a.runasm\"\n",
+	})
+
+	_, diagnostics, err := assembleFile(t, filepath.Join(dir, "a.runasm"))
+	if err == nil || len(diagnostics) != 1 {
+		t.Fatalf("found %v, expected one diagnostic", diagnostics)
+	}
+	d := diagnostics[0]
+	if d.Message != "include cycle: a.runasm -> b.runasm -> c.runasm -> a.runasm" {
+		t.Errorf("found %q", d.Message)
+	}
+	if !strings.HasSuffix(d.File, filepath.Join("sub", "c.runasm")) || d.Line != 1 || d.Column != 10 {
+		t.Errorf("diagnostic at %s:%d:%d, expected c.runasm:1:10", d.File, d.Line, d.Column)
+	}
+}
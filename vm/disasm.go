@@ -0,0 +1,98 @@
+package vm
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Disassemble formats a program as assembly source which
+// Assemble turns back into the same instructions. Every address
+// used by a branch is given a label, keeping any labels the
+// program already carries. A label carried by more than one
+// instruction, such as a function defined by several modules,
+// is suffixed with the address of each after the first
+func Disassemble(program []*Instruction) string {
+	names := make([][]string, len(program)+1)
+	taken := map[string]bool{}
+	for address, instr := range program {
+		for _, label := range instr.Labels {
+			if taken[label] {
+				label = unique(fmt.Sprintf("%s_%04d", label, address), taken)
+			}
+			taken[label] = true
+			names[address] = append(names[address], label)
+		}
+	}
+
+	for _, instr := range program {
+		address, ok := branchTarget(instr, len(program))
+		if !ok || len(names[address]) > 0 {
+			continue
+		}
+
+		label := unique(fmt.Sprintf("L%04d", address), taken)
+		taken[label] = true
+		names[address] = []string{label}
+	}
+
+	var b strings.Builder
+	for address := range names {
+		for _, label := range names[address] {
+			fmt.Fprintf(&b, "%s:\n", label)
+		}
+		if address == len(program) {
+			break
+		}
+
+		instr := program[address]
+		b.WriteString("\t" + Instructions[instr.Code])
+		for i, op := range instr.Operands {
+			if target, ok := branchTarget(instr, len(program)); ok && i == 0 {
+				b.WriteString(" " + names[target][0])
+			} else {
+				b.WriteString(" " + formatOperand(op))
+			}
+		}
+		b.WriteString("\n")
+	}
+
+	return b.String()
+}
+
+// unique returns label, or label suffixed with underscores
+// if it is already taken
+func unique(label string, taken map[string]bool) string {
+	for taken[label] {
+		label += "_"
+	}
+	return label
+}
+
+// branchTarget returns the address an instruction branches to,
+// if it is a valid address within a program of the given length
+func branchTarget(instr *Instruction, length int) (int, bool) {
+	if !instr.Code.IsBranch() || len(instr.Operands) == 0 || instr.Operands[0].Kind != NumberValue {
+		return 0, false
+	}
+
+	f := instr.Operands[0].Content.(float64)
+	if f != math.Trunc(f) || f < 0 || f > float64(length) {
+		return 0, false
+	}
+	return int(f), true
+}
+
+// formatOperand writes a Value as an assembly literal
+func formatOperand(v Value) string {
+	switch v.Kind {
+	case NumberValue:
+		return strconv.FormatFloat(v.Content.(float64), 'g', -1, 64)
+	case StringValue:
+		return strconv.Quote(v.Content.(string))
+	case BoolValue:
+		return strconv.FormatBool(v.Content.(bool))
+	}
+	return "nil"
+}
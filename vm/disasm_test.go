@@ -0,0 +1,107 @@
+package vm_test
+
+import (
+	"io/ioutil"
+	"math"
+	"path/filepath"
+	"testing"
+
+	"github.com/chickencoder/run/compiler"
+	"github.com/chickencoder/run/vm"
+)
+
+// roundTrip checks that disassembling a program and assembling
+// the result gives back the same instructions
+func roundTrip(t *testing.T, name string, program []*vm.Instruction) {
+	text := vm.Disassemble(program)
+	again, diagnostics, err := vm.Assemble(text)
+	if err != nil {
+		t.Errorf("%s: %s\n%v\n%s", name, err, diagnostics, text)
+		return
+	}
+	if len(again) != len(program) {
+		t.Errorf("%s: assembled %d instructions, expected %d", name, len(again), len(program))
+		return
+	}
+
+	for i, instr := range program {
+		got := again[i]
+		if got.Code != instr.Code || len(got.Operands) != len(instr.Operands) {
+			t.Errorf("%s: instruction %d is %s, expected %s", name, i, got.Display(), instr.Display())
+			continue
+		}
+		for n, op := range instr.Operands {
+			if !sameOperand(got.Operands[n], op) {
+				t.Errorf("%s: instruction %d is %s, expected %s", name, i, got.Display(), instr.Display())
+				break
+			}
+		}
+	}
+}
+
+func sameOperand(a, b vm.Value) bool {
+	if a.Kind == vm.NumberValue && b.Kind == vm.NumberValue {
+		return math.Float64bits(a.Content.(float64)) == math.Float64bits(b.Content.(float64))
+	}
+	return a == b
+}
+
+func TestDisassembleRoundTrip(t *testing.T) {
+	paths, err := filepath.Glob(filepath.Join("test", "*.run*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, path := range paths {
+		var program []*vm.Instruction
+		switch filepath.Ext(path) {
+		case ".run":
+			var errs []compiler.Error
+			program, errs = compiler.Load(path, nil)
+			if len(errs) > 0 {
+				t.Errorf("%s: %v", path, errs)
+				continue
+			}
+
+		case ".runasm":
+			dat, err := ioutil.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			program, _, err = vm.AssembleFile(path, string(dat))
+			if err != nil {
+				// Files such as helpers.runasm are only included
+				continue
+			}
+		}
+		roundTrip(t, path, program)
+	}
+}
+
+func TestDisassembleModules(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"main.run":   "import first\nimport second\n\nfun helper() {\n    return 0\n}\n\nprint(first.twice(2) + second.twice(3) + helper())\n",
+		"first.run":  "fun helper(x) {\n    return x * 2\n}\n\nfun twice(x) {\n    return helper(x)\n}\n\nexport twice\n",
+		"second.run": "fun helper(x) {\n    return x + x\n}\n\nfun twice(x) {\n    return helper(x)\n}\n\nexport twice\n",
+	}
+	for name, source := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(source), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	program, errs := compiler.Load(filepath.Join(dir, "main.run"), nil)
+	if len(errs) > 0 {
+		t.Fatal(errs)
+	}
+
+	// Functions of modules are labelled with the module name
+	labels := vm.Labels(program)
+	for _, label := range []string{"helper", "first.helper", "second.helper", "first.twice", "second.twice"} {
+		if _, ok := labels[label]; !ok {
+			t.Errorf("program has no label %s", label)
+		}
+	}
+	roundTrip(t, "main.run", program)
+}
@@ -0,0 +1,293 @@
+package vm
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+)
+
+// Compiled programs are stored in a binary container laid out as
+//
+//	magic     "RUNC"
+//	version   uint16
+//	flags     uint16
+//	constants uvarint count, then a kind byte and payload for each
+//	code      uvarint count, then opcode, operand count and the
+//	          constant pool index of each operand for each instruction
+//	symbols   uvarint count, then name and address for each label
+//	lines     source line of each instruction, if FlagDebugLines is set
+//
+// All integers other than the header are unsigned varints.
+
+// Magic identifies a compiled Run program
+const Magic = "RUNC"
+
+// Version is the revision of the container format written by Encode.
+// Decode rejects files written with any other version
+const Version = 1
+
+// FlagDebugLines is set when the container holds a line table
+const FlagDebugLines = 1 << 0
+
+// Encode serializes a program into the binary container format
+func Encode(program []*Instruction) []byte {
+	var constants []Value
+	index := map[constantKey]int{}
+	var flags uint16
+
+	for _, instr := range program {
+		for _, op := range instr.Operands {
+			if _, ok := index[keyOf(op)]; !ok {
+				index[keyOf(op)] = len(constants)
+				constants = append(constants, op)
+			}
+		}
+		if instr.Line > 0 {
+			flags |= FlagDebugLines
+		}
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString(Magic)
+	binary.Write(&buf, binary.LittleEndian, uint16(Version))
+	binary.Write(&buf, binary.LittleEndian, flags)
+
+	writeUvarint(&buf, len(constants))
+	for _, c := range constants {
+		buf.WriteByte(byte(c.Kind))
+		switch c.Kind {
+		case NumberValue:
+			binary.Write(&buf, binary.LittleEndian, math.Float64bits(c.Content.(float64)))
+		case StringValue:
+			writeString(&buf, c.Content.(string))
+		case BoolValue:
+			if c.Content.(bool) {
+				buf.WriteByte(1)
+			} else {
+				buf.WriteByte(0)
+			}
+		}
+	}
+
+	writeUvarint(&buf, len(program))
+	for _, instr := range program {
+		writeUvarint(&buf, int(instr.Code))
+		writeUvarint(&buf, len(instr.Operands))
+		for _, op := range instr.Operands {
+			writeUvarint(&buf, index[keyOf(op)])
+		}
+	}
+
+	var symbols int
+	for _, instr := range program {
+		symbols += len(instr.Labels)
+	}
+	writeUvarint(&buf, symbols)
+	for address, instr := range program {
+		for _, label := range instr.Labels {
+			writeString(&buf, label)
+			writeUvarint(&buf, address)
+		}
+	}
+
+	if flags&FlagDebugLines != 0 {
+		for _, instr := range program {
+			writeUvarint(&buf, instr.Line)
+		}
+	}
+
+	return buf.Bytes()
+}
+
+// constantKey identifies a constant in the pool. Numbers are
+// keyed by their bits, as NaN is not equal to itself and -0
+// is equal to 0
+type constantKey struct {
+	kind    ValueKind
+	content interface{}
+}
+
+func keyOf(v Value) constantKey {
+	if v.Kind == NumberValue {
+		return constantKey{v.Kind, math.Float64bits(v.Content.(float64))}
+	}
+	return constantKey{v.Kind, v.Content}
+}
+
+// Decode deserializes a program written by Encode
+func Decode(data []byte) ([]*Instruction, error) {
+	if !bytes.HasPrefix(data, []byte(Magic)) {
+		return nil, fmt.Errorf("bytecode: not a compiled Run program")
+	}
+
+	r := &decoder{
+		Reader: bufio.NewReader(bytes.NewReader(data[len(Magic):])),
+		limit:  len(data),
+	}
+	var version, flags uint16
+	if err := binary.Read(r, binary.LittleEndian, &version); err != nil {
+		return nil, decodeError(err)
+	}
+	if version != Version {
+		return nil, fmt.Errorf("bytecode: unsupported version %d, expected version %d", version, Version)
+	}
+	if err := binary.Read(r, binary.LittleEndian, &flags); err != nil {
+		return nil, decodeError(err)
+	}
+
+	count, err := r.uvarint()
+	if err != nil {
+		return nil, err
+	}
+	constants := make([]Value, count)
+	for i := range constants {
+		kind, err := r.ReadByte()
+		if err != nil {
+			return nil, decodeError(err)
+		}
+
+		switch ValueKind(kind) {
+		case NilValue:
+			constants[i] = Nil
+		case NumberValue:
+			var bits uint64
+			if err := binary.Read(r, binary.LittleEndian, &bits); err != nil {
+				return nil, decodeError(err)
+			}
+			constants[i] = Value{Kind: NumberValue, Content: math.Float64frombits(bits)}
+		case StringValue:
+			s, err := r.string()
+			if err != nil {
+				return nil, err
+			}
+			constants[i] = Value{Kind: StringValue, Content: s}
+		case BoolValue:
+			b, err := r.ReadByte()
+			if err != nil {
+				return nil, decodeError(err)
+			}
+			constants[i] = Value{Kind: BoolValue, Content: b != 0}
+		default:
+			return nil, fmt.Errorf("bytecode: unknown constant kind %d", kind)
+		}
+	}
+
+	count, err = r.uvarint()
+	if err != nil {
+		return nil, err
+	}
+	program := make([]*Instruction, count)
+	for i := range program {
+		code, err := r.uvarint()
+		if err != nil {
+			return nil, err
+		}
+		if code >= len(Instructions) {
+			return nil, fmt.Errorf("bytecode: unknown opcode %d at %04d", code, i)
+		}
+
+		nops, err := r.uvarint()
+		if err != nil {
+			return nil, err
+		}
+		if nops != instructionOperand[Instructions[code]] {
+			return nil, fmt.Errorf("bytecode: wrong number of operands for %s at %04d", Instructions[code], i)
+		}
+
+		var operands []Value
+		for j := 0; j < nops; j++ {
+			c, err := r.uvarint()
+			if err != nil {
+				return nil, err
+			}
+			if c >= len(constants) {
+				return nil, fmt.Errorf("bytecode: constant %d out of range at %04d", c, i)
+			}
+			operands = append(operands, constants[c])
+		}
+		program[i] = NewInstruction(Opcode(code), operands)
+	}
+
+	count, err = r.uvarint()
+	if err != nil {
+		return nil, err
+	}
+	for i := 0; i < count; i++ {
+		label, err := r.string()
+		if err != nil {
+			return nil, err
+		}
+		address, err := r.uvarint()
+		if err != nil {
+			return nil, err
+		}
+		if address >= len(program) {
+			return nil, fmt.Errorf("bytecode: label %s out of range", label)
+		}
+		program[address].Labels = append(program[address].Labels, label)
+	}
+
+	if flags&FlagDebugLines != 0 {
+		for _, instr := range program {
+			line, err := binary.ReadUvarint(r)
+			if err != nil {
+				return nil, decodeError(err)
+			}
+			if line > math.MaxInt32 {
+				return nil, fmt.Errorf("bytecode: line %d out of range", line)
+			}
+			instr.Line = int(line)
+		}
+	}
+
+	return program, nil
+}
+
+func decodeError(err error) error {
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return fmt.Errorf("bytecode: %v", err)
+}
+
+func writeUvarint(buf *bytes.Buffer, n int) {
+	var scratch [binary.MaxVarintLen64]byte
+	buf.Write(scratch[:binary.PutUvarint(scratch[:], uint64(n))])
+}
+
+// decoder reads the variable length fields of a container
+type decoder struct {
+	*bufio.Reader
+	limit int // Size of the container, which no count may exceed
+}
+
+func (r *decoder) uvarint() (int, error) {
+	n, err := binary.ReadUvarint(r)
+	if err != nil {
+		return 0, decodeError(err)
+	}
+	if n > uint64(r.limit) {
+		return 0, fmt.Errorf("bytecode: length %d exceeds size of file", n)
+	}
+	return int(n), nil
+}
+
+func writeString(buf *bytes.Buffer, s string) {
+	writeUvarint(buf, len(s))
+	buf.WriteString(s)
+}
+
+func (r *decoder) string() (string, error) {
+	n, err := r.uvarint()
+	if err != nil {
+		return "", err
+	}
+	b := make([]byte, n)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return "", decodeError(err)
+	}
+	return string(b), nil
+}
@@ -0,0 +1,123 @@
+package vm
+
+import (
+	"encoding/binary"
+	"math"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestEncodeConstants(t *testing.T) {
+	numbers := []float64{7, math.NaN(), math.Inf(1), math.Inf(-1), math.Copysign(0, -1), 0, math.NaN()}
+	var program []*Instruction
+	for _, n := range numbers {
+		program = append(program, NewInstruction(Const, []Value{{Kind: NumberValue, Content: n}}))
+	}
+	program = append(program, NewInstruction(Const, []Value{{Kind: StringValue, Content: "7"}}))
+	program = append(program, NewInstruction(Halt, nil))
+
+	decoded, err := Decode(Encode(program))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(decoded) != len(program) {
+		t.Fatalf("decoded %d instructions, expected %d", len(decoded), len(program))
+	}
+
+	for i, n := range numbers {
+		got := decoded[i].Operands[0]
+		if got.Kind != NumberValue {
+			t.Errorf("constant %d: decoded %s value, expected number", i, ValueKinds[got.Kind])
+			continue
+		}
+		if math.Float64bits(got.Content.(float64)) != math.Float64bits(n) {
+			t.Errorf("constant %d: decoded %v, expected %v", i, got.Content, n)
+		}
+	}
+	if got := decoded[len(numbers)].Operands[0]; got.Kind != StringValue || got.Content != "7" {
+		t.Errorf("decoded %v, expected string 7", got.Content)
+	}
+}
+
+// everyOpcode returns a program using every opcode, whose operands
+// cycle through every kind, with branches to a labelled address
+func everyOpcode() []*Instruction {
+	kinds := []Value{
+		Nil,
+		{Kind: BoolValue, Content: true},
+		{Kind: BoolValue, Content: false},
+		{Kind: NumberValue, Content: 2.5},
+		{Kind: StringValue, Content: "text \"quoted\"\n"},
+		{Kind: StringValue, Content: ""},
+	}
+
+	var program []*Instruction
+	n := 0
+	for code, name := range Instructions {
+		operands := make([]Value, instructionOperand[name])
+		for i := range operands {
+			operands[i] = kinds[n%len(kinds)]
+			n++
+		}
+		if Opcode(code).IsBranch() {
+			operands[0] = Value{Kind: NumberValue, Content: float64(0)}
+		}
+
+		instr := NewInstruction(Opcode(code), operands)
+		instr.Line = code + 1
+		program = append(program, instr)
+	}
+	program[0].Labels = []string{"main", "start"}
+	program[len(program)-1].Labels = []string{"end"}
+	return program
+}
+
+func TestEncodeEveryOpcode(t *testing.T) {
+	program := everyOpcode()
+	decoded, err := Decode(Encode(program))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(decoded) != len(program) {
+		t.Fatalf("decoded %d instructions, expected %d", len(decoded), len(program))
+	}
+
+	for i, instr := range program {
+		got := decoded[i]
+		if got.Code != instr.Code || got.Line != instr.Line || !reflect.DeepEqual(got.Labels, instr.Labels) {
+			t.Errorf("instruction %d decoded as %s (line %d, labels %v), expected %s (line %d, labels %v)",
+				i, got.Display(), got.Line, got.Labels, instr.Display(), instr.Line, instr.Labels)
+			continue
+		}
+		if len(got.Operands) != len(instr.Operands) || len(got.Operands) > 0 && !reflect.DeepEqual(got.Operands, instr.Operands) {
+			t.Errorf("instruction %d decoded with operands %v, expected %v", i, got.Operands, instr.Operands)
+		}
+	}
+
+	if address, err := Entry(decoded, "end"); err != nil || address != len(program)-1 {
+		t.Errorf("label end decoded as %d, %v", address, err)
+	}
+}
+
+func TestDecodeVersion(t *testing.T) {
+	data := Encode(everyOpcode())
+	binary.LittleEndian.PutUint16(data[len(Magic):], Version+1)
+
+	_, err := Decode(data)
+	if err == nil || !strings.Contains(err.Error(), "unsupported version") {
+		t.Errorf("decoding version %d returned %v, expected an unsupported version error", Version+1, err)
+	}
+}
+
+func TestDecodeTruncated(t *testing.T) {
+	data := Encode(everyOpcode())
+	for n := 0; n < len(data); n++ {
+		if program, err := Decode(data[:n]); err == nil {
+			t.Fatalf("decoding the first %d of %d bytes returned %d instructions, expected an error", n, len(data), len(program))
+		}
+	}
+	if _, err := Decode([]byte("NOPE")); err == nil {
+		t.Error("decoding a file without the magic returned no error")
+	}
+}
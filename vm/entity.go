@@ -0,0 +1,107 @@
+package vm
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Entity is the content of an EntityValue, describing a record
+// type by its ordered fields and the methods declared on it.
+// Calling an entity constructs a new instance of it
+type Entity struct {
+	Name    string
+	Fields  []string
+	index   map[string]int
+	methods map[string]*Closure
+}
+
+// NewEntity returns an EntityValue with no methods
+func NewEntity(name string, fields []string) Value {
+	index := make(map[string]int, len(fields))
+	for i, field := range fields {
+		index[field] = i
+	}
+	return Value{
+		Kind: EntityValue,
+		Content: &Entity{
+			Name:    name,
+			Fields:  fields,
+			index:   index,
+			methods: map[string]*Closure{},
+		},
+	}
+}
+
+// Instance is the content of an InstanceValue. Like lists,
+// instances live on the heap and are shared by reference
+type Instance struct {
+	Entity *Entity
+	Fields []Value // In the order they are declared by the entity
+}
+
+// Get returns a field of the instance, or one of the methods of
+// its entity bound to the instance
+func (i *Instance) Get(name string) (Value, error) {
+	if n, ok := i.Entity.index[name]; ok {
+		return i.Fields[n], nil
+	}
+
+	if method, ok := i.Entity.methods[name]; ok {
+		bound := *method
+		bound.Arity--
+		bound.Self = &Value{Kind: InstanceValue, Content: i}
+		return Value{Kind: FunctionValue, Content: &bound}, nil
+	}
+	return Nil, fmt.Errorf("%s has no field or method %s", i.Entity.Name, name)
+}
+
+// Set replaces a field of the instance
+func (i *Instance) Set(name string, item Value) error {
+	n, ok := i.Entity.index[name]
+	if !ok {
+		return fmt.Errorf("%s has no field %s", i.Entity.Name, name)
+	}
+	i.Fields[n] = item
+	return nil
+}
+
+// format writes the instance as Animal{mass: 40, ...},
+// eliding any instances in seen which already contain this one
+func (i *Instance) format(seen []interface{}) string {
+	for _, s := range seen {
+		if s == i {
+			return i.Entity.Name + "{...}"
+		}
+	}
+	seen = append(seen, i)
+
+	fields := make([]string, len(i.Fields))
+	for n, item := range i.Fields {
+		fields[n] = i.Entity.Fields[n] + ": " + repr(item, seen)
+	}
+	return i.Entity.Name + "{" + strings.Join(fields, ", ") + "}"
+}
+
+// construct pops the n arguments of a constructor call into
+// a new instance of the entity, one for each field
+func (r *Runner) construct(e *Entity, n int) error {
+	if n != len(e.Fields) {
+		return r.Throw(ValueError, fmt.Sprintf("%s expects %d fields, found %d", e.Name, len(e.Fields), n))
+	}
+	if r.stack.Len() < n {
+		return r.Throw(StackError, fmt.Sprintf("cannot construct %s because stack is empty", e.Name))
+	}
+	if err := r.allocate(headerSize + n*valueSize); err != nil {
+		return err
+	}
+
+	fields := make([]Value, n)
+	for i := n - 1; i >= 0; i-- {
+		fields[i] = r.stack.Pop()
+	}
+	r.stack.Push(Value{
+		Kind:    InstanceValue,
+		Content: &Instance{Entity: e, Fields: fields},
+	})
+	return nil
+}
@@ -0,0 +1,35 @@
+package vm
+
+import "testing"
+
+// animal pushes an entity with the fields mass and species
+const animal = `const "mass"` + "\n" + `const "species"` + "\n" + `entity 2 "Animal"` + "\n"
+
+// dog pushes an instance of animal
+const dog = "const 40\n" + `const "dog"` + "\n" + animal + "callv 2\n"
+
+var entityTests = []programTest{
+	{"entity", animal, "<entity Animal>", -1},
+	{"construct", dog, `Animal{mass: 40, species: "dog"}`, -1},
+	{"getfield", dog + "getfield \"species\"", "dog", -1},
+	{"setfield", dog + "gstore 0\ngfetch 0\nconst 41\nsetfield \"mass\"\ngfetch 0\ngetfield \"mass\"", "41", -1},
+	{"method", animal + "gstore 0\ngfetch 0\n" + `closure f 1 "f"` + "\nmethod \"f\"\nconst 40\n" + `const "dog"` + "\ngfetch 0\ncallv 2\ngetfield \"f\"\ncallv 0\ngoto 1f\nf:\n\tenter 0\n\tfetch 0\n\tgetfield \"species\"\n\tret\n1:", "dog", -1},
+
+	{"construct arity", "const 1\n" + animal + "callv 1", "", ValueError},
+	{"construct empty", animal + "callv 2", "", StackError},
+	{"entity empty", `entity 1 "A"`, "", StackError},
+	{"field name", "const 1\n" + `entity 1 "A"`, "", ValueError},
+	{"getfield missing", dog + "getfield \"legs\"", "", ValueError},
+	{"getfield number", "const 1\ngetfield \"x\"", "", ValueError},
+	{"getfield empty", "getfield \"x\"", "", StackError},
+	{"setfield missing", dog + "const 4\nsetfield \"legs\"", "", ValueError},
+	{"setfield list", "list 0\nconst 4\nsetfield \"x\"", "", ValueError},
+	{"setfield empty", "const 4\nsetfield \"x\"", "", StackError},
+	{"method number", "const 1\n" + `closure f 0 "f"` + "\nmethod \"f\"\nf:", "", ValueError},
+	{"method empty", "method \"f\"", "", StackError},
+	{"method operand", animal + `closure f 0 "f"` + "\nmethod 1\nf:", "", CodeError},
+}
+
+func TestEntities(t *testing.T) {
+	checkPrograms(t, entityTests)
+}
@@ -1,5 +1,10 @@
 package vm
 
+import (
+	"fmt"
+	"strings"
+)
+
 // ErrorKind describes the nature of an error message
 type ErrorKind int
 
@@ -9,10 +14,82 @@ var Errors = []string{
 	"StackError",
 	"ValueError",
 	"CodeError",
+	"NativeError",
+	"CancelError",
+	"BudgetError",
+	"TimeoutError",
+	"LimitError",
+	"PermissionError",
 }
 
 const (
 	StackError ErrorKind = iota
 	ValueError
 	CodeError
+	NativeError     // Returned by a native function
+	CancelError     // The context of the run was cancelled
+	BudgetError     // The run exceeded its budget of instructions
+	TimeoutError    // The run exceeded its timeout or the deadline of its context
+	LimitError      // The run exceeded one of its Limits
+	PermissionError // A native was denied a capability it requires
 )
+
+func (k ErrorKind) String() string {
+	return Errors[k]
+}
+
+// traceFrames is the number of distinct frames printed by Trace
+const traceFrames = 32
+
+// RuntimeError is returned by a Runner when the execution
+// of a program fails
+type RuntimeError struct {
+	Kind        ErrorKind
+	Message     string
+	Instruction *Instruction // Instruction that failed, nil if ip was out of range
+	IP          int          // Address of the failed instruction
+	Frames      []Frame      // Call frames active at the time, innermost last
+	Native      string       // Name of the native function which failed, if any
+}
+
+func (e *RuntimeError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Kind, e.Message)
+}
+
+// Trace returns a printable backtrace of the call frames
+// active when the error occured, innermost first
+func (e *RuntimeError) Trace() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "  at %04d", e.IP)
+	if e.Instruction != nil {
+		fmt.Fprintf(&b, "  %s", strings.TrimSpace(e.Instruction.Display()))
+		if e.Instruction.Line > 0 {
+			fmt.Fprintf(&b, "  (line %d)", e.Instruction.Line)
+		}
+	}
+	b.WriteString("\n")
+
+	// Repeated frames, such as those of a recursion, are collapsed
+	// and only the innermost traceFrames are printed
+	printed := 0
+	for i := len(e.Frames) - 1; i >= 0; i-- {
+		if printed == traceFrames {
+			fmt.Fprintf(&b, "  ... %d more frames\n", i+1)
+			break
+		}
+
+		f := e.Frames[i]
+		repeats := 0
+		for i > 0 && e.Frames[i-1].Address == f.Address && e.Frames[i-1].Return == f.Return {
+			repeats++
+			i--
+		}
+
+		fmt.Fprintf(&b, "  in function %04d (%d args) called from %04d\n", f.Address, f.Args, f.Return)
+		if repeats > 0 {
+			fmt.Fprintf(&b, "  ... %d more frames in function %04d\n", repeats, f.Address)
+		}
+		printed++
+	}
+	return b.String()
+}
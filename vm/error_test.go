@@ -0,0 +1,82 @@
+package vm
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// overflow runs a program which recurses until the stack is
+// full, returning the error it stops with
+func overflow(t *testing.T, source string) *RuntimeError {
+	program, diagnostics, err := Assemble(source)
+	if err != nil {
+		t.Fatal(err, diagnostics)
+	}
+	main, err := Entry(program, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = NewRunner(program, 4096, main, false).Run()
+	rerr, ok := err.(*RuntimeError)
+	if !ok || rerr.Kind != StackError {
+		t.Fatalf("recursing forever returned %v, expected a StackError", err)
+	}
+	return rerr
+}
+
+func TestTraceRepeatedFrames(t *testing.T) {
+	rerr := overflow(t, `
+main:
+    call down 0
+    halt
+down:
+    call down 0
+    ret
+`)
+
+	lines := strings.Split(strings.TrimSpace(rerr.Trace()), "\n")
+	if len(lines) != 4 {
+		t.Fatalf("trace has %d lines, expected 4:\n%s", len(lines), rerr.Trace())
+	}
+
+	// The innermost frame is printed, followed by the others
+	// made from the same call and then the call from main
+	repeats := len(rerr.Frames) - 2
+	want := []string{
+		"in function 0002 (0 args) called from 0002",
+		"... " + strconv.Itoa(repeats) + " more frames in function 0002",
+		"in function 0002 (0 args) called from 0000",
+	}
+	for i, w := range want {
+		if got := strings.TrimSpace(lines[i+1]); got != w {
+			t.Errorf("line %d of trace is %q, expected %q", i+2, got, w)
+		}
+	}
+}
+
+func TestTraceFrameCap(t *testing.T) {
+	// Mutual recursion alternates between two frames, which
+	// are not collapsed, so only the innermost are printed
+	rerr := overflow(t, `
+main:
+    call ping 0
+    halt
+ping:
+    call pong 0
+    ret
+pong:
+    call ping 0
+    ret
+`)
+
+	lines := strings.Split(strings.TrimSpace(rerr.Trace()), "\n")
+	if len(lines) != traceFrames+2 {
+		t.Fatalf("trace has %d lines, expected %d:\n%s", len(lines), traceFrames+2, rerr.Trace())
+	}
+	want := "... " + strconv.Itoa(len(rerr.Frames)-traceFrames) + " more frames"
+	if got := strings.TrimSpace(lines[len(lines)-1]); got != want {
+		t.Errorf("trace ends with %q, expected %q", got, want)
+	}
+}
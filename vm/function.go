@@ -0,0 +1,107 @@
+package vm
+
+import "fmt"
+
+// Closure is the content of a FunctionValue. It pairs the entry
+// point of a function with the variables it captured from the
+// frames enclosing it when it was created
+type Closure struct {
+	Name     string
+	Address  int // Entry point of the function
+	Arity    int // Number of arguments expected
+	Upvalues []*Upvalue
+	Self     *Value // Instance bound by a method lookup, passed as the first argument
+}
+
+// NewClosure returns a FunctionValue which has not yet
+// captured any variables
+func NewClosure(name string, address, arity int) Value {
+	return Value{
+		Kind: FunctionValue,
+		Content: &Closure{
+			Name:    name,
+			Address: address,
+			Arity:   arity,
+		},
+	}
+}
+
+func (c *Closure) String() string {
+	return fmt.Sprintf("<fun %s/%d>", c.Name, c.Arity)
+}
+
+// Upvalue is a variable captured by a closure. While the frame
+// which declared the variable is running the upvalue is open and
+// refers to its slot on the stack, so that the frame and every
+// closure sharing the upvalue see the same variable. Once the
+// frame returns the upvalue is closed and holds the value itself
+type Upvalue struct {
+	index  int // Position of the variable on the stack while open
+	closed bool
+	value  Value
+}
+
+func (u *Upvalue) get(stack *Stack) Value {
+	if u.closed {
+		return u.value
+	}
+	return stack.data[u.index]
+}
+
+func (u *Upvalue) set(stack *Stack, item Value) {
+	if u.closed {
+		u.value = item
+	} else {
+		stack.data[u.index] = item
+	}
+}
+
+// capture returns the open upvalue for a position on the stack,
+// creating it if no closure has captured the variable yet
+func (r *Runner) capture(index int) *Upvalue {
+	for _, u := range r.open {
+		if u.index == index {
+			return u
+		}
+	}
+	u := &Upvalue{index: index}
+	r.open = append(r.open, u)
+	return u
+}
+
+// close closes every open upvalue referring to a position on
+// the stack above the pointer, as their frame has returned
+func (r *Runner) close() {
+	open := r.open[:0]
+	for _, u := range r.open {
+		if u.index > r.stack.pointer {
+			u.value = r.stack.data[u.index]
+			u.closed = true
+		} else {
+			open = append(open, u)
+		}
+	}
+	r.open = open
+}
+
+// closure returns the closure running in the current frame
+func (r *Runner) closure() (*Closure, error) {
+	if len(r.frames) == 0 || r.frames[len(r.frames)-1].Closure == nil {
+		return nil, r.Throw(CodeError, "cannot access upvalues outside of a closure")
+	}
+	return r.frames[len(r.frames)-1].Closure, nil
+}
+
+// upvalue returns an upvalue of the closure running in the current frame
+func (r *Runner) upvalue(address Value) (*Upvalue, error) {
+	c, err := r.closure()
+	if err != nil {
+		return nil, err
+	}
+
+	n := int(address.Content.(float64))
+	if n < 0 || n >= len(c.Upvalues) {
+		return nil, r.Throw(CodeError, fmt.Sprintf("upvalue address %d out of range", n))
+	}
+	return c.Upvalues[n], nil
+}
@@ -0,0 +1,44 @@
+package vm
+
+import "testing"
+
+var globalTests = []programTest{
+	{"store", "const 1\ngstore 0\ngfetch 0", "1", -1},
+	{"store again", "const 1\ngstore 0\nconst 2\ngstore 0\ngfetch 0", "2", -1},
+	{"unset", "gfetch 3", "nil", -1},
+	{"define", "const 1\ngdefine 0\ngfetch 0", "1", -1},
+	{"define after store", "const 1\ngstore 0\nconst 2\ngdefine 0\ngfetch 0", "2", -1},
+	{"define nil", "const nil\ngdefine 0\ngfetch 0", "nil", -1},
+	{"other slots", "const 1\ngdefine 0\nconst 2\ngstore 1\ngfetch 1", "2", -1},
+
+	// Globals defined with gdefine are constants
+	{"store to constant", "const 1\ngdefine 0\nconst 2\ngstore 0", "", ValueError},
+	{"store nil to constant", "const nil\ngdefine 0\nconst 2\ngstore 0", "", ValueError},
+	{"redefine", "const 1\ngdefine 0\nconst 2\ngdefine 0", "", ValueError},
+
+	{"store empty", "gstore 0", "", StackError},
+	{"define empty", "gdefine 0", "", StackError},
+	{"store out of range", "const 1\ngstore 512", "", CodeError},
+	{"define out of range", "const 1\ngdefine -1", "", CodeError},
+	{"fetch out of range", "gfetch 512", "", CodeError},
+}
+
+func TestGlobals(t *testing.T) {
+	checkPrograms(t, globalTests)
+}
+
+// A constant keeps its value after a failed store
+func TestConstantUnchanged(t *testing.T) {
+	program, _, err := Assemble("const 1\ngdefine 0\nconst 2\ngstore 0\nhalt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := NewRunner(program, 64, 0, false)
+	err = r.Run()
+	if rerr, ok := err.(*RuntimeError); !ok || rerr.Kind != ValueError || rerr.IP != 3 {
+		t.Fatalf("returned %v, expected a ValueError at 3", err)
+	}
+	if got := r.Global(0); got != number(1) {
+		t.Errorf("constant changed to %s", got)
+	}
+}
@@ -0,0 +1,110 @@
+package vm
+
+import (
+	"context"
+	"fmt"
+)
+
+// Limits bound the memory a program may use, so that untrusted
+// programs can be run safely. A limit of 0 is no limit. Exceeding
+// a limit stops the run with a LimitError
+type Limits struct {
+	// HeapBytes bounds the approximate number of bytes allocated
+	// by each run for lists, maps, strings, instances and closures,
+	// whether or not they are still in use
+	HeapBytes  int
+	StringLen  int // Maximum length of a string in bytes
+	Collection int // Maximum number of items in a list or map
+	CallDepth  int // Maximum number of calls in progress, unlike the size of the stack
+}
+
+// Approximate sizes in bytes of what a program allocates
+const (
+	valueSize    = 24 // The kind of a value and the interface holding its content
+	headerSize   = 32 // A list, map, instance or closure, without its items
+	mapEntrySize = 3 * valueSize
+)
+
+// SetLimits sets the limits of each run
+func (r *Runner) SetLimits(limits Limits) {
+	r.limits = limits
+}
+
+// allocate charges n bytes to the heap of the run
+func (r *Runner) allocate(n int) error {
+	r.heap += n
+	if r.limits.HeapBytes > 0 && r.heap > r.limits.HeapBytes {
+		return r.Throw(LimitError, fmt.Sprintf("exceeded heap limit of %d bytes", r.limits.HeapBytes))
+	}
+	return nil
+}
+
+// grow checks that a list or map may hold n items and charges
+// the items added to the heap
+func (r *Runner) grow(kind ValueKind, n, added int) error {
+	if r.limits.Collection > 0 && n > r.limits.Collection {
+		return r.Throw(LimitError, fmt.Sprintf("%s of %d items exceeds limit of %d", ValueKinds[kind], n, r.limits.Collection))
+	}
+
+	size := valueSize
+	if kind == MapValue {
+		size = mapEntrySize
+	}
+	return r.allocate(added * size)
+}
+
+// text checks the length of a new string and charges it to the heap
+func (r *Runner) text(s string) error {
+	if r.limits.StringLen > 0 && len(s) > r.limits.StringLen {
+		return r.Throw(LimitError, fmt.Sprintf("string of %d bytes exceeds limit of %d", len(s), r.limits.StringLen))
+	}
+	return r.allocate(len(s))
+}
+
+// account checks a value made outside of the vm, such as the
+// result of a native, as if the program had made it
+func (r *Runner) account(item Value) error {
+	switch item.Kind {
+	case StringValue:
+		return r.text(item.Content.(string))
+	case ListValue:
+		n := len(item.Content.(*List).Items)
+		return r.grow(ListValue, n, n)
+	case MapValue:
+		n := item.Content.(*Map).Len()
+		return r.grow(MapValue, n, n)
+	}
+	return nil
+}
+
+// allowanceKey is the key of the allowance in the context of a native
+type allowanceKey struct{}
+
+// allowance returns the most bytes a string may hold within the
+// limits of the run, or -1 if there is no limit
+func (r *Runner) allowance() int {
+	n := -1
+	if r.limits.StringLen > 0 {
+		n = r.limits.StringLen
+	}
+	if r.limits.HeapBytes > 0 {
+		left := r.limits.HeapBytes - r.heap
+		if left < 0 {
+			left = 0
+		}
+		if n < 0 || left < n {
+			n = left
+		}
+	}
+	return n
+}
+
+// Allowance returns the most bytes which a native, passed ctx by
+// a Runner, may read into a string within the Limits of the run,
+// or false if there is no limit. Natives which read files or
+// the output of processes stop reading once past the allowance,
+// rather than reading everything before the result is checked
+func Allowance(ctx context.Context) (int, bool) {
+	n, ok := ctx.Value(allowanceKey{}).(int)
+	return n, ok
+}
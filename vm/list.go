@@ -0,0 +1,144 @@
+package vm
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// List is the content of a ListValue. Lists live on the heap
+// and are shared by reference, so every copy of a ListValue
+// refers to the same items
+type List struct {
+	Items []Value
+}
+
+// NewList returns a ListValue holding items
+func NewList(items []Value) Value {
+	return Value{
+		Kind:    ListValue,
+		Content: &List{Items: items},
+	}
+}
+
+// Iterator is the content of an IteratorValue which walks
+// the items of a collection for the next instruction
+type Iterator struct {
+	collection Value
+	index      int
+}
+
+// NewIterator returns an IteratorValue over the items of a
+// list, the keys of a map or the characters of a string
+func NewIterator(collection Value) (Value, bool) {
+	switch collection.Kind {
+	case ListValue:
+	case MapValue:
+		collection = NewList(collection.Content.(*Map).Keys())
+	case StringValue:
+		var chars []Value
+		for _, r := range collection.Content.(string) {
+			chars = append(chars, Value{Kind: StringValue, Content: string(r)})
+		}
+		collection = NewList(chars)
+	default:
+		return Nil, false
+	}
+
+	return Value{
+		Kind:    IteratorValue,
+		Content: &Iterator{collection: collection},
+	}, true
+}
+
+// Next returns the next item of the collection, ok is false
+// once the iterator has been exhausted
+func (it *Iterator) Next() (item Value, ok bool) {
+	items := it.collection.Content.(*List).Items
+	if it.index < len(items) {
+		item, ok = items[it.index], true
+		it.index++
+	}
+	return item, ok
+}
+
+// toIndex converts a number into an index of a
+// collection with the given length
+func toIndex(key Value, length int) (int, error) {
+	if key.Kind != NumberValue {
+		return 0, fmt.Errorf("cannot index with %s value", ValueKinds[key.Kind])
+	}
+
+	f := key.Content.(float64)
+	if f != math.Trunc(f) {
+		return 0, fmt.Errorf("index %v is not a whole number", key)
+	}
+	if f < 0 || f >= float64(length) {
+		return 0, fmt.Errorf("index %v out of range for length %d", key, length)
+	}
+	return int(f), nil
+}
+
+// toBounds converts a pair of numbers into the bounds of a
+// slice of a collection with the given length
+func toBounds(start, end Value, length int) (int, int, error) {
+	if start.Kind != NumberValue || end.Kind != NumberValue {
+		return 0, 0, fmt.Errorf("cannot slice with %s and %s values", ValueKinds[start.Kind], ValueKinds[end.Kind])
+	}
+
+	low, high := start.Content.(float64), end.Content.(float64)
+	if low != math.Trunc(low) || high != math.Trunc(high) {
+		return 0, 0, fmt.Errorf("slice bounds [%v:%v] are not whole numbers", start, end)
+	}
+	if low < 0 || high > float64(length) || low > high {
+		return 0, 0, fmt.Errorf("slice bounds [%v:%v] out of range for length %d", start, end, length)
+	}
+	return int(low), int(high), nil
+}
+
+// length returns the number of items in a collection
+func length(v Value) (int, bool) {
+	switch v.Kind {
+	case ListValue:
+		return len(v.Content.(*List).Items), true
+	case MapValue:
+		return v.Content.(*Map).Len(), true
+	case StringValue:
+		return len([]rune(v.Content.(string))), true
+	}
+	return 0, false
+}
+
+// repr formats a value nested within a collection,
+// quoting strings so that they can be told apart
+func repr(v Value, seen []interface{}) string {
+	switch v.Kind {
+	case StringValue:
+		return strconv.Quote(v.Content.(string))
+	case ListValue:
+		return v.Content.(*List).format(seen)
+	case MapValue:
+		return v.Content.(*Map).format(seen)
+	case InstanceValue:
+		return v.Content.(*Instance).format(seen)
+	}
+	return v.String()
+}
+
+// format writes the list as [1, 2, 3], eliding any
+// lists in seen which already contain this one
+func (l *List) format(seen []interface{}) string {
+	for _, s := range seen {
+		if s == l {
+			return "[...]"
+		}
+	}
+	seen = append(seen, l)
+
+	items := make([]string, len(l.Items))
+	for i, item := range l.Items {
+		items[i] = repr(item, seen)
+	}
+	return "[" + strings.Join(items, ", ") + "]"
+}
@@ -0,0 +1,86 @@
+package vm
+
+import "testing"
+
+// programTest is a program which leaves a result on top of the
+// stack, printed as want, or which fails with the error err
+type programTest struct {
+	name   string
+	source string
+	want   string
+	err    ErrorKind
+}
+
+func checkPrograms(t *testing.T, tests []programTest) {
+	for _, test := range tests {
+		result, err := runSource(t, test.source+"\nhalt\n")
+		if test.err >= 0 {
+			if errorKind(err) != test.err {
+				t.Errorf("%s: returned %v, expected a %s", test.name, err, test.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err)
+		} else if got := result.String(); got != test.want {
+			t.Errorf("%s: returned %s, expected %s", test.name, got, test.want)
+		}
+	}
+}
+
+// list123 pushes the list [1, 2, 3]
+const list123 = "const 1\nconst 2\nconst 3\nlist 3\n"
+
+var listTests = []programTest{
+	{"make", list123, "[1, 2, 3]", -1},
+	{"make empty", "list 0", "[]", -1},
+	{"make nested", `const "a"` + "\nlist 0\nlist 2", `["a", []]`, -1},
+	{"get", list123 + "const 1\nget", "2", -1},
+	{"get string", `const "héllo"` + "\nconst 1\nget", "é", -1},
+	{"set", list123 + "gstore 0\ngfetch 0\nconst 0\nconst 9\nset\ngfetch 0", "[9, 2, 3]", -1},
+	{"append", list123 + "gstore 0\ngfetch 0\nconst 4\nappend\ngfetch 0", "[1, 2, 3, 4]", -1},
+	{"len", list123 + "len", "3", -1},
+	{"len string", `const "héllo"` + "\nlen", "5", -1},
+	{"slice", list123 + "const 1\nconst 3\nslice", "[2, 3]", -1},
+	{"slice string", `const "héllo"` + "\nconst 1\nconst 3\nslice", "él", -1},
+	{"slice copies", list123 + "gstore 0\ngfetch 0\nconst 0\nconst 3\nslice\nconst 0\nconst 9\nset\ngfetch 0", "[1, 2, 3]", -1},
+
+	// Lists are shared by every global holding them
+	{"reference", list123 + "gstore 0\ngfetch 0\ngstore 1\ngfetch 1\nconst 4\nappend\ngfetch 0", "[1, 2, 3, 4]", -1},
+
+	{"iterate", "const 0\ngstore 0\n" + list123 + `iter
+2:
+    next 1f
+    gfetch 0
+    add
+    gstore 0
+    goto 2b
+1:
+    gfetch 0`, "6", -1},
+
+	{"get out of range", list123 + "const 3\nget", "", ValueError},
+	{"get negative", list123 + "const -1\nget", "", ValueError},
+	{"get fraction", list123 + "const 0.5\nget", "", ValueError},
+	{"get with string", list123 + `const "a"` + "\nget", "", ValueError},
+	{"get from number", "const 1\nconst 0\nget", "", ValueError},
+	{"set out of range", list123 + "const 3\nconst 0\nset", "", ValueError},
+	{"set string", `const "abc"` + "\nconst 0\nconst 1\nset", "", ValueError},
+	{"append to map", "map 0\nconst 1\nappend", "", ValueError},
+	{"len of number", "const 1\nlen", "", ValueError},
+	{"slice out of range", list123 + "const 2\nconst 4\nslice", "", ValueError},
+	{"slice backwards", list123 + "const 2\nconst 1\nslice", "", ValueError},
+	{"iterate number", "const 1\niter", "", ValueError},
+	{"next of list", list123 + "next 0", "", ValueError},
+
+	{"make too many", "const 1\nlist 2", "", StackError},
+	{"get empty", "const 1\nget", "", StackError},
+	{"set empty", "const 1\nconst 1\nset", "", StackError},
+	{"append empty", "append", "", StackError},
+	{"len empty", "len", "", StackError},
+	{"slice empty", "const 1\nconst 1\nslice", "", StackError},
+	{"iterate empty", "iter", "", StackError},
+}
+
+func TestLists(t *testing.T) {
+	checkPrograms(t, listTests)
+}
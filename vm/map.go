@@ -0,0 +1,98 @@
+package vm
+
+import (
+	"fmt"
+	"math"
+	"strings"
+)
+
+// Map is the content of a MapValue. Like lists, maps live on
+// the heap and are shared by reference. Keys may be strings or
+// numbers and are kept in the order they were first set
+type Map struct {
+	keys  []Value
+	items map[Value]Value
+}
+
+// NewMap returns an empty MapValue
+func NewMap() Value {
+	return Value{
+		Kind:    MapValue,
+		Content: &Map{items: map[Value]Value{}},
+	}
+}
+
+// checkKey reports an error if a value cannot be used as a map key
+func checkKey(key Value) error {
+	switch key.Kind {
+	case StringValue:
+		return nil
+	case NumberValue:
+		if math.IsNaN(key.Content.(float64)) {
+			return fmt.Errorf("cannot use NaN as map key")
+		}
+		return nil
+	}
+	return fmt.Errorf("cannot use %s value as map key", ValueKinds[key.Kind])
+}
+
+// Get returns the item stored under key, or Nil if there is none
+func (m *Map) Get(key Value) (Value, bool) {
+	item, ok := m.items[key]
+	if !ok {
+		return Nil, false
+	}
+	return item, true
+}
+
+// Set stores item under key
+func (m *Map) Set(key, item Value) {
+	if _, ok := m.items[key]; !ok {
+		m.keys = append(m.keys, key)
+	}
+	m.items[key] = item
+}
+
+// Delete removes key and its item from the map
+func (m *Map) Delete(key Value) {
+	if _, ok := m.items[key]; !ok {
+		return
+	}
+	delete(m.items, key)
+
+	for i, k := range m.keys {
+		if k == key {
+			m.keys = append(m.keys[:i], m.keys[i+1:]...)
+			break
+		}
+	}
+}
+
+// Len returns the number of keys in the map
+func (m *Map) Len() int {
+	return len(m.keys)
+}
+
+// Keys returns a copy of the keys of the map in insertion order
+func (m *Map) Keys() []Value {
+	keys := make([]Value, len(m.keys))
+	copy(keys, m.keys)
+	return keys
+}
+
+// format writes the map as {"key": item, ...} in insertion
+// order, eliding any collections in seen which contain it
+func (m *Map) format(seen []interface{}) string {
+	for _, s := range seen {
+		if s == m {
+			return "{...}"
+		}
+	}
+	seen = append(seen, m)
+
+	items := make([]string, len(m.keys))
+	for i, key := range m.keys {
+		items[i] = repr(key, seen) + ": " + repr(m.items[key], seen)
+	}
+	return "{" + strings.Join(items, ", ") + "}"
+}
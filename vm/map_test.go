@@ -0,0 +1,52 @@
+package vm
+
+import "testing"
+
+// mapAB pushes the map {"a": 1, "b": 2}
+const mapAB = `const "a"` + "\nconst 1\n" + `const "b"` + "\nconst 2\nmap 2\n"
+
+var mapTests = []programTest{
+	{"make", mapAB, `{"a": 1, "b": 2}`, -1},
+	{"make empty", "map 0", "{}", -1},
+	{"make number keys", "const 2\nconst \"two\"\nconst 1\nconst \"one\"\nmap 2", `{2: "two", 1: "one"}`, -1},
+	{"make repeated key", `const "a"` + "\nconst 1\n" + `const "a"` + "\nconst 2\nmap 2", `{"a": 2}`, -1},
+	{"get", mapAB + `const "b"` + "\nget", "2", -1},
+	{"get missing", mapAB + `const "c"` + "\nget", "nil", -1},
+	{"set", mapAB + "gstore 0\ngfetch 0\n" + `const "a"` + "\nconst 9\nset\ngfetch 0", `{"a": 9, "b": 2}`, -1},
+	{"set new key", mapAB + "gstore 0\ngfetch 0\nconst 0\nconst 3\nset\ngfetch 0", `{"a": 1, "b": 2, 0: 3}`, -1},
+	{"delete", mapAB + "gstore 0\ngfetch 0\n" + `const "a"` + "\ndelete\ngfetch 0", `{"b": 2}`, -1},
+	{"delete missing", mapAB + "gstore 0\ngfetch 0\n" + `const "c"` + "\ndelete\ngfetch 0", `{"a": 1, "b": 2}`, -1},
+	{"delete and set", mapAB + "gstore 0\ngfetch 0\n" + `const "a"` + "\ndelete\ngfetch 0\n" + `const "a"` + "\nconst 3\nset\ngfetch 0", `{"b": 2, "a": 3}`, -1},
+	{"has", mapAB + `const "a"` + "\nhas", "true", -1},
+	{"has missing", mapAB + `const "c"` + "\nhas", "false", -1},
+	{"len", mapAB + "len", "2", -1},
+
+	// Keys are iterated in the order they were added
+	{"iterate", "list 0\ngstore 0\n" + `const "z"` + "\nconst 1\n" + `const "a"` + "\nconst 2\nconst 5\nconst 3\nmap 3\n" + `iter
+2:
+    next 1f
+    gstore 1
+    gfetch 0
+    gfetch 1
+    append
+    goto 2b
+1:
+    gfetch 0`, `["z", "a", 5]`, -1},
+
+	{"make with list key", "list 0\nconst 1\nmap 1", "", ValueError},
+	{"make with NaN key", "const NaN\nconst 1\nmap 1", "", ValueError},
+	{"get with nil key", mapAB + "const nil\nget", "", ValueError},
+	{"set with bool key", mapAB + "const true\nconst 1\nset", "", ValueError},
+	{"delete from list", "list 0\nconst 0\ndelete", "", ValueError},
+	{"has of string", `const "a"` + "\n" + `const "a"` + "\nhas", "", ValueError},
+	{"has with list key", mapAB + "list 0\nhas", "", ValueError},
+
+	{"make too many", "const 1\nconst 2\nmap 2", "", StackError},
+	{"make odd", "const 1\nmap 1", "", StackError},
+	{"delete empty", "const 1\ndelete", "", StackError},
+	{"has empty", "has", "", StackError},
+}
+
+func TestMaps(t *testing.T) {
+	checkPrograms(t, mapTests)
+}
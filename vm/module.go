@@ -0,0 +1,43 @@
+package vm
+
+import "fmt"
+
+// Module is the content of a ModuleValue, holding the names
+// exported by a module once its top level has run
+type Module struct {
+	Name  string
+	names []string
+	items map[string]Value
+}
+
+// NewModule returns a ModuleValue which exports nothing
+func NewModule(name string) Value {
+	return Value{
+		Kind: ModuleValue,
+		Content: &Module{
+			Name:  name,
+			items: map[string]Value{},
+		},
+	}
+}
+
+// Get returns an exported value of the module
+func (m *Module) Get(name string) (Value, error) {
+	if item, ok := m.items[name]; ok {
+		return item, nil
+	}
+	return Nil, fmt.Errorf("module %s does not export %s", m.Name, name)
+}
+
+// Export adds a name to those exported by the module
+func (m *Module) Export(name string, item Value) {
+	if _, ok := m.items[name]; !ok {
+		m.names = append(m.names, name)
+	}
+	m.items[name] = item
+}
+
+// Names returns the exported names in the order they were exported
+func (m *Module) Names() []string {
+	return m.names
+}
@@ -0,0 +1,138 @@
+package vm
+
+import (
+	"context"
+	"fmt"
+	"sort"
+)
+
+// NativeFunction is a function written in Go which programs call
+// like any other. Its arguments are in the order they were passed.
+// Errors it returns are raised as NativeErrors, unless the error
+// is a *RuntimeError, in which case its Kind is raised instead
+type NativeFunction func(args []Value) (Value, error)
+
+// NativeContextFunction is a NativeFunction which is passed the
+// context of the run. The context is done once the run is
+// cancelled or exceeds its timeout, so that natives which wait,
+// such as on another process, may stop early
+type NativeContextFunction func(ctx context.Context, args []Value) (Value, error)
+
+// Native is a NativeContextFunction registered under a name
+type Native struct {
+	Name     string
+	Arity    int // Number of arguments expected, or -1 for any number
+	Function NativeContextFunction
+}
+
+// Natives is a registry of the native functions available to a
+// program. The compiler compiles calls to a registered name into
+// callnative instructions, which the Runner looks up by name
+type Natives struct {
+	table map[string]*Native
+}
+
+// NewNatives returns an empty registry
+func NewNatives() *Natives {
+	return &Natives{table: map[string]*Native{}}
+}
+
+// Register adds a native function expecting arity arguments,
+// or any number if arity is -1, replacing any of the same name
+func (n *Natives) Register(name string, arity int, fn NativeFunction) {
+	n.RegisterContext(name, arity, func(ctx context.Context, args []Value) (Value, error) {
+		return fn(args)
+	})
+}
+
+// RegisterContext adds a native function as Register does,
+// which is passed the context of the run
+func (n *Natives) RegisterContext(name string, arity int, fn NativeContextFunction) {
+	n.table[name] = &Native{Name: name, Arity: arity, Function: fn}
+}
+
+// Lookup returns the native function registered as name. A nil
+// registry has no natives
+func (n *Natives) Lookup(name string) (*Native, bool) {
+	if n == nil {
+		return nil, false
+	}
+	native, ok := n.table[name]
+	return native, ok
+}
+
+// Names returns the names of the registered natives in order
+func (n *Natives) Names() []string {
+	if n == nil {
+		return nil
+	}
+	names := make([]string, 0, len(n.table))
+	for name := range n.table {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// callNative pops the arguments of a native function and
+// pushes its result. An error returned by the native is
+// reported as a RuntimeError naming it, unless the run was
+// cancelled or timed out while the native was running
+func (r *Runner) callNative(name Value, nargs int) error {
+	if name.Kind != StringValue {
+		return r.Throw(CodeError, fmt.Sprintf("expected name operand from %s", r.program[r.ip].Display()))
+	}
+
+	native, ok := r.natives.Lookup(name.Content.(string))
+	if !ok {
+		return r.Throw(CodeError, fmt.Sprintf("undefined native %s", name.Content))
+	}
+	if native.Arity >= 0 && nargs != native.Arity {
+		return r.Throw(ValueError, fmt.Sprintf("%s expects %d arguments, found %d", native.Name, native.Arity, nargs))
+	}
+	if r.stack.Len() < nargs {
+		return r.Throw(StackError, fmt.Sprintf("cannot call %s with %d args because stack is empty", native.Name, nargs))
+	}
+
+	args := make([]Value, nargs)
+	for i := nargs - 1; i >= 0; i-- {
+		args[i] = r.stack.Pop()
+	}
+
+	ctx, cancel := r.nativeContext()
+	result, err := native.Function(ctx, args)
+	cancel()
+	if stop := r.interrupted(); stop != nil {
+		return stop
+	}
+	if err != nil {
+		kind, message := NativeError, err.Error()
+		if e, ok := err.(*RuntimeError); ok {
+			kind, message = e.Kind, e.Message
+		}
+		rerr := r.Throw(kind, fmt.Sprintf("%s: %s", native.Name, message)).(*RuntimeError)
+		rerr.Native = native.Name
+		return rerr
+	}
+	if err := r.account(result); err != nil {
+		return err
+	}
+	return r.push(result)
+}
+
+// nativeContext returns the context passed to natives, which
+// is that of the run limited to the timeout of the run, holding
+// the Allowance of the run
+func (r *Runner) nativeContext() (context.Context, context.CancelFunc) {
+	ctx := r.ctx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	if n := r.allowance(); n >= 0 {
+		ctx = context.WithValue(ctx, allowanceKey{}, n)
+	}
+	if r.timeout > 0 {
+		return context.WithDeadline(ctx, r.deadline)
+	}
+	return ctx, func() {}
+}
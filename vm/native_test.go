@@ -0,0 +1,278 @@
+package vm
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// runNative runs a program which calls the native wait once
+func runNative(t *testing.T, ctx context.Context, timeout time.Duration, natives *Natives) error {
+	program, diagnostics, err := Assemble(`
+    callnative "wait" 0
+    print
+    halt
+`)
+	if err != nil {
+		t.Fatal(err, diagnostics)
+	}
+
+	r := NewRunner(program, 64, 0, false)
+	r.SetOutput(ioutil.Discard)
+	r.SetNatives(natives)
+	r.SetTimeout(timeout)
+	return r.RunContext(ctx)
+}
+
+func TestNativeTimeout(t *testing.T) {
+	natives := NewNatives()
+	natives.RegisterContext("wait", 0, func(ctx context.Context, args []Value) (Value, error) {
+		select {
+		case <-ctx.Done():
+			return Nil, ctx.Err()
+		case <-time.After(5 * time.Second):
+			return Nil, nil
+		}
+	})
+
+	start := time.Now()
+	err := runNative(t, context.Background(), 20*time.Millisecond, natives)
+	if rerr, ok := err.(*RuntimeError); !ok || rerr.Kind != TimeoutError {
+		t.Errorf("native waiting past the timeout returned %v, expected a TimeoutError", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("native was not stopped, running for %s", elapsed)
+	}
+}
+
+func TestNativeCancel(t *testing.T) {
+	natives := NewNatives()
+	natives.RegisterContext("wait", 0, func(ctx context.Context, args []Value) (Value, error) {
+		<-ctx.Done()
+		return Nil, ctx.Err()
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	err := runNative(t, ctx, 0, natives)
+	if rerr, ok := err.(*RuntimeError); !ok || rerr.Kind != TimeoutError {
+		t.Errorf("native waiting past the deadline returned %v, expected a TimeoutError", err)
+	}
+}
+
+func TestNativeOverrun(t *testing.T) {
+	// Natives which ignore their context are still stopped once they
+	// return, however few instructions the program has run
+	natives := NewNatives()
+	natives.Register("wait", 0, func(args []Value) (Value, error) {
+		time.Sleep(50 * time.Millisecond)
+		return Nil, nil
+	})
+
+	err := runNative(t, context.Background(), 10*time.Millisecond, natives)
+	if rerr, ok := err.(*RuntimeError); !ok || rerr.Kind != TimeoutError {
+		t.Errorf("native running past the timeout returned %v, expected a TimeoutError", err)
+	}
+}
+
+// runBudget runs source with a budget, calling the native
+// id which returns its argument
+func runBudget(t *testing.T, source string, budget int) error {
+	program, diagnostics, err := Assemble(source)
+	if err != nil {
+		t.Fatal(err, diagnostics)
+	}
+	natives := NewNatives()
+	natives.Register("id", 1, func(args []Value) (Value, error) {
+		return args[0], nil
+	})
+
+	r := NewRunner(program, 64, 0, false)
+	r.SetNatives(natives)
+	r.SetBudget(budget)
+	return r.Run()
+}
+
+func TestNativeBudget(t *testing.T) {
+	tests := []struct {
+		name   string
+		source string
+		budget int
+		err    ErrorKind
+	}{
+		// A native which is the last instruction within
+		// the budget completes the run
+		{"last instruction", "const 1\ncallnative \"id\" 1", 2, -1},
+		{"before halt", "const 1\ncallnative \"id\" 1\nhalt", 3, -1},
+		{"halt over budget", "const 1\ncallnative \"id\" 1\nhalt", 2, BudgetError},
+		{"native over budget", "const 1\ncallnative \"id\" 1", 1, BudgetError},
+		{"no budget", "const 1\ncallnative \"id\" 1\nhalt", 0, -1},
+	}
+	for _, test := range tests {
+		err := runBudget(t, test.source, test.budget)
+		if errorKind(err) != test.err {
+			t.Errorf("%s: returned %v, expected %v", test.name, err, test.err)
+		}
+	}
+}
+
+// runLoop runs a loop which calls no natives until it is stopped
+func runLoop(t *testing.T, ctx context.Context, timeout time.Duration) error {
+	program, diagnostics, err := Assemble("1:\n    goto 1b\n")
+	if err != nil {
+		t.Fatal(err, diagnostics)
+	}
+
+	r := NewRunner(program, 64, 0, false)
+	r.SetTimeout(timeout)
+	return r.RunContext(ctx)
+}
+
+func TestLoopTimeout(t *testing.T) {
+	start := time.Now()
+	err := runLoop(t, context.Background(), 20*time.Millisecond)
+	if rerr, ok := err.(*RuntimeError); !ok || rerr.Kind != TimeoutError {
+		t.Errorf("loop returned %v, expected a TimeoutError", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("loop was not stopped, running for %s", elapsed)
+	}
+}
+
+func TestLoopCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(20*time.Millisecond, cancel)
+
+	err := runLoop(t, ctx, 0)
+	if rerr, ok := err.(*RuntimeError); !ok || rerr.Kind != CancelError {
+		t.Errorf("loop returned %v, expected a CancelError", err)
+	}
+}
+
+func TestLoopDeadline(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+
+	err := runLoop(t, ctx, 0)
+	if rerr, ok := err.(*RuntimeError); !ok || rerr.Kind != TimeoutError {
+		t.Errorf("loop returned %v, expected a TimeoutError", err)
+	}
+}
+
+func TestRegistry(t *testing.T) {
+	natives := NewNatives()
+	natives.Register("b", 1, func(args []Value) (Value, error) { return Nil, nil })
+	natives.RegisterContext("a", -1, func(ctx context.Context, args []Value) (Value, error) { return Nil, nil })
+	natives.Register("c", 0, func(args []Value) (Value, error) { return Nil, nil })
+	natives.Register("c", 2, func(args []Value) (Value, error) { return Nil, nil })
+
+	if names := natives.Names(); !reflect.DeepEqual(names, []string{"a", "b", "c"}) {
+		t.Errorf("names are %v, expected [a b c]", names)
+	}
+	if native, ok := natives.Lookup("a"); !ok || native.Name != "a" || native.Arity != -1 {
+		t.Errorf("found %v, expected a taking any number of arguments", native)
+	}
+	if native, ok := natives.Lookup("c"); !ok || native.Arity != 2 {
+		t.Errorf("found %v, expected c to be replaced", native)
+	}
+	if _, ok := natives.Lookup("d"); ok {
+		t.Error("found unregistered native d")
+	}
+
+	var none *Natives
+	if _, ok := none.Lookup("a"); ok || none.Names() != nil {
+		t.Error("nil registry has natives")
+	}
+}
+
+// callNatives are the natives called by callNativeTests
+func callNatives() *Natives {
+	natives := NewNatives()
+	natives.Register("sub", 2, func(args []Value) (Value, error) {
+		return number(args[0].Content.(float64) - args[1].Content.(float64)), nil
+	})
+	natives.Register("count", -1, func(args []Value) (Value, error) {
+		return number(float64(len(args))), nil
+	})
+	natives.Register("fail", 0, func(args []Value) (Value, error) {
+		return Nil, errors.New("failed")
+	})
+	natives.Register("raise", 0, func(args []Value) (Value, error) {
+		return Nil, &RuntimeError{Kind: LimitError, Message: "too big"}
+	})
+	natives.Register("nothing", 0, func(args []Value) (Value, error) {
+		return Nil, nil
+	})
+	return natives
+}
+
+var callNativeTests = []struct {
+	name    string
+	source  string
+	want    string
+	err     ErrorKind
+	message string
+}{
+	{"arguments in order", "const 5\nconst 2\ncallnative \"sub\" 2", "3", -1, ""},
+	{"any number", "const 1\nconst 2\nconst 3\ncallnative \"count\" 3", "3", -1, ""},
+	{"none", "callnative \"count\" 0", "0", -1, ""},
+	{"result", "const 1\ncallnative \"nothing\" 0", "nil", -1, ""},
+	{"leaves stack", "const 9\nconst 5\nconst 2\ncallnative \"sub\" 2\nadd", "12", -1, ""},
+
+	{"too few", "const 1\ncallnative \"sub\" 1", "", ValueError, "sub expects 2 arguments, found 1"},
+	{"too many", "const 1\ncallnative \"nothing\" 1", "", ValueError, "nothing expects 0 arguments, found 1"},
+	{"undefined", "callnative \"missing\" 0", "", CodeError, "undefined native missing"},
+	{"name operand", "callnative 1 0", "", CodeError, "expected name operand from callnative\t1.00\t0.00"},
+	{"empty stack", "const 1\ncallnative \"count\" 2", "", StackError, "cannot call count with 2 args because stack is empty"},
+	{"error", "callnative \"fail\" 0", "", NativeError, "fail: failed"},
+	{"runtime error", "callnative \"raise\" 0", "", LimitError, "raise: too big"},
+}
+
+func TestCallNative(t *testing.T) {
+	for _, test := range callNativeTests {
+		program, diagnostics, err := Assemble(test.source + "\nhalt\n")
+		if err != nil {
+			t.Fatal(err, diagnostics)
+		}
+		r := NewRunner(program, 64, 0, false)
+		r.SetNatives(callNatives())
+		err = r.Run()
+
+		if test.err >= 0 {
+			rerr, ok := err.(*RuntimeError)
+			if !ok || rerr.Kind != test.err || rerr.Message != test.message {
+				t.Errorf("%s: returned %v, expected a %s: %s", test.name, err, test.err, test.message)
+			}
+			continue
+		}
+		stack := r.Stack()
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err)
+		} else if len(stack) == 0 || stack[len(stack)-1].String() != test.want {
+			t.Errorf("%s: stack is %v, expected %s on top", test.name, stack, test.want)
+		}
+	}
+}
+
+// Errors returned by natives name the native in which they were
+// raised, and natives are missing from a Runner without a registry
+func TestNativeErrors(t *testing.T) {
+	program, _, err := Assemble("callnative \"fail\" 0\nhalt")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := NewRunner(program, 64, 0, false)
+	r.SetNatives(callNatives())
+	if rerr, ok := r.Run().(*RuntimeError); !ok || rerr.Native != "fail" || rerr.IP != 0 {
+		t.Errorf("returned %v, expected an error raised in fail at 0", rerr)
+	}
+
+	r = NewRunner(program, 64, 0, false)
+	if rerr, ok := r.Run().(*RuntimeError); !ok || rerr.Kind != CodeError || rerr.Native != "" {
+		t.Errorf("returned %v, expected a CodeError without natives", rerr)
+	}
+}
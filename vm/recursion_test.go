@@ -0,0 +1,132 @@
+package vm
+
+import (
+	"fmt"
+	"testing"
+)
+
+// recursion calls even(n), which calls odd(n - 1) and so on down
+// to 0, storing the result in global 0. Each call keeps n in a
+// local which must survive the calls made after it, and the
+// native depth records the number of frames at the deepest call
+const recursion = `
+main:
+    const %d
+    call even 1
+    gstore 0
+    halt
+
+even:
+    .locals n, before, result
+    enter 2
+    fetch n
+    store before
+    fetch n
+    const 0
+    eq
+    jmpt .done
+    fetch n
+    const 1
+    sub
+    call odd 1
+    store result
+    fetch before
+    fetch n
+    neq
+    jmpt clobbered
+    fetch result
+    ret
+.done:
+    callnative "depth" 0
+    pop
+    const true
+    ret
+
+odd:
+    .locals n, before, result
+    enter 2
+    fetch n
+    store before
+    fetch n
+    const 0
+    eq
+    jmpt .done
+    fetch n
+    const 1
+    sub
+    call even 1
+    store result
+    fetch before
+    fetch n
+    neq
+    jmpt clobbered
+    fetch result
+    ret
+.done:
+    callnative "depth" 0
+    pop
+    const false
+    ret
+
+clobbered:
+    const "clobbered"
+    ret
+`
+
+// recurse runs the recursion program, returning its runner
+// and the number of frames at the deepest call
+func recurse(t *testing.T, n, size int) (*Runner, int, error) {
+	program, diagnostics, err := Assemble(fmt.Sprintf(recursion, n))
+	if err != nil {
+		t.Fatal(err, diagnostics)
+	}
+	main, err := Entry(program, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := NewRunner(program, size, main, false)
+	depth := 0
+	natives := NewNatives()
+	natives.Register("depth", 0, func(args []Value) (Value, error) {
+		depth = len(r.frames)
+		return Nil, nil
+	})
+	r.SetNatives(natives)
+	err = r.Run()
+	return r, depth, err
+}
+
+func TestDeepRecursion(t *testing.T) {
+	for _, n := range []int{0, 1, 100, 1001, 5000} {
+		r, depth, err := recurse(t, n, 1<<16)
+		if err != nil {
+			t.Fatalf("even(%d): %s", n, err)
+		}
+
+		want := Value{Kind: BoolValue, Content: n%2 == 0}
+		if got := r.Global(0); got != want {
+			t.Errorf("even(%d) returned %s, expected %s", n, got, want)
+		}
+		if depth != n+1 {
+			t.Errorf("even(%d) reached a depth of %d frames, expected %d", n, depth, n+1)
+		}
+		if len(r.frames) != 0 {
+			t.Errorf("even(%d) left %d frames after returning", n, len(r.frames))
+		}
+	}
+}
+
+func TestStackOverflow(t *testing.T) {
+	_, _, err := recurse(t, 10000, 256)
+	rerr, ok := err.(*RuntimeError)
+	if !ok {
+		t.Fatalf("overflowing the stack returned %v, expected a *RuntimeError", err)
+	}
+	if rerr.Kind != StackError {
+		t.Errorf("overflowing the stack raised %s, expected StackError", rerr)
+	}
+	if len(rerr.Frames) == 0 {
+		t.Error("overflowing the stack recorded no frames")
+	}
+}
@@ -1,21 +1,39 @@
 package vm
 
-import "fmt"
+import (
+	"fmt"
+	"strconv"
+)
 
-// ValueKind represents either a String or Number
-// typed value on the stack
+// ValueKind represents the type of a value on the stack
 type ValueKind int
 
 var ValueKinds = []string{
 	"nil",
 	"number",
 	"string",
+	"bool",
+	"list",
+	"iterator",
+	"map",
+	"function",
+	"entity",
+	"instance",
+	"module",
 }
 
 const (
 	NilValue ValueKind = iota
 	NumberValue
 	StringValue
+	BoolValue
+	ListValue     // Content is a *List
+	IteratorValue // Content is an *Iterator
+	MapValue      // Content is a *Map
+	FunctionValue // Content is a *Closure
+	EntityValue   // Content is an *Entity
+	InstanceValue // Content is an *Instance
+	ModuleValue   // Content is a *Module
 )
 
 // Value represents an item on the stack
@@ -30,14 +48,49 @@ var Nil = Value{
 	Content: nil,
 }
 
+// Truthy reports whether a value counts as true when tested
+// by a conditional jump. nil, false, 0, the empty string, the
+// empty list and the empty map are not truthy, every other value is
+func (v Value) Truthy() bool {
+	switch v.Kind {
+	case NumberValue:
+		return v.Content.(float64) != 0
+	case StringValue:
+		return v.Content.(string) != ""
+	case BoolValue:
+		return v.Content.(bool)
+	case ListValue:
+		return len(v.Content.(*List).Items) > 0
+	case MapValue:
+		return v.Content.(*Map).Len() > 0
+	case IteratorValue, FunctionValue, EntityValue, InstanceValue, ModuleValue:
+		return true
+	}
+	return false
+}
+
 func (v Value) String() string {
-	if v.Kind == StringValue {
+	switch v.Kind {
+	case StringValue, BoolValue:
 		return fmt.Sprint(v.Content)
-	} else if v.Content != nil {
-		return fmt.Sprintf("%.2f", v.Content.(float64))
-	} else {
-		return "nil"
+	case NumberValue:
+		return strconv.FormatFloat(v.Content.(float64), 'g', -1, 64)
+	case ListValue:
+		return v.Content.(*List).format(nil)
+	case MapValue:
+		return v.Content.(*Map).format(nil)
+	case IteratorValue:
+		return "<iterator>"
+	case FunctionValue:
+		return v.Content.(*Closure).String()
+	case EntityValue:
+		return fmt.Sprintf("<entity %s>", v.Content.(*Entity).Name)
+	case InstanceValue:
+		return v.Content.(*Instance).format(nil)
+	case ModuleValue:
+		return fmt.Sprintf("<module %s>", v.Content.(*Module).Name)
 	}
+	return "nil"
 }
 
 // Stack data structure for storing Value items
@@ -82,6 +135,11 @@ func (s *Stack) Pop() Value {
 	return v
 }
 
+// Len returns the number of items on the stack
+func (s *Stack) Len() int {
+	return s.pointer + 1
+}
+
 // Peek returns the item on the top of the stack
 // without popping it off
 func (s *Stack) Peek() Value {
@@ -92,31 +150,6 @@ func (s *Stack) Peek() Value {
 	return Nil
 }
 
-// Store takes an address, pops item off stack then stores
-// it into local memory (heap growing up the stack)
-func (s *Stack) Store(address Value) Value {
-	item := s.Pop()
-	if item == Nil {
-		return Nil
-	}
-
-	addr := int(address.Content.(float64))
-	s.data[len(s.data)-addr-1] = item
-	return item
-}
-
-// Fetch looks up an address in memory then pushes
-// the value at the address onto the stack
-func (s *Stack) Fetch(address Value) Value {
-	addr := int(address.Content.(float64))
-	if addr < len(s.data) {
-		item := s.data[len(s.data)-addr-1]
-		s.Push(item)
-		return item
-	}
-	return Nil
-}
-
 // func (s *Stack) String() string {
 // 	var str string
 // 	for i, item := range s.data {
@@ -1,43 +1,415 @@
 package vm
 
 import (
+	"context"
 	"fmt"
+	"io"
+	"math"
 	"os"
+	"strings"
+	"time"
 )
 
 // Runner represents an instance of the Run Virtual Machine
 type Runner struct {
 	ip      int
-	fp      int
+	fp      int // Index of the return address of the current frame
+	locals  int // Number of local slots reserved outside of any function
 	stack   *Stack
 	globals *Stack
+	consts  []bool // Globals created by gdefine
+	frames  []Frame
+	open    []*Upvalue // Upvalues referring to variables still on the stack
 	program []*Instruction
+	natives *Natives
+	out     io.Writer // Destination of print and trace output
 	trace   bool
 	panic   bool
+
+	// Limits on each run, checked every checkInterval instructions
+	ctx      context.Context
+	budget   int           // Maximum number of instructions, or 0 for no limit
+	timeout  time.Duration // Maximum duration, or 0 for no limit
+	deadline time.Time
+	steps    int // Instructions executed by the current run
+	next     int // Number of steps at which to check the limits next
+	limits   Limits
+	heap     int // Bytes allocated by the current run
+}
+
+// checkInterval is the number of instructions run between checks
+// of the context and the clock, which are too slow to make on
+// every instruction
+const checkInterval = 1024
+
+// Frame records a function call made by the Runner
+type Frame struct {
+	Address int      // Entry point of the called function
+	Return  int      // Address of the call instruction
+	Args    int      // Number of arguments passed
+	Locals  int      // Number of local slots reserved by enter
+	Closure *Closure // Function value called by callv, nil for call
 }
 
 // NewRunner returns reference to an instance of a Runner
 func NewRunner(program []*Instruction, size int, main int, trace bool) *Runner {
 	return &Runner{
 		ip:      main,
+		fp:      -1,
 		stack:   NewStack(size),
 		globals: NewStack(512),
+		consts:  make([]bool, 512),
 		program: program,
+		out:     os.Stdout,
 		trace:   trace,
 		panic:   false,
 	}
 }
 
-// Throw will display a runtime error message
-func Throw(kind ErrorKind, message string) {
-	fmt.Printf("%s: %s\n", Errors[kind], message)
-	os.Exit(1)
+// Continue runs a new program from address, as when a repl
+// appends another entry to the program run so far. Globals and
+// the locals of the top level are kept, whereas anything left
+// on the stack by the last run or a failure is discarded
+func (r *Runner) Continue(program []*Instruction, address int) error {
+	r.program = program
+	r.ip = address
+	r.panic = false
+	r.frames = nil
+	r.fp = -1
+	r.stack.pointer = r.locals - 1
+	r.close()
+	return r.Run()
+}
+
+// Call calls a function value with args once the program has
+// run, returning its result. Like Continue, globals are kept and
+// anything left on the stack is discarded, so the functions of a
+// program may be called any number of times
+func (r *Runner) Call(fn Value, args []Value) (Value, error) {
+	return r.CallContext(context.Background(), fn, args)
+}
+
+// CallContext calls a function as Call does, stopping
+// once ctx is cancelled or expires as RunContext does
+func (r *Runner) CallContext(ctx context.Context, fn Value, args []Value) (Value, error) {
+	r.panic = false
+	r.frames = nil
+	r.fp = -1
+	r.stack.pointer = r.locals - 1
+	r.close()
+
+	// The function returns to the end of the program, where
+	// Run stops. Errors before the call report no instruction
+	r.ip = len(r.program)
+	if fn.Kind != FunctionValue {
+		return Nil, r.Throw(ValueError, fmt.Sprintf("cannot call %s value", ValueKinds[fn.Kind]))
+	}
+
+	closure := fn.Content.(*Closure)
+	if len(args) != closure.Arity {
+		return Nil, r.Throw(ValueError, fmt.Sprintf("%s expects %d arguments, found %d", closure.Name, closure.Arity, len(args)))
+	}
+	if closure.Self != nil {
+		args = append([]Value{*closure.Self}, args...)
+	}
+	for _, arg := range args {
+		if err := r.push(arg); err != nil {
+			return Nil, err
+		}
+	}
+
+	r.ip = len(r.program) - 1
+	if err := r.call(closure.Address, len(args), closure); err != nil {
+		return Nil, err
+	}
+	if err := r.RunContext(ctx); err != nil {
+		return Nil, err
+	}
+
+	// A halt within the function stops Run before it returns
+	if len(r.frames) > 0 {
+		return Nil, r.Throw(CodeError, fmt.Sprintf("%s halted before returning", closure.Name))
+	}
+	return r.stack.Pop(), nil
+}
+
+// SetOutput directs the output of print instructions
+// and tracing, which is written to stdout by default
+func (r *Runner) SetOutput(w io.Writer) {
+	r.out = w
+}
+
+// SetNatives sets the registry in which callnative
+// instructions look up native functions
+func (r *Runner) SetNatives(natives *Natives) {
+	r.natives = natives
+}
+
+// SetGlobal replaces the global variable held in a slot, such
+// as to pass arguments to a program before it is run
+func (r *Runner) SetGlobal(slot int, item Value) {
+	if slot >= 0 && slot < r.globals.size {
+		r.globals.data[slot] = item
+	}
+}
+
+// SetTrace turns the tracing of each instruction on or off
+func (r *Runner) SetTrace(trace bool) {
+	r.trace = trace
+}
+
+// Stack returns the items on the stack, from the bottom up
+func (r *Runner) Stack() []Value {
+	items := make([]Value, r.stack.Len())
+	copy(items, r.stack.data)
+	return items
+}
+
+// Global returns the global variable held in a slot
+func (r *Runner) Global(slot int) Value {
+	if slot < 0 || slot >= r.globals.size {
+		return Nil
+	}
+	return r.globals.data[slot]
+}
+
+// Throw halts the Runner and returns a RuntimeError describing
+// the failure of the current instruction
+func (r *Runner) Throw(kind ErrorKind, message string) error {
+	r.panic = true
+
+	var instr *Instruction
+	if r.ip >= 0 && r.ip < len(r.program) {
+		instr = r.program[r.ip]
+	}
+
+	frames := make([]Frame, len(r.frames))
+	copy(frames, r.frames)
+
+	return &RuntimeError{
+		Kind:        kind,
+		Message:     message,
+		Instruction: instr,
+		IP:          r.ip,
+		Frames:      frames,
+	}
+}
+
+// push puts an item on the top of the stack,
+// failing if the stack is full
+func (r *Runner) push(item Value) error {
+	if r.stack.Len() == r.stack.size {
+		return r.Throw(StackError, "cannot push because stack is full")
+	}
+	r.stack.Push(item)
+	return nil
+}
+
+// frame returns the number of arguments and local slots
+// of the current frame
+func (r *Runner) frame() (nargs, nlocals int) {
+	if len(r.frames) == 0 {
+		return 0, r.locals
+	}
+	f := r.frames[len(r.frames)-1]
+	return f.Args, f.Locals
+}
+
+// local returns the position on the stack of an argument or local
+// variable of the current frame. Arguments are numbered first and
+// sit below the frame header of nargs, fp and return address,
+// whereas locals sit above it
+func (r *Runner) local(address Value) (int, error) {
+	n := int(address.Content.(float64))
+	nargs, nlocals := r.frame()
+	if n < 0 || n >= nargs+nlocals {
+		return 0, r.Throw(CodeError, fmt.Sprintf("local address %d out of range", n))
+	}
+	if n < nargs {
+		return r.fp - 2 - nargs + n, nil
+	}
+	return r.fp + 1 + n - nargs, nil
+}
+
+// global returns the index of a global variable
+func (r *Runner) global(address Value) (int, error) {
+	n := int(address.Content.(float64))
+	if n < 0 || n >= r.globals.size {
+		return 0, r.Throw(CodeError, fmt.Sprintf("global address %d out of range", n))
+	}
+	return n, nil
+}
+
+// call enters a function at addr, whose nargs
+// arguments are already on the stack
+func (r *Runner) call(addr, nargs int, closure *Closure) error {
+	if r.stack.Len() < nargs {
+		return r.Throw(StackError, fmt.Sprintf("cannot call with %d args because stack is empty", nargs))
+	}
+	if r.stack.Len()+3 > r.stack.size {
+		return r.Throw(StackError, "cannot call because stack is full")
+	}
+	if r.limits.CallDepth > 0 && len(r.frames) >= r.limits.CallDepth {
+		return r.Throw(LimitError, fmt.Sprintf("exceeded call depth of %d", r.limits.CallDepth))
+	}
+
+	fpVal := Value{
+		Kind:    NumberValue,
+		Content: float64(r.fp),
+	}
+	ipVal := Value{
+		Kind:    NumberValue,
+		Content: float64(r.ip),
+	}
+	r.stack.Push(Value{Kind: NumberValue, Content: float64(nargs)})
+	r.stack.Push(fpVal)
+	r.stack.Push(ipVal)
+
+	r.fp = r.stack.pointer // fp points to the return address on the stack
+	r.frames = append(r.frames, Frame{
+		Address: addr,
+		Return:  r.ip,
+		Args:    nargs,
+		Closure: closure,
+	})
+	r.ip = addr
+	return nil
+}
+
+// branch jumps to addr if cond holds, otherwise
+// moving on to the next instruction
+func (r *Runner) branch(addr Value, cond bool) {
+	if cond {
+		r.ip = int(addr.Content.(float64))
+	} else {
+		r.ip++
+	}
+}
+
+// unordered is the order of two numbers either of which is NaN,
+// which satisfies no comparison
+const unordered = 2
+
+// compare orders two numbers or two strings, returning a negative
+// number if a comes before b, zero if they are equal and a positive
+// number if a comes after b, or unordered if either is NaN. ok is
+// false for any other kinds
+func compare(a, b Value) (order int, ok bool) {
+	if a.Kind == NumberValue && b.Kind == NumberValue {
+		x, y := a.Content.(float64), b.Content.(float64)
+		if math.IsNaN(x) || math.IsNaN(y) {
+			return unordered, true
+		} else if x < y {
+			return -1, true
+		} else if x > y {
+			return 1, true
+		}
+		return 0, true
+	} else if a.Kind == StringValue && b.Kind == StringValue {
+		return strings.Compare(a.Content.(string), b.Content.(string)), true
+	}
+	return 0, false
+}
+
+// holds reports whether the ordering of two values satisfies
+// the relation tested by a comparison opcode
+func holds(op Opcode, order int) bool {
+	if order == unordered {
+		return false
+	}
+	switch op {
+	case LessThan, IfLessThan:
+		return order < 0
+	case LessThanOrEqual, IfLessThanOrEqual:
+		return order <= 0
+	case GreaterThan, IfGreaterThan:
+		return order > 0
+	case GreaterThanOrEqual, IfGreaterThanOrEqual:
+		return order >= 0
+	}
+	return false
+}
+
+// SetBudget limits each run to n instructions, or
+// removes the limit if n is 0
+func (r *Runner) SetBudget(n int) {
+	r.budget = n
+}
+
+// SetTimeout limits the duration of each run, or
+// removes the limit if d is 0
+func (r *Runner) SetTimeout(d time.Duration) {
+	r.timeout = d
+}
+
+// RunContext runs the program as Run does, stopping with a
+// CancelError or TimeoutError once ctx is cancelled or expires
+func (r *Runner) RunContext(ctx context.Context) error {
+	r.ctx = ctx
+	defer func() { r.ctx = nil }()
+	return r.Run()
+}
+
+// check stops the run if it has exhausted its budget, run out
+// of time or been cancelled, and otherwise decides when to
+// check again
+func (r *Runner) check() error {
+	if r.budget > 0 && r.steps >= r.budget {
+		return r.Throw(BudgetError, fmt.Sprintf("exceeded budget of %d instructions", r.budget))
+	}
+	if err := r.interrupted(); err != nil {
+		return err
+	}
+
+	r.next = r.steps + checkInterval
+	if r.budget > 0 && r.next > r.budget {
+		r.next = r.budget
+	}
+	return nil
+}
+
+// interrupted stops the run if it has run out of time or been
+// cancelled. Unlike check it ignores the budget, which is only
+// exceeded by starting another instruction
+func (r *Runner) interrupted() error {
+	if r.ctx != nil {
+		switch r.ctx.Err() {
+		case context.Canceled:
+			return r.Throw(CancelError, "run was cancelled")
+		case context.DeadlineExceeded:
+			return r.Throw(TimeoutError, "run exceeded the deadline of its context")
+		}
+	}
+	if r.timeout > 0 && time.Now().After(r.deadline) {
+		return r.Throw(TimeoutError, fmt.Sprintf("run exceeded timeout of %s", r.timeout))
+	}
+	return nil
 }
 
 // Run will begin executing the program loaded into the Runner
-func (r *Runner) Run() {
+// and returns a *RuntimeError if execution fails
+func (r *Runner) Run() (err error) {
+	// Malformed programs (such as operands of the wrong kind)
+	// must not bring down the host process
+	defer func() {
+		if p := recover(); p != nil {
+			err = r.Throw(CodeError, fmt.Sprint(p))
+		}
+	}()
+
+	r.steps, r.next, r.heap = 0, 0, 0
+	if r.timeout > 0 {
+		r.deadline = time.Now().Add(r.timeout)
+	}
+
 loop:
 	for !r.panic && r.ip < len(r.program) {
+		if r.steps >= r.next {
+			if err := r.check(); err != nil {
+				return err
+			}
+		}
+		r.steps++
 		instr := r.program[r.ip]
 
 		// Decode & Execute
@@ -45,57 +417,129 @@ loop:
 		case Halt:
 			break loop
 		case Const:
-			operand := instr.NextOperand()
-			if operand == Nil {
-				Throw(CodeError, fmt.Sprintf("expected operand from %s", instr.Display()))
+			// nil is a valid constant so check for a
+			// missing operand and a full stack directly
+			if len(instr.Operands) == 0 {
+				return r.Throw(CodeError, fmt.Sprintf("expected operand from %s", instr.Display()))
+			}
+			if r.stack.Len() == r.stack.size {
+				return r.Throw(StackError, "cannot add because stack is full")
 			}
-			item := r.stack.Push(operand)
-			if item == Nil {
-				Throw(StackError, "cannot add because stack is full")
+			item := instr.NextOperand()
+			if item.Kind == StringValue && r.limits.StringLen > 0 && len(item.Content.(string)) > r.limits.StringLen {
+				return r.Throw(LimitError, fmt.Sprintf("string of %d bytes exceeds limit of %d", len(item.Content.(string)), r.limits.StringLen))
 			}
+			r.stack.Push(item)
 			r.ip++
 
 		case Store:
 			address := instr.NextOperand()
 			if address == Nil {
-				Throw(CodeError, fmt.Sprintf("expected operand from %s", instr.Display()))
+				return r.Throw(CodeError, fmt.Sprintf("expected operand from %s", instr.Display()))
 			}
-			// Check for nil value
-			r.stack.Store(address)
+			if r.stack.Len() < 1 {
+				return r.Throw(StackError, "cannot store because stack is empty")
+			}
+			slot, err := r.local(address)
+			if err != nil {
+				return err
+			}
+			r.stack.data[slot] = r.stack.Pop()
 			r.ip++
 
 		case Fetch:
 			address := instr.NextOperand()
 			if address == Nil {
-				Throw(CodeError, fmt.Sprintf("expected operand from %s", instr.Display()))
+				return r.Throw(CodeError, fmt.Sprintf("expected operand from %s", instr.Display()))
+			}
+			slot, err := r.local(address)
+			if err != nil {
+				return err
+			}
+			if err := r.push(r.stack.data[slot]); err != nil {
+				return err
+			}
+			r.ip++
+
+		case Enter:
+			n := int(instr.NextOperand().Content.(float64))
+			_, nlocals := r.frame()
+
+			// Locals must be contiguous, so nothing else
+			// may have been pushed within the frame
+			if r.stack.pointer != r.fp+nlocals {
+				return r.Throw(CodeError, "cannot reserve locals after pushing within a frame")
+			}
+			if n < 0 || r.stack.Len()+n > r.stack.size {
+				return r.Throw(StackError, fmt.Sprintf("cannot reserve %d locals because stack is full", n))
+			}
+			for i := 0; i < n; i++ {
+				r.stack.Push(Nil)
+			}
+
+			if len(r.frames) == 0 {
+				r.locals += n
+			} else {
+				r.frames[len(r.frames)-1].Locals += n
 			}
-			// Check for nil value
-			r.stack.Fetch(address)
 			r.ip++
 
 		case GStore:
 			address := instr.NextOperand()
 			if address == Nil {
-				Throw(CodeError, fmt.Sprintf("expected operand from %s", instr.Display()))
+				return r.Throw(CodeError, fmt.Sprintf("expected operand from %s", instr.Display()))
+			}
+			if r.stack.Len() < 1 {
+				return r.Throw(StackError, "cannot store because stack is empty")
+			}
+			slot, err := r.global(address)
+			if err != nil {
+				return err
 			}
-			// Check for nil value
-			r.globals.Store(address)
+			if r.consts[slot] {
+				return r.Throw(ValueError, fmt.Sprintf("cannot store to constant global %d", slot))
+			}
+			r.globals.data[slot] = r.stack.Pop()
+			r.ip++
+
+		case GDefine:
+			address := instr.NextOperand()
+			if address == Nil {
+				return r.Throw(CodeError, fmt.Sprintf("expected operand from %s", instr.Display()))
+			}
+			if r.stack.Len() < 1 {
+				return r.Throw(StackError, "cannot define because stack is empty")
+			}
+			slot, err := r.global(address)
+			if err != nil {
+				return err
+			}
+			if r.consts[slot] {
+				return r.Throw(ValueError, fmt.Sprintf("cannot redefine constant global %d", slot))
+			}
+			r.globals.data[slot] = r.stack.Pop()
+			r.consts[slot] = true
 			r.ip++
 
 		case GFetch:
 			address := instr.NextOperand()
 			if address == Nil {
-				Throw(CodeError, fmt.Sprintf("expected operand from %s", instr.Display()))
+				return r.Throw(CodeError, fmt.Sprintf("expected operand from %s", instr.Display()))
+			}
+			slot, err := r.global(address)
+			if err != nil {
+				return err
+			}
+			if err := r.push(r.globals.data[slot]); err != nil {
+				return err
 			}
-			// Check for nil value
-			r.globals.Fetch(address)
 			r.ip++
 
 		case Pop:
-			item := r.stack.Pop()
-			if item == Nil {
-				Throw(StackError, "cannot pop because stack is empty")
+			if r.stack.Len() < 1 {
+				return r.Throw(StackError, "cannot pop because stack is empty")
 			}
+			r.stack.Pop()
 			r.ip++
 
 		case Add:
@@ -103,7 +547,7 @@ loop:
 			b := r.stack.Pop()
 
 			if a == Nil || b == Nil {
-				Throw(StackError, "cannot add because stack is empty")
+				return r.Throw(StackError, "cannot add because stack is empty")
 			}
 
 			if a.Kind == NumberValue && b.Kind == NumberValue {
@@ -113,10 +557,10 @@ loop:
 				}
 				item := r.stack.Push(result)
 				if item == Nil {
-					Throw(StackError, "cannot add because stack is full")
+					return r.Throw(StackError, "cannot add because stack is full")
 				}
 			} else {
-				Throw(ValueError, fmt.Sprintf("cannot add %s value to %s value", ValueKinds[a.Kind], ValueKinds[b.Kind]))
+				return r.Throw(ValueError, fmt.Sprintf("cannot add %s value to %s value", ValueKinds[a.Kind], ValueKinds[b.Kind]))
 			}
 			r.ip++
 
@@ -125,7 +569,7 @@ loop:
 			b := r.stack.Pop()
 
 			if a == Nil || b == Nil {
-				Throw(StackError, "cannot sub because stack is empty")
+				return r.Throw(StackError, "cannot sub because stack is empty")
 			}
 
 			if a.Kind == NumberValue && b.Kind == NumberValue {
@@ -135,11 +579,11 @@ loop:
 				}
 				item := r.stack.Push(result)
 				if item == Nil {
-					Throw(StackError, "cannot add because stack is full")
+					return r.Throw(StackError, "cannot add because stack is full")
 				}
 				r.ip++
 			} else {
-				Throw(ValueError, fmt.Sprintf("cannot sub %s value from %s value", ValueKinds[b.Kind], ValueKinds[a.Kind]))
+				return r.Throw(ValueError, fmt.Sprintf("cannot sub %s value from %s value", ValueKinds[b.Kind], ValueKinds[a.Kind]))
 			}
 
 		case Mul:
@@ -147,7 +591,7 @@ loop:
 			b := r.stack.Pop()
 
 			if a == Nil || b == Nil {
-				Throw(StackError, "cannot mul because stack is empty")
+				return r.Throw(StackError, "cannot mul because stack is empty")
 			}
 
 			if a.Kind == NumberValue && b.Kind == NumberValue {
@@ -157,11 +601,11 @@ loop:
 				}
 				item := r.stack.Push(result)
 				if item == Nil {
-					Throw(StackError, "cannot add because stack is full")
+					return r.Throw(StackError, "cannot add because stack is full")
 				}
 				r.ip++
 			} else {
-				Throw(ValueError, fmt.Sprintf("cannot mul %s value with %s value", ValueKinds[a.Kind], ValueKinds[b.Kind]))
+				return r.Throw(ValueError, fmt.Sprintf("cannot mul %s value with %s value", ValueKinds[a.Kind], ValueKinds[b.Kind]))
 			}
 
 		case Div:
@@ -169,7 +613,7 @@ loop:
 			b := r.stack.Pop()
 
 			if a == Nil || b == Nil {
-				Throw(StackError, "cannot div because stack is empty")
+				return r.Throw(StackError, "cannot div because stack is empty")
 			}
 
 			if a.Kind == NumberValue && b.Kind == NumberValue {
@@ -179,11 +623,11 @@ loop:
 				}
 				item := r.stack.Push(result)
 				if item == Nil {
-					Throw(StackError, "cannot add because stack is full")
+					return r.Throw(StackError, "cannot add because stack is full")
 				}
 				r.ip++
 			} else {
-				Throw(ValueError, fmt.Sprintf("cannot div %s value by %s value", ValueKinds[b.Kind], ValueKinds[a.Kind]))
+				return r.Throw(ValueError, fmt.Sprintf("cannot div %s value by %s value", ValueKinds[b.Kind], ValueKinds[a.Kind]))
 			}
 
 		case And:
@@ -191,7 +635,7 @@ loop:
 			b := r.stack.Pop()
 
 			if a == Nil || b == Nil {
-				Throw(StackError, "cannot and because stack is empty")
+				return r.Throw(StackError, "cannot and because stack is empty")
 			}
 
 			if a.Kind == NumberValue && b.Kind == NumberValue {
@@ -201,11 +645,11 @@ loop:
 				}
 				item := r.stack.Push(result)
 				if item == Nil {
-					Throw(StackError, "cannot add because stack is full")
+					return r.Throw(StackError, "cannot add because stack is full")
 				}
 				r.ip++
 			} else {
-				Throw(ValueError, fmt.Sprintf("cannot and %s value with %s value", ValueKinds[a.Kind], ValueKinds[b.Kind]))
+				return r.Throw(ValueError, fmt.Sprintf("cannot and %s value with %s value", ValueKinds[a.Kind], ValueKinds[b.Kind]))
 			}
 
 		case Or:
@@ -213,7 +657,7 @@ loop:
 			b := r.stack.Pop()
 
 			if a == Nil || b == Nil {
-				Throw(StackError, "cannot or because stack is empty")
+				return r.Throw(StackError, "cannot or because stack is empty")
 			}
 
 			if a.Kind == NumberValue && b.Kind == NumberValue {
@@ -223,11 +667,11 @@ loop:
 				}
 				item := r.stack.Push(result)
 				if item == Nil {
-					Throw(StackError, "cannot add because stack is full")
+					return r.Throw(StackError, "cannot add because stack is full")
 				}
 				r.ip++
 			} else {
-				Throw(ValueError, fmt.Sprintf("cannot or %s value with %s value", ValueKinds[a.Kind], ValueKinds[b.Kind]))
+				return r.Throw(ValueError, fmt.Sprintf("cannot or %s value with %s value", ValueKinds[a.Kind], ValueKinds[b.Kind]))
 			}
 
 		case Xor:
@@ -235,7 +679,7 @@ loop:
 			b := r.stack.Pop()
 
 			if a == Nil || b == Nil {
-				Throw(StackError, "cannot xor because stack is empty")
+				return r.Throw(StackError, "cannot xor because stack is empty")
 			}
 
 			if a.Kind == NumberValue && b.Kind == NumberValue {
@@ -245,11 +689,11 @@ loop:
 				}
 				item := r.stack.Push(result)
 				if item == Nil {
-					Throw(StackError, "cannot add because stack is full")
+					return r.Throw(StackError, "cannot add because stack is full")
 				}
 				r.ip++
 			} else {
-				Throw(ValueError, fmt.Sprintf("cannot xor %s value with %s value", ValueKinds[a.Kind], ValueKinds[b.Kind]))
+				return r.Throw(ValueError, fmt.Sprintf("cannot xor %s value with %s value", ValueKinds[a.Kind], ValueKinds[b.Kind]))
 			}
 
 		case IfEqual:
@@ -258,93 +702,90 @@ loop:
 			b := r.stack.Pop()
 
 			if a == Nil || b == Nil {
-				Throw(StackError, "cannot make comparison because stack is empty")
+				return r.Throw(StackError, "cannot make comparison because stack is empty")
 			}
 
 			if a.Kind == NumberValue && b.Kind == NumberValue {
-				if a == b {
-					r.ip = int(addr.Content.(float64))
-				}
+				r.branch(addr, a == b)
 			} else if a.Kind == StringValue && b.Kind == StringValue {
-				if a == b {
-					r.ip = int(addr.Content.(float64))
-				}
+				r.branch(addr, a == b)
 			} else {
-				Throw(ValueError, fmt.Sprintf("cannot make comparison between %s value and %s value", ValueKinds[a.Kind], ValueKinds[b.Kind]))
+				return r.Throw(ValueError, fmt.Sprintf("cannot make comparison between %s value and %s value", ValueKinds[a.Kind], ValueKinds[b.Kind]))
 			}
 
-		case IfLessThan:
+		case IfLessThan, IfLessThanOrEqual, IfGreaterThan, IfGreaterThanOrEqual:
 			addr := instr.NextOperand()
 			a := r.stack.Pop()
 			b := r.stack.Pop()
 
 			if a == Nil || b == Nil {
-				Throw(StackError, "cannot make comparison because stack is empty")
+				return r.Throw(StackError, "cannot make comparison because stack is empty")
 			}
 
-			if a.Kind == NumberValue && b.Kind == NumberValue {
-				if a.Content.(float64) < b.Content.(float64) {
-					r.ip = int(addr.Content.(float64))
-				}
-			} else {
-				Throw(ValueError, fmt.Sprintf("cannot make comparison between %s value and %s value", ValueKinds[a.Kind], ValueKinds[b.Kind]))
+			order, ok := compare(b, a)
+			if !ok {
+				return r.Throw(ValueError, fmt.Sprintf("cannot make comparison between %s value and %s value", ValueKinds[b.Kind], ValueKinds[a.Kind]))
 			}
+			r.branch(addr, holds(instr.Code, order))
 
-		case IfLessThanOrEqual:
-			addr := instr.NextOperand()
+		case Equal, NotEqual:
+			if r.stack.Len() < 2 {
+				return r.Throw(StackError, "cannot make comparison because stack is empty")
+			}
 			a := r.stack.Pop()
 			b := r.stack.Pop()
 
-			if a == Nil || b == Nil {
-				Throw(StackError, "cannot make comparison because stack is empty")
+			result := Value{
+				Kind:    BoolValue,
+				Content: (a == b) == (instr.Code == Equal),
 			}
+			r.stack.Push(result)
+			r.ip++
 
-			if a.Kind == NumberValue && b.Kind == NumberValue {
-				if a.Content.(float64) <= b.Content.(float64) {
-					r.ip = int(addr.Content.(float64))
-				}
-			} else {
-				Throw(ValueError, fmt.Sprintf("cannot make comparison between %s value and %s value", ValueKinds[a.Kind], ValueKinds[b.Kind]))
+		case LessThan, LessThanOrEqual, GreaterThan, GreaterThanOrEqual:
+			if r.stack.Len() < 2 {
+				return r.Throw(StackError, "cannot make comparison because stack is empty")
 			}
-
-		case IfGreaterThan:
-			addr := instr.NextOperand()
 			a := r.stack.Pop()
 			b := r.stack.Pop()
 
-			if a == Nil || b == Nil {
-				Throw(StackError, "cannot make comparison because stack is empty")
+			order, ok := compare(b, a)
+			if !ok {
+				return r.Throw(ValueError, fmt.Sprintf("cannot make comparison between %s value and %s value", ValueKinds[b.Kind], ValueKinds[a.Kind]))
 			}
 
-			if a.Kind == NumberValue && b.Kind == NumberValue {
-				if a.Content.(float64) > b.Content.(float64) {
-					r.ip = int(addr.Content.(float64))
-				}
-			} else {
-				Throw(ValueError, fmt.Sprintf("cannot make comparison between %s value and %s value", ValueKinds[a.Kind], ValueKinds[b.Kind]))
+			result := Value{
+				Kind:    BoolValue,
+				Content: holds(instr.Code, order),
 			}
+			r.stack.Push(result)
+			r.ip++
 
-		case IfGreaterThanOrEqual:
-			addr := instr.NextOperand()
+		case Not:
+			if r.stack.Len() < 1 {
+				return r.Throw(StackError, "cannot not because stack is empty")
+			}
 			a := r.stack.Pop()
-			b := r.stack.Pop()
 
-			if a == Nil || b == Nil {
-				Throw(StackError, "cannot make comparison because stack is empty")
+			result := Value{
+				Kind:    BoolValue,
+				Content: !a.Truthy(),
 			}
+			r.stack.Push(result)
+			r.ip++
 
-			if a.Kind == NumberValue && b.Kind == NumberValue {
-				if a.Content.(float64) >= b.Content.(float64) {
-					r.ip = int(addr.Content.(float64))
-				}
-			} else {
-				Throw(ValueError, fmt.Sprintf("cannot make comparison between %s value and %s value", ValueKinds[a.Kind], ValueKinds[b.Kind]))
+		case JumpIfTrue, JumpIfFalse:
+			addr := instr.NextOperand()
+			if r.stack.Len() < 1 {
+				return r.Throw(StackError, "cannot make jump because stack is empty")
 			}
+			a := r.stack.Pop()
+			r.branch(addr, a.Truthy() == (instr.Code == JumpIfTrue))
 
 		case Goto:
 			addr := instr.NextOperand()
 			if addr == Nil {
-				Throw(CodeError, fmt.Sprintf("expected operand from %s", instr.Display()))
+				return r.Throw(CodeError, fmt.Sprintf("expected operand from %s", instr.Display()))
 			}
 			r.ip = int(addr.Content.(float64))
 
@@ -355,31 +796,230 @@ loop:
 			nargs := instr.NextOperand()
 
 			if addr == Nil || nargs == Nil {
-				Throw(CodeError, fmt.Sprintf("expected address and nargs operands from %s", instr.Display()))
+				return r.Throw(CodeError, fmt.Sprintf("expected address and nargs operands from %s", instr.Display()))
+			}
+			if err := r.call(int(addr.Content.(float64)), int(nargs.Content.(float64)), nil); err != nil {
+				return err
+			}
+
+		case CallValue:
+			nargs := int(instr.NextOperand().Content.(float64))
+			if r.stack.Len() < 1 {
+				return r.Throw(StackError, "cannot call because stack is empty")
 			}
 
-			fpVal := Value{
-				Kind:    NumberValue,
-				Content: float64(r.fp),
+			fn := r.stack.Pop()
+			if fn.Kind == EntityValue {
+				if err := r.construct(fn.Content.(*Entity), nargs); err != nil {
+					return err
+				}
+				r.ip++
+				break
 			}
-			ipVal := Value{
-				Kind:    NumberValue,
-				Content: float64(r.ip),
+			if fn.Kind != FunctionValue {
+				return r.Throw(ValueError, fmt.Sprintf("cannot call %s value", ValueKinds[fn.Kind]))
 			}
-			r.stack.Push(nargs)
-			r.stack.Push(fpVal)
-			r.stack.Push(ipVal)
 
-			r.fp = r.stack.pointer // fp points to the return address on the stack
-			r.ip = int(addr.Content.(float64))
+			closure := fn.Content.(*Closure)
+			if nargs != closure.Arity {
+				return r.Throw(ValueError, fmt.Sprintf("%s expects %d arguments, found %d", closure.Name, closure.Arity, nargs))
+			}
+			if r.stack.Len() < nargs {
+				return r.Throw(StackError, fmt.Sprintf("cannot call with %d args because stack is empty", nargs))
+			}
+
+			// Bound methods receive their instance beneath the arguments
+			if closure.Self != nil {
+				if err := r.push(Nil); err != nil {
+					return err
+				}
+				args := r.stack.data[r.stack.pointer-nargs : r.stack.pointer+1]
+				copy(args[1:], args[:nargs])
+				args[0] = *closure.Self
+				nargs++
+			}
+			if err := r.call(closure.Address, nargs, closure); err != nil {
+				return err
+			}
+
+		case MakeEntity:
+			n := int(instr.NextOperand().Content.(float64))
+			name := instr.NextOperand()
+			if name.Kind != StringValue {
+				return r.Throw(CodeError, fmt.Sprintf("expected name operand from %s", instr.Display()))
+			}
+			if n < 0 || r.stack.Len() < n {
+				return r.Throw(StackError, fmt.Sprintf("cannot make entity of %d fields because stack is empty", n))
+			}
+
+			fields := make([]string, n)
+			for i := n - 1; i >= 0; i-- {
+				field := r.stack.Pop()
+				if field.Kind != StringValue {
+					return r.Throw(ValueError, fmt.Sprintf("cannot use %s value as field name", ValueKinds[field.Kind]))
+				}
+				fields[i] = field.Content.(string)
+			}
+			r.stack.Push(NewEntity(name.Content.(string), fields))
+			r.ip++
+
+		case Method:
+			name := instr.NextOperand()
+			if name.Kind != StringValue {
+				return r.Throw(CodeError, fmt.Sprintf("expected name operand from %s", instr.Display()))
+			}
+			if r.stack.Len() < 2 {
+				return r.Throw(StackError, "cannot declare method because stack is empty")
+			}
+			fn := r.stack.Pop()
+			entity := r.stack.Pop()
+			if fn.Kind != FunctionValue || entity.Kind != EntityValue {
+				return r.Throw(ValueError, fmt.Sprintf("cannot declare %s value as method of %s value", ValueKinds[fn.Kind], ValueKinds[entity.Kind]))
+			}
+			entity.Content.(*Entity).methods[name.Content.(string)] = fn.Content.(*Closure)
+			r.ip++
+
+		case GetField:
+			name := instr.NextOperand()
+			if r.stack.Len() < 1 {
+				return r.Throw(StackError, "cannot get field because stack is empty")
+			}
+			var item Value
+			var err error
+			switch x := r.stack.Pop(); x.Kind {
+			case InstanceValue:
+				item, err = x.Content.(*Instance).Get(fmt.Sprint(name.Content))
+			case ModuleValue:
+				item, err = x.Content.(*Module).Get(fmt.Sprint(name.Content))
+			default:
+				return r.Throw(ValueError, fmt.Sprintf("cannot get field of %s value", ValueKinds[x.Kind]))
+			}
+			if err != nil {
+				return r.Throw(ValueError, err.Error())
+			}
+			r.stack.Push(item)
+			r.ip++
+
+		case MakeModule:
+			n := int(instr.NextOperand().Content.(float64))
+			name := instr.NextOperand()
+			if name.Kind != StringValue {
+				return r.Throw(CodeError, fmt.Sprintf("expected name operand from %s", instr.Display()))
+			}
+			if n < 0 || r.stack.Len() < n*2 {
+				return r.Throw(StackError, fmt.Sprintf("cannot make module of %d exports because stack is empty", n))
+			}
+
+			module := NewModule(name.Content.(string))
+			pairs := r.stack.data[r.stack.pointer-n*2+1 : r.stack.pointer+1]
+			for i := 0; i < n*2; i += 2 {
+				if pairs[i].Kind != StringValue {
+					return r.Throw(ValueError, fmt.Sprintf("cannot export %s value as name", ValueKinds[pairs[i].Kind]))
+				}
+				module.Content.(*Module).Export(pairs[i].Content.(string), pairs[i+1])
+			}
+			r.stack.pointer -= n * 2
+			r.stack.Push(module)
+			r.ip++
+
+		case CallNative:
+			name := instr.NextOperand()
+			nargs := int(instr.NextOperand().Content.(float64))
+			if err := r.callNative(name, nargs); err != nil {
+				return err
+			}
+			r.ip++
+
+		case SetField:
+			name := instr.NextOperand()
+			if r.stack.Len() < 2 {
+				return r.Throw(StackError, "cannot set field because stack is empty")
+			}
+			item := r.stack.Pop()
+			instance := r.stack.Pop()
+			if instance.Kind != InstanceValue {
+				return r.Throw(ValueError, fmt.Sprintf("cannot set field of %s value", ValueKinds[instance.Kind]))
+			}
+
+			if err := instance.Content.(*Instance).Set(fmt.Sprint(name.Content), item); err != nil {
+				return r.Throw(ValueError, err.Error())
+			}
+			r.ip++
+
+		case MakeClosure:
+			addr := instr.NextOperand()
+			arity := instr.NextOperand()
+			name := instr.NextOperand()
+			if addr.Kind != NumberValue || arity.Kind != NumberValue || name.Kind != StringValue {
+				return r.Throw(CodeError, fmt.Sprintf("expected address, arity and name operands from %s", instr.Display()))
+			}
+			if err := r.allocate(headerSize); err != nil {
+				return err
+			}
+			fn := NewClosure(name.Content.(string), int(addr.Content.(float64)), int(arity.Content.(float64)))
+			if err := r.push(fn); err != nil {
+				return err
+			}
+			r.ip++
+
+		case Capture, CaptureUp:
+			address := instr.NextOperand()
+			if r.stack.Len() < 1 || r.stack.Peek().Kind != FunctionValue {
+				return r.Throw(ValueError, "cannot capture without a function on top of the stack")
+			}
+
+			var upvalue *Upvalue
+			if instr.Code == Capture {
+				slot, err := r.local(address)
+				if err != nil {
+					return err
+				}
+				upvalue = r.capture(slot)
+			} else {
+				u, err := r.upvalue(address)
+				if err != nil {
+					return err
+				}
+				upvalue = u
+			}
+
+			closure := r.stack.Peek().Content.(*Closure)
+			closure.Upvalues = append(closure.Upvalues, upvalue)
+			r.ip++
+
+		case UFetch:
+			upvalue, err := r.upvalue(instr.NextOperand())
+			if err != nil {
+				return err
+			}
+			if err := r.push(upvalue.get(r.stack)); err != nil {
+				return err
+			}
+			r.ip++
+
+		case UStore:
+			upvalue, err := r.upvalue(instr.NextOperand())
+			if err != nil {
+				return err
+			}
+			if r.stack.Len() < 1 {
+				return r.Throw(StackError, "cannot store because stack is empty")
+			}
+			upvalue.set(r.stack, r.stack.Pop())
+			r.ip++
 
 		case Return:
 			// TODO: add error checking
-			retVal := r.stack.Pop()
-			if retVal == Nil {
-				Throw(CodeError, "no value returned from function")
+			if len(r.frames) == 0 {
+				return r.Throw(CodeError, "cannot return from outside of a function")
 			}
 
+			if _, nlocals := r.frame(); r.stack.pointer <= r.fp+nlocals {
+				return r.Throw(CodeError, "no value returned from function")
+			}
+			retVal := r.stack.Pop()
+
+			// Discard the locals and anything else pushed within the frame
 			r.stack.pointer = r.fp
 			r.ip = int(r.stack.Pop().Content.(float64))
 			r.fp = int(r.stack.Pop().Content.(float64))
@@ -389,28 +1029,272 @@ loop:
 			for i := 0; i < nargs; i++ {
 				r.stack.Pop()
 			}
+			r.close()
+
+			r.frames = r.frames[:len(r.frames)-1]
 
 			// Leave result on stack
 			r.stack.Push(retVal)
 			r.ip++
 
+		case MakeList:
+			n := int(instr.NextOperand().Content.(float64))
+			if n < 0 || r.stack.Len() < n {
+				return r.Throw(StackError, fmt.Sprintf("cannot make list of %d items because stack is empty", n))
+			}
+
+			if err := r.grow(ListValue, n, n); err != nil {
+				return err
+			}
+			if err := r.allocate(headerSize); err != nil {
+				return err
+			}
+
+			items := make([]Value, n)
+			for i := n - 1; i >= 0; i-- {
+				items[i] = r.stack.Pop()
+			}
+			r.stack.Push(NewList(items))
+			r.ip++
+
+		case Get:
+			if r.stack.Len() < 2 {
+				return r.Throw(StackError, "cannot get because stack is empty")
+			}
+			key := r.stack.Pop()
+			collection := r.stack.Pop()
+
+			var item Value
+			switch collection.Kind {
+			case ListValue:
+				items := collection.Content.(*List).Items
+				i, err := toIndex(key, len(items))
+				if err != nil {
+					return r.Throw(ValueError, err.Error())
+				}
+				item = items[i]
+			case StringValue:
+				runes := []rune(collection.Content.(string))
+				i, err := toIndex(key, len(runes))
+				if err != nil {
+					return r.Throw(ValueError, err.Error())
+				}
+				item = Value{Kind: StringValue, Content: string(runes[i])}
+			case MapValue:
+				if err := checkKey(key); err != nil {
+					return r.Throw(ValueError, err.Error())
+				}
+				item, _ = collection.Content.(*Map).Get(key)
+			default:
+				return r.Throw(ValueError, fmt.Sprintf("cannot get item of %s value", ValueKinds[collection.Kind]))
+			}
+			r.stack.Push(item)
+			r.ip++
+
+		case Set:
+			if r.stack.Len() < 3 {
+				return r.Throw(StackError, "cannot set because stack is empty")
+			}
+			item := r.stack.Pop()
+			key := r.stack.Pop()
+			collection := r.stack.Pop()
+
+			switch collection.Kind {
+			case ListValue:
+				items := collection.Content.(*List).Items
+				i, err := toIndex(key, len(items))
+				if err != nil {
+					return r.Throw(ValueError, err.Error())
+				}
+				items[i] = item
+			case MapValue:
+				if err := checkKey(key); err != nil {
+					return r.Throw(ValueError, err.Error())
+				}
+				m := collection.Content.(*Map)
+				if _, ok := m.Get(key); !ok {
+					if err := r.grow(MapValue, m.Len()+1, 1); err != nil {
+						return err
+					}
+				}
+				m.Set(key, item)
+			default:
+				return r.Throw(ValueError, fmt.Sprintf("cannot set item of %s value", ValueKinds[collection.Kind]))
+			}
+			r.ip++
+
+		case Append:
+			if r.stack.Len() < 2 {
+				return r.Throw(StackError, "cannot append because stack is empty")
+			}
+			item := r.stack.Pop()
+			list := r.stack.Pop()
+
+			if list.Kind != ListValue {
+				return r.Throw(ValueError, fmt.Sprintf("cannot append to %s value", ValueKinds[list.Kind]))
+			}
+			l := list.Content.(*List)
+			if err := r.grow(ListValue, len(l.Items)+1, 1); err != nil {
+				return err
+			}
+			l.Items = append(l.Items, item)
+			r.ip++
+
+		case Length:
+			if r.stack.Len() < 1 {
+				return r.Throw(StackError, "cannot len because stack is empty")
+			}
+			collection := r.stack.Pop()
+
+			n, ok := length(collection)
+			if !ok {
+				return r.Throw(ValueError, fmt.Sprintf("cannot take length of %s value", ValueKinds[collection.Kind]))
+			}
+			r.stack.Push(Value{Kind: NumberValue, Content: float64(n)})
+			r.ip++
+
+		case Slice:
+			if r.stack.Len() < 3 {
+				return r.Throw(StackError, "cannot slice because stack is empty")
+			}
+			end := r.stack.Pop()
+			start := r.stack.Pop()
+			collection := r.stack.Pop()
+
+			n, ok := length(collection)
+			if !ok {
+				return r.Throw(ValueError, fmt.Sprintf("cannot slice %s value", ValueKinds[collection.Kind]))
+			}
+			low, high, err := toBounds(start, end, n)
+			if err != nil {
+				return r.Throw(ValueError, err.Error())
+			}
+
+			if collection.Kind == StringValue {
+				runes := []rune(collection.Content.(string))
+				s := string(runes[low:high])
+				if err := r.text(s); err != nil {
+					return err
+				}
+				r.stack.Push(Value{Kind: StringValue, Content: s})
+			} else {
+				if err := r.grow(ListValue, high-low, high-low); err != nil {
+					return err
+				}
+				items := make([]Value, high-low)
+				copy(items, collection.Content.(*List).Items[low:high])
+				r.stack.Push(NewList(items))
+			}
+			r.ip++
+
+		case Iter:
+			if r.stack.Len() < 1 {
+				return r.Throw(StackError, "cannot iter because stack is empty")
+			}
+			collection := r.stack.Pop()
+
+			it, ok := NewIterator(collection)
+			if !ok {
+				return r.Throw(ValueError, fmt.Sprintf("cannot iterate over %s value", ValueKinds[collection.Kind]))
+			}
+
+			// Strings and maps are iterated over a new list
+			// of their characters or keys
+			if collection.Kind != ListValue {
+				n, _ := length(collection)
+				if err := r.allocate(headerSize + n*valueSize); err != nil {
+					return err
+				}
+			}
+			r.stack.Push(it)
+			r.ip++
+
+		case Next:
+			addr := instr.NextOperand()
+			it := r.stack.Peek()
+			if it.Kind != IteratorValue {
+				return r.Throw(ValueError, fmt.Sprintf("cannot take next item of %s value", ValueKinds[it.Kind]))
+			}
+
+			item, ok := it.Content.(*Iterator).Next()
+			if !ok {
+				r.stack.Pop()
+				r.branch(addr, true)
+				break
+			}
+			if err := r.push(item); err != nil {
+				return err
+			}
+			r.ip++
+
+		case MakeMap:
+			n := int(instr.NextOperand().Content.(float64))
+			if n < 0 || r.stack.Len() < 2*n {
+				return r.Throw(StackError, fmt.Sprintf("cannot make map of %d items because stack is empty", n))
+			}
+
+			if err := r.grow(MapValue, n, n); err != nil {
+				return err
+			}
+			if err := r.allocate(headerSize); err != nil {
+				return err
+			}
+
+			pairs := make([]Value, 2*n)
+			for i := 2*n - 1; i >= 0; i-- {
+				pairs[i] = r.stack.Pop()
+			}
+
+			m := NewMap()
+			for i := 0; i < len(pairs); i += 2 {
+				if err := checkKey(pairs[i]); err != nil {
+					return r.Throw(ValueError, err.Error())
+				}
+				m.Content.(*Map).Set(pairs[i], pairs[i+1])
+			}
+			r.stack.Push(m)
+			r.ip++
+
+		case Delete, Has:
+			if r.stack.Len() < 2 {
+				return r.Throw(StackError, fmt.Sprintf("cannot %s because stack is empty", Instructions[instr.Code]))
+			}
+			key := r.stack.Pop()
+			m := r.stack.Pop()
+
+			if m.Kind != MapValue {
+				return r.Throw(ValueError, fmt.Sprintf("cannot %s key of %s value", Instructions[instr.Code], ValueKinds[m.Kind]))
+			}
+			if err := checkKey(key); err != nil {
+				return r.Throw(ValueError, err.Error())
+			}
+
+			if instr.Code == Delete {
+				m.Content.(*Map).Delete(key)
+			} else {
+				_, ok := m.Content.(*Map).Get(key)
+				r.stack.Push(Value{Kind: BoolValue, Content: ok})
+			}
+			r.ip++
+
 		case Print:
-			fmt.Println(r.stack.Peek())
+			fmt.Fprintln(r.out, r.stack.Peek())
 			r.ip++
 
 		default:
-			fmt.Printf("Unrecognised opcode %d\n", instr.Code)
-			break loop
+			return r.Throw(CodeError, fmt.Sprintf("unrecognised opcode %d", instr.Code))
 		}
 
 		if r.trace {
 			out := instr.Display()
 			if out != "" {
-				fmt.Printf("%04d ", r.ip)
-				fmt.Print(instr.Display())
-				fmt.Printf("\tstack %v \t(%v)", r.stack.data, r.stack.Peek())
-				fmt.Printf("\t*%d\n", r.stack.pointer)
+				fmt.Fprintf(r.out, "%04d ", r.ip)
+				fmt.Fprint(r.out, instr.Display())
+				fmt.Fprintf(r.out, "\tstack %v \t(%v)", r.stack.data[:r.stack.Len()], r.stack.Peek())
+				fmt.Fprintf(r.out, "\t*%d\n", r.stack.pointer)
 			}
 		}
 	}
+
+	return nil
 }
@@ -0,0 +1,184 @@
+package vm
+
+import (
+	"fmt"
+	"io/ioutil"
+	"math"
+	"testing"
+)
+
+// runSource assembles and runs a program, returning the item
+// on top of the stack once it halts
+func runSource(t *testing.T, source string) (Value, error) {
+	program, diagnostics, err := Assemble(source)
+	if err != nil {
+		t.Fatalf("%s\n%v\n%s", err, diagnostics, source)
+	}
+
+	r := NewRunner(program, 64, 0, false)
+	r.SetOutput(ioutil.Discard)
+	err = r.Run()
+	if stack := r.Stack(); len(stack) > 0 {
+		return stack[len(stack)-1], err
+	}
+	return Nil, err
+}
+
+// errorKind returns the kind of a RuntimeError, or -1 for any other error
+func errorKind(err error) ErrorKind {
+	if rerr, ok := err.(*RuntimeError); ok {
+		return rerr.Kind
+	}
+	return -1
+}
+
+func number(n float64) Value { return Value{Kind: NumberValue, Content: n} }
+func text(s string) Value    { return Value{Kind: StringValue, Content: s} }
+func boolean(b bool) Value   { return Value{Kind: BoolValue, Content: b} }
+
+func TestTruthy(t *testing.T) {
+	m := NewMap()
+	m.Content.(*Map).Set(text("a"), number(1))
+
+	tests := []struct {
+		value  Value
+		truthy bool
+	}{
+		{Nil, false},
+		{boolean(false), false},
+		{boolean(true), true},
+		{number(0), false},
+		{number(math.Copysign(0, -1)), false},
+		{number(1), true},
+		{number(-1), true},
+		{number(math.NaN()), true},
+		{text(""), false},
+		{text("0"), true},
+		{NewList(nil), false},
+		{NewList([]Value{Nil}), true},
+		{NewMap(), false},
+		{m, true},
+		{NewClosure("f", 0, 0), true},
+	}
+	for _, test := range tests {
+		if got := test.value.Truthy(); got != test.truthy {
+			t.Errorf("%s %s is truthy %v, expected %v", ValueKinds[test.value.Kind], test.value, got, test.truthy)
+		}
+	}
+}
+
+// Each program leaves its result on top of the stack, or fails
+// with the error given
+var comparisonTests = []struct {
+	source string
+	result Value
+	err    ErrorKind
+}{
+	{"const 1\nconst 2\nlt", boolean(true), -1},
+	{"const 2\nconst 1\nlt", boolean(false), -1},
+	{"const 2\nconst 2\nlte", boolean(true), -1},
+	{"const 3\nconst 2\nlte", boolean(false), -1},
+	{"const 3\nconst 2\ngt", boolean(true), -1},
+	{"const 2\nconst 2\ngt", boolean(false), -1},
+	{"const 2\nconst 2\ngte", boolean(true), -1},
+	{"const 1\nconst 2\ngte", boolean(false), -1},
+	{`const "a"` + "\n" + `const "b"` + "\nlt", boolean(true), -1},
+	{"const 1\nconst 1\neq", boolean(true), -1},
+	{"const 1\nconst \"1\"\neq", boolean(false), -1},
+	{"const nil\nconst nil\neq", boolean(true), -1},
+	{"const true\nconst true\neq", boolean(true), -1},
+	{"const true\nconst false\nneq", boolean(true), -1},
+	{"const 1\nconst 2\nneq", boolean(true), -1},
+
+	// NaN is equal to nothing and satisfies no ordering
+	{"const NaN\nconst NaN\neq", boolean(false), -1},
+	{"const NaN\nconst NaN\nneq", boolean(true), -1},
+	{"const NaN\nconst 1\nlt", boolean(false), -1},
+	{"const NaN\nconst 1\nlte", boolean(false), -1},
+	{"const NaN\nconst 1\ngt", boolean(false), -1},
+	{"const 1\nconst NaN\ngte", boolean(false), -1},
+	{"const NaN\nconst NaN\nlte", boolean(false), -1},
+	{"const Inf\nconst 1\ngt", boolean(true), -1},
+
+	{"const true\nnot", boolean(false), -1},
+	{"const 0\nnot", boolean(true), -1},
+	{`const ""` + "\nnot", boolean(true), -1},
+
+	{"const 1\nconst \"a\"\nlt", Nil, ValueError},
+	{"const true\nconst 1\ngte", Nil, ValueError},
+	{"const nil\nconst nil\nlt", Nil, ValueError},
+	{"const 1\nlt", Nil, StackError},
+	{"eq", Nil, StackError},
+	{"not", Nil, StackError},
+}
+
+func TestComparisons(t *testing.T) {
+	for _, test := range comparisonTests {
+		result, err := runSource(t, test.source+"\nhalt\n")
+		if test.err >= 0 {
+			if errorKind(err) != test.err {
+				t.Errorf("%q returned %v, expected %s", test.source, err, test.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %s", test.source, err)
+		} else if result != test.result {
+			t.Errorf("%q returned %s, expected %s", test.source, result, test.result)
+		}
+	}
+}
+
+// jump runs a conditional jump, returning whether it was taken
+const jump = `
+    %s
+    %s 1f
+    const "stayed"
+    halt
+1:
+    const "jumped"
+    halt
+`
+
+var jumpTests = []struct {
+	push   string
+	jump   string
+	jumped bool
+}{
+	{"const true", "jmpt", true},
+	{"const false", "jmpt", false},
+	{"const 0", "jmpt", false},
+	{`const "x"`, "jmpt", true},
+	{"const nil", "jmpf", true},
+	{"const 1", "jmpf", false},
+	{"const 1\n    const 2", "iflt", true},
+	{"const 2\n    const 1", "iflt", false},
+	{"const 1\n    const 1", "ifeq", true},
+	{"const NaN\n    const NaN", "ifeq", false},
+	{"const NaN\n    const 1", "iflte", false},
+	{"const NaN\n    const 1", "ifgte", false},
+	{"const 1\n    const NaN", "iflt", false},
+	{"const 2\n    const 2", "ifgte", true},
+}
+
+func TestJumps(t *testing.T) {
+	for _, test := range jumpTests {
+		result, err := runSource(t, fmt.Sprintf(jump, test.push, test.jump))
+		if err != nil {
+			t.Errorf("%s after %q: %s", test.jump, test.push, err)
+			continue
+		}
+		if jumped := result == text("jumped"); jumped != test.jumped {
+			t.Errorf("%s after %q jumped %v, expected %v", test.jump, test.push, jumped, test.jumped)
+		}
+	}
+
+	for _, source := range []string{"jmpt 0", "jmpf 0"} {
+		if _, err := runSource(t, source); errorKind(err) != StackError {
+			t.Errorf("%q on an empty stack returned %v, expected a StackError", source, err)
+		}
+	}
+	if _, err := runSource(t, "const 1\nconst \"a\"\niflt 0"); errorKind(err) != ValueError {
+		t.Errorf("iflt between a number and a string returned %v, expected a ValueError", err)
+	}
+}